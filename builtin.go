@@ -29,18 +29,6 @@ func callerFileLine() (file string, line int) {
 	return
 }
 
-func assert(condition bool, a ...interface{}) {
-	if !condition {
-		file, line := callerFileLine()
-		if msg := fmt.Sprint(a...); msg != "" {
-			fmt.Fprintf(os.Stderr, "%s:%d: Assert failed, %s", file, line, msg)
-		} else {
-			fmt.Fprintf(os.Stderr, "%s:%d: Assert failed", file, line)
-		}
-		os.Exit(1)
-	}
-}
-
 func logf(format string, a ...interface{}) {
 	file, line := callerFileLine()
 	fmt.Fprintf(os.Stderr, "%s:%d: ", file, line)
@@ -53,34 +41,6 @@ func logln(a ...interface{}) {
 	fmt.Fprintln(os.Stderr, a...)
 }
 
-func fatalf(format string, a ...interface{}) {
-	file, line := callerFileLine()
-	fmt.Fprintf(os.Stderr, "%s:%d: ", file, line)
-	fmt.Fprintf(os.Stderr, format, a...)
-	os.Exit(1)
-}
-
-func fatalln(a ...interface{}) {
-	file, line := callerFileLine()
-	fmt.Fprintf(os.Stderr, "%s:%d: ", file, line)
-	fmt.Fprintln(os.Stderr, a...)
-	os.Exit(1)
-}
-
-func panicf(format string, a ...interface{}) {
-	file, line := callerFileLine()
-	s := fmt.Sprintf("%s:%d: ", file, line)
-	s += fmt.Sprint(a...)
-	panic(s)
-}
-
-func panicln(a ...interface{}) {
-	file, line := callerFileLine()
-	s := fmt.Sprintf("%s:%d: ", file, line)
-	s += fmt.Sprint(a...)
-	panic(s)
-}
-
 func errorf(format string, a ...interface{}) error {
 	return fmt.Errorf(format, a...)
 }
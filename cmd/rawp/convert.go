@@ -0,0 +1,240 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/chai2010/rawp"
+)
+
+var cmdConvert = &command{
+	name:  "convert",
+	args:  "[-snappy] [-block-size N] [-cfa PATTERN] [-demosaic METHOD] [-kind KIND] [-channels N] IN OUT",
+	short: "convert between image formats, by file extension",
+	run:   runConvert,
+}
+
+var kinds = []reflect.Kind{
+	reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+	rawp.Float16, rawp.BFloat16, reflect.Float32, reflect.Float64,
+	reflect.Complex64, reflect.Complex128,
+}
+
+func parseKind(s string) (reflect.Kind, error) {
+	for _, k := range kinds {
+		if rawp.KindString(k) == s {
+			return k, nil
+		}
+	}
+	return reflect.Invalid, fmt.Errorf("unknown kind %q", s)
+}
+
+var demosaicMethods = map[string]rawp.DemosaicMethod{
+	"bilinear": rawp.DemosaicBilinear,
+	"edge":     rawp.DemosaicEdgeAware,
+}
+
+func runConvert(cmd *command, args []string, stdout, stderr io.Writer) int {
+	fs := cmd.flagSet(stderr)
+	useSnappy := fs.Bool("snappy", false, "compress RawP output with snappy")
+	blockSize := fs.Int("block-size", 0, "split snappy data into blocks of `N` bytes (0 for one block)")
+	kindName := fs.String("kind", "", "convert samples to `KIND`: uint8, uint16, uint32, uint64, float16, bfloat16, float32, float64, complex64 or complex128")
+	channels := fs.Int("channels", 0, "convert to `N` channels: 1, 3 or 4")
+	cfaName := fs.String("cfa", "", "mark 1 channel output as raw sensor data with the CFA `PATTERN` (RGGB, BGGR, GRBG or GBRG), or demosaic with it")
+	methodName := fs.String("demosaic", "", "demosaic raw sensor data to RGB with `METHOD`: bilinear or edge")
+	files, ok := cmd.parse(fs, args, 2, 2)
+	if !ok {
+		return exitUsage
+	}
+
+	var cfa rawp.CFAPattern
+	if *cfaName != "" {
+		var err error
+		if cfa, err = rawp.ParseCFAPattern(*cfaName); err != nil {
+			fmt.Fprintf(stderr, "rawp convert: %v\n", err)
+			return exitUsage
+		}
+	}
+	method, demosaic := demosaicMethods[*methodName]
+	if *methodName != "" && !demosaic {
+		fmt.Fprintf(stderr, "rawp convert: unknown demosaic method %q\n", *methodName)
+		return exitUsage
+	}
+
+	var kind reflect.Kind
+	if *kindName != "" {
+		var err error
+		if kind, err = parseKind(*kindName); err != nil {
+			fmt.Fprintf(stderr, "rawp convert: %v\n", err)
+			return exitUsage
+		}
+	}
+
+	m, err := loadImage(files[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", files[0], err)
+		return exitFailure
+	}
+	if demosaic {
+		if m, err = rawp.Demosaic(m, cfa, method); err != nil {
+			fmt.Fprintf(stderr, "rawp convert: %v\n", err)
+			return exitFailure
+		}
+	}
+	if kind != reflect.Invalid || *channels != 0 {
+		if kind == reflect.Invalid {
+			kind = m.XDataType
+		}
+		if *channels == 0 {
+			*channels = m.XChannels
+		}
+		if m, err = rawp.Convert(m, *channels, kind); err != nil {
+			fmt.Fprintf(stderr, "rawp convert: %v\n", err)
+			return exitFailure
+		}
+	}
+
+	if cfa != rawp.CFANone && !demosaic {
+		if m.XChannels != 1 {
+			fmt.Fprintf(stderr, "rawp convert: -cfa needs 1 channel, got %d\n", m.XChannels)
+			return exitFailure
+		}
+		m.XCFA.Pattern = cfa
+	}
+
+	opt := &rawp.Options{UseSnappy: *useSnappy, BlockSize: *blockSize}
+	if err = saveImage(files[1], m, opt); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", files[1], err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// loadImage loads a RawP image, or any image registered with the image
+// package.
+func loadImage(name string) (*rawp.MemPImage, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	sig, _ := br.Peek(6)
+	switch {
+	case strings.HasPrefix(string(sig), "RAWP"):
+		return rawp.DecodeImage(br)
+	case string(sig) == "\x93NUMPY":
+		return rawp.DecodeNpy(br)
+	case len(sig) >= 2 && sig[0] == 'P' && strings.IndexByte("567fF", sig[1]) >= 0:
+		return rawp.DecodePNM(br)
+	case strings.HasPrefix(string(sig), "II\x2A\x00") || strings.HasPrefix(string(sig), "MM\x00\x2A"):
+		return rawp.DecodeTIFF(br)
+	case strings.HasPrefix(string(sig), "\x76\x2f\x31\x01"):
+		return rawp.DecodeEXR(br)
+	}
+	m, _, err := image.Decode(br)
+	if err != nil {
+		return nil, err
+	}
+	return rawp.NewMemPImageFrom(m), nil
+}
+
+// saveImage saves m in the format of the extension of name: .rawp (or no
+// extension), .npy, .pgm, .ppm, .pnm, .pam, .pfm, .tif, .tiff, .exr, .png,
+// .jpg, .jpeg or .gif. TIFF and OpenEXR files are zip compressed, and
+// OpenEXR files hold float32 samples.
+func saveImage(name string, m *rawp.MemPImage, opt *rawp.Options) (err error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch ext {
+	case "", ".rawp", ".npy", ".pgm", ".ppm", ".pnm", ".pam", ".pfm", ".tif", ".tiff", ".exr", ".png", ".jpg", ".jpeg", ".gif":
+	default:
+		return fmt.Errorf("unknown image format %q", ext)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+	defer func() {
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+	}()
+
+	switch ext {
+	case "", ".rawp":
+		return rawp.Encode(w, m, opt)
+	case ".npy":
+		return rawp.EncodeNpy(w, m)
+	case ".pgm", ".ppm", ".pnm", ".pfm":
+		return rawp.EncodePNM(w, m)
+	case ".pam":
+		return rawp.EncodePAM(w, m)
+	case ".tif", ".tiff":
+		return rawp.EncodeTIFF(w, m, &rawp.TIFFOptions{UseDeflate: true})
+	case ".exr":
+		if m.XDataType != reflect.Float32 {
+			if m, err = rawp.Convert(m, m.XChannels, reflect.Float32); err != nil {
+				return err
+			}
+		}
+		return rawp.EncodeEXR(w, m, &rawp.EXROptions{UseZip: true})
+	case ".png":
+		std, err := stdImage(m, false)
+		if err != nil {
+			return err
+		}
+		return png.Encode(w, std)
+	case ".jpg", ".jpeg":
+		std, err := stdImage(m, true)
+		if err != nil {
+			return err
+		}
+		return jpeg.Encode(w, std, &jpeg.Options{Quality: 95})
+	default:
+		std, err := stdImage(m, true)
+		if err != nil {
+			return err
+		}
+		return gif.Encode(w, std, nil)
+	}
+}
+
+// stdImage converts m to a gray or RGBA image of the image package, with
+// 8 bit samples if only8 is set or m has them, 16 bit samples otherwise.
+func stdImage(m *rawp.MemPImage, only8 bool) (image.Image, error) {
+	channels, kind := 4, reflect.Uint16
+	if m.XChannels == 1 {
+		channels = 1
+	}
+	if only8 || m.XDataType == reflect.Uint8 {
+		kind = reflect.Uint8
+	}
+	if m.XChannels != channels || m.XDataType != kind {
+		var err error
+		if m, err = rawp.Convert(m, channels, kind); err != nil {
+			return nil, err
+		}
+	}
+	return m.StdImage(), nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"reflect"
+
+	"github.com/chai2010/rawp"
+)
+
+var cmdDiff = &command{
+	name:  "diff",
+	args:  "[-tolerance T] [-heatmap OUT.png] A B",
+	short: "compare two images; exit 0 if equal, 1 if different, 2 on trouble",
+	run:   runDiff,
+}
+
+// diffStats are the errors of one channel, in the sample units of A.
+type diffStats struct {
+	max  float64
+	sum  float64 // sum of absolute errors
+	sum2 float64 // sum of squared errors
+	n    int
+}
+
+func (s *diffStats) add(d float64) {
+	if d = math.Abs(d); d > s.max {
+		s.max = d
+	}
+	s.sum += d
+	s.sum2 += d * d
+	s.n++
+}
+
+func (s *diffStats) merge(o *diffStats) {
+	if o.max > s.max {
+		s.max = o.max
+	}
+	s.sum += o.sum
+	s.sum2 += o.sum2
+	s.n += o.n
+}
+
+func (s *diffStats) mean() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return s.sum / float64(s.n)
+}
+
+// psnr returns the PSNR in dB for the largest sample value peak.
+func (s *diffStats) psnr(peak float64) float64 {
+	if s.n == 0 || s.sum2 == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(peak*peak/(s.sum2/float64(s.n)))
+}
+
+// kindMax returns the largest sample value of kind, 1 for floats.
+func kindMax(kind reflect.Kind) float64 {
+	switch kind {
+	case reflect.Int8:
+		return math.MaxInt8
+	case reflect.Int16:
+		return math.MaxInt16
+	case reflect.Int32:
+		return math.MaxInt32
+	case reflect.Int64:
+		return math.MaxInt64
+	case reflect.Uint8:
+		return math.MaxUint8
+	case reflect.Uint16:
+		return math.MaxUint16
+	case reflect.Uint32:
+		return math.MaxUint32
+	case reflect.Uint64:
+		return math.MaxUint64
+	}
+	return 1
+}
+
+func runDiff(cmd *command, args []string, stdout, stderr io.Writer) int {
+	fs := cmd.flagSet(stderr)
+	tolerance := fs.Float64("tolerance", 0, "max absolute error `T` (in sample units of A) still reported as equal")
+	heatmap := fs.String("heatmap", "", "write a heat map of the differences to the PNG `file`")
+	files, ok := cmd.parse(fs, args, 2, 2)
+	if !ok {
+		return exitUsage
+	}
+
+	var m [2]*rawp.MemPImage
+	for i, name := range files {
+		var err error
+		if m[i], err = loadImage(name); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", name, err)
+			return exitUsage
+		}
+		fmt.Fprintf(stdout, "%s: %dx%d, %d channels, %s\n",
+			name, m[i].Bounds().Dx(), m[i].Bounds().Dy(), m[i].XChannels, rawp.KindString(m[i].XDataType))
+	}
+	a, b := m[0], m[1]
+	if a.Bounds().Size() != b.Bounds().Size() || a.XChannels != b.XChannels {
+		fmt.Fprintf(stdout, "images differ in size or channels\n")
+		return exitFailure
+	}
+	if a.XDataType != b.XDataType {
+		fmt.Fprintf(stdout, "images differ in kind, comparing normalized samples\n")
+	}
+
+	stats, diff := diffImages(a, b)
+	var all diffStats
+	peak := kindMax(a.XDataType)
+	fmt.Fprintf(stdout, "%-8s %12s %12s %10s\n", "channel", "max", "mean", "psnr")
+	for i := range stats {
+		s := &stats[i]
+		fmt.Fprintf(stdout, "%-8d %12.6g %12.6g %10.2f\n", i, s.max, s.mean(), s.psnr(peak))
+		all.merge(s)
+	}
+	fmt.Fprintf(stdout, "%-8s %12.6g %12.6g %10.2f\n", "all", all.max, all.mean(), all.psnr(peak))
+
+	if *heatmap != "" {
+		if err := saveImage(*heatmap, rawp.NewMemPImageFrom(heatMap(diff, a.Bounds().Size(), all.max/peak)), nil); err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", *heatmap, err)
+			return exitUsage
+		}
+	}
+
+	if all.max > *tolerance {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// diffImages returns the errors of every channel of a and b, and the
+// largest normalized error of every pixel.
+func diffImages(a, b *rawp.MemPImage) (stats []diffStats, diff []float64) {
+	w, h, c := a.Bounds().Dx(), a.Bounds().Dy(), a.XChannels
+	maxA, maxB := kindMax(a.XDataType), kindMax(b.XDataType)
+	stats = make([]diffStats, c)
+	diff = make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		rowA := rawp.PixSlice(a.XPix[a.PixOffset(a.XRect.Min.X, a.XRect.Min.Y+y):])
+		rowB := rawp.PixSlice(b.XPix[b.PixOffset(b.XRect.Min.X, b.XRect.Min.Y+y):])
+		for x := 0; x < w; x++ {
+			for ch := 0; ch < c; ch++ {
+				i := x*c + ch
+				va := rowA.Value(i, a.XDataType)
+				vb := rowB.Value(i, b.XDataType)
+				if maxA != maxB {
+					vb = vb / maxB * maxA
+				}
+				d := va - vb
+				stats[ch].add(d)
+				if d = math.Abs(d) / maxA; d > diff[y*w+x] {
+					diff[y*w+x] = d
+				}
+			}
+		}
+	}
+	return
+}
+
+// heatMap draws the normalized errors diff, black for no error to white
+// for the largest error max, through red and yellow.
+func heatMap(diff []float64, size image.Point, max float64) image.Image {
+	m := image.NewRGBA(image.Rectangle{Max: size})
+	for i, d := range diff {
+		t := 0.0
+		if max > 0 {
+			t = d / max
+		}
+		r := math.Min(1, 3*t)
+		g := math.Min(1, math.Max(0, 3*t-1))
+		b := math.Min(1, math.Max(0, 3*t-2))
+		m.Set(i%size.X, i/size.X, color.RGBA{
+			R: uint8(r*255 + 0.5),
+			G: uint8(g*255 + 0.5),
+			B: uint8(b*255 + 0.5),
+			A: 0xFF,
+		})
+	}
+	return m
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chai2010/rawp"
+)
+
+var cmdInfo = &command{
+	name:  "info",
+	args:  "[-json] FILE...",
+	short: "print the header of RawP files",
+	run:   runInfo,
+}
+
+func runInfo(cmd *command, args []string, stdout, stderr io.Writer) int {
+	fs := cmd.flagSet(stderr)
+	asJSON := fs.Bool("json", false, "print JSON")
+	files, ok := cmd.parse(fs, args, 1, -1)
+	if !ok {
+		return exitUsage
+	}
+
+	status := exitOK
+	for _, name := range files {
+		h, err := loadHeader(name)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", name, err)
+			status = exitFailure
+			continue
+		}
+		if *asJSON {
+			data, _ := json.MarshalIndent(struct {
+				File string
+				*rawp.Header
+				Kind string
+			}{name, h, rawp.KindString(h.Kind)}, "", "\t")
+			fmt.Fprintf(stdout, "%s\n", data)
+			continue
+		}
+		fmt.Fprintf(stdout, "%s:\n", name)
+		fmt.Fprintf(stdout, "\tSig:          %q\n", h.Sig)
+		fmt.Fprintf(stdout, "\tMagic:        0x%x\n", h.Magic)
+		fmt.Fprintf(stdout, "\tWidth:        %d\n", h.Width)
+		fmt.Fprintf(stdout, "\tHeight:       %d\n", h.Height)
+		fmt.Fprintf(stdout, "\tChannels:     %d\n", h.Channels)
+		if h.Depth%8 != 0 {
+			fmt.Fprintf(stdout, "\tDepth:        %d (packed, %v)\n", h.Depth, h.Packing)
+		} else {
+			fmt.Fprintf(stdout, "\tDepth:        %d\n", h.Depth)
+		}
+		fmt.Fprintf(stdout, "\tDataType:     %d (%s)\n", h.DataType, rawp.KindString(h.Kind))
+		fmt.Fprintf(stdout, "\tUseSnappy:    %d\n", h.UseSnappy)
+		fmt.Fprintf(stdout, "\tDataSize:     %d\n", h.DataSize)
+		fmt.Fprintf(stdout, "\tDataCheckSum: 0x%x\n", h.DataCheckSum)
+		fmt.Fprintf(stdout, "\tOrigin:       (%d,%d)\n", h.MinX, h.MinY)
+		if h.YUV != rawp.YUVNone {
+			fmt.Fprintf(stdout, "\tYUV:          %v\n", h.YUV)
+		}
+		if h.ColorSpace != rawp.ColorSpaceUnknown {
+			fmt.Fprintf(stdout, "\tColorSpace:   %v\n", h.ColorSpace)
+		}
+		if h.CFA.Pattern != rawp.CFANone {
+			fmt.Fprintf(stdout, "\tCFA:          %v, levels %v-%v\n", h.CFA.Pattern, h.CFA.BlackLevel, h.CFA.WhiteLevel)
+		}
+	}
+	return status
+}
+
+func loadHeader(name string) (*rawp.Header, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return rawp.DecodeHeader(f)
+}
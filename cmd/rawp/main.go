@@ -0,0 +1,104 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Rawp inspects, converts and checks RawP images.
+//
+// Usage:
+//
+//	rawp info [-json] FILE...
+//	rawp convert [-snappy] [-block-size N] [-kind KIND] [-channels N] IN OUT
+//	rawp verify FILE...
+//	rawp diff [-tolerance T] [-heatmap OUT.png] A B
+//	rawp recompress [-snappy] [-block-size N] [-j N] [-dry-run] PATH...
+//
+// Exit status is 0 on success, 1 if a command fails and 2 for usage errors.
+// diff, like cmp, exits with 1 if the images differ and 2 on errors.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(cmd *command, args []string, stdout, stderr io.Writer) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		cmdInfo,
+		cmdConvert,
+		cmdVerify,
+		cmdDiff,
+		cmdRecompress,
+	}
+}
+
+// flagSet returns a flag set for cmd which prints its usage to stderr.
+func (cmd *command) flagSet(stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: rawp %s %s\n\n%s.\n", cmd.name, cmd.args, cmd.short)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the flags of cmd and checks the number of remaining
+// arguments, max < 0 for no limit. ok is false after a usage error.
+func (cmd *command) parse(fs *flag.FlagSet, args []string, min, max int) (rest []string, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		return nil, false
+	}
+	if rest = fs.Args(); len(rest) < min || (max >= 0 && len(rest) > max) {
+		fs.Usage()
+		return nil, false
+	}
+	return rest, true
+}
+
+func usage(stderr io.Writer) {
+	fmt.Fprintf(stderr, "usage: rawp COMMAND [ARGS]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(stderr, "  %-10s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(stderr, "\nrun 'rawp COMMAND -h' for the arguments of a command.\n")
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return exitUsage
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(cmd, args[1:], stdout, stderr)
+		}
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(stdout)
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "rawp: unknown command %q\n", args[0])
+	usage(stderr)
+	return exitUsage
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
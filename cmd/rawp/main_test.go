@@ -0,0 +1,296 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chai2010/rawp"
+)
+
+func tRun(t *testing.T, expect int, args ...string) (stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	if code := run(args, &out, &errOut); code != expect {
+		t.Fatalf("rawp %s: exit = %d, expect = %d\nstdout:\n%s\nstderr:\n%s",
+			strings.Join(args, " "), code, expect, out.String(), errOut.String())
+	}
+	return out.String(), errOut.String()
+}
+
+func TestInfoConvertVerify(t *testing.T) {
+	dir := t.TempDir()
+	lena := "../../testdata/lena.jpg"
+	raw := filepath.Join(dir, "lena.rawp")
+	gray := filepath.Join(dir, "gray.rawp")
+	png := filepath.Join(dir, "gray.png")
+	half := filepath.Join(dir, "half.rawp")
+	npy := filepath.Join(dir, "gray.npy")
+	pfm := filepath.Join(dir, "gray.pfm")
+	tif := filepath.Join(dir, "gray.tif")
+	exr := filepath.Join(dir, "gray.exr")
+	bayer := filepath.Join(dir, "bayer.rawp")
+	rgb := filepath.Join(dir, "rgb.png")
+
+	tRun(t, exitOK, "convert", "-snappy", lena, raw)
+	tRun(t, exitOK, "convert", "-kind", "float32", "-channels", "1", raw, gray)
+	tRun(t, exitOK, "convert", "-kind", "bfloat16", raw, half)
+	tRun(t, exitOK, "convert", gray, png)
+	tRun(t, exitOK, "convert", gray, npy)
+	tRun(t, exitOK, "convert", gray, pfm)
+	tRun(t, exitOK, "convert", gray, tif)
+	tRun(t, exitOK, "convert", gray, exr)
+	tRun(t, exitOK, "convert", "-kind", "uint16", "-channels", "1", "-cfa", "rggb", raw, bayer)
+	tRun(t, exitOK, "convert", "-demosaic", "edge", bayer, rgb)
+
+	out, _ := tRun(t, exitOK, "info", raw, gray, half, bayer)
+	for _, s := range []string{"lena.rawp:", "UseSnappy:    1", "gray.rawp:", "(float32)", "Channels:     1", "4 (bfloat16)", "CFA:          RGGB"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("info: %q not found in:\n%s", s, out)
+		}
+	}
+
+	out, _ = tRun(t, exitOK, "info", "-json", gray)
+	var h struct {
+		rawp.Header
+		Kind string
+	}
+	if err := json.Unmarshal([]byte(out), &h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Channels != 1 || h.Kind != "float32" || h.Sig != "RAWP" {
+		t.Fatalf("info -json: got = %+v", h)
+	}
+
+	m, err := rawp.LoadImage(gray)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1, err := loadImage(png)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1.Bounds() != m.Bounds() || m1.XChannels != 1 {
+		t.Fatalf("png: bounds = %v, channels = %v", m1.Bounds(), m1.XChannels)
+	}
+	if m1, err = loadImage(rgb); err != nil {
+		t.Fatal(err)
+	}
+	if m1.Bounds() != m.Bounds() || m1.XChannels < 3 {
+		t.Fatalf("demosaic: bounds = %v, channels = %v", m1.Bounds(), m1.XChannels)
+	}
+	if m1, err = loadImage(npy); err != nil {
+		t.Fatal(err)
+	}
+	if m1.Bounds() != m.Bounds() || !bytes.Equal(m1.XPix, m.XPix) {
+		t.Fatalf("npy: bounds = %v, pixels differ", m1.Bounds())
+	}
+	for _, name := range []string{pfm, tif, exr} {
+		if m1, err = loadImage(name); err != nil {
+			t.Fatal(err)
+		}
+		if m1.Bounds() != m.Bounds() || !bytes.Equal(m1.XPix, m.XPix) {
+			t.Fatalf("%s: bounds = %v, pixels differ", name, m1.Bounds())
+		}
+	}
+
+	out, _ = tRun(t, exitOK, "verify", raw, gray)
+	if strings.Count(out, ": ok\n") != 2 {
+		t.Fatalf("verify: got:\n%s", out)
+	}
+
+	// corrupt the last byte of the image data
+	data, err := ioutil.ReadFile(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	bad := filepath.Join(dir, "bad.rawp")
+	if err := ioutil.WriteFile(bad, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = tRun(t, exitFailure, "verify", raw, bad)
+	if !strings.Contains(out, "bad.rawp: FAIL") || !strings.Contains(out, "checksum") {
+		t.Fatalf("verify: got:\n%s", out)
+	}
+
+	tRun(t, exitUsage)
+	tRun(t, exitUsage, "nosuchcommand")
+	tRun(t, exitUsage, "convert", raw)
+	tRun(t, exitUsage, "convert", "-kind", "int3", raw, gray)
+	tRun(t, exitUsage, "convert", "-cfa", "rgbw", raw, gray)
+	tRun(t, exitUsage, "convert", "-demosaic", "best", raw, gray)
+	tRun(t, exitFailure, "convert", "-demosaic", "edge", raw, gray)
+	tRun(t, exitFailure, "info", filepath.Join(dir, "missing.rawp"))
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.rawp")
+	b := filepath.Join(dir, "b.rawp")
+	c := filepath.Join(dir, "c.rawp")
+	heat := filepath.Join(dir, "heat.png")
+
+	m := rawp.NewMemPImage(image.Rect(0, 0, 4, 2), 3, reflect.Uint8)
+	for i := range m.XPix {
+		m.XPix[i] = byte(10 * i)
+	}
+	if err := rawp.Save(a, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	m.XPix[4] += 6 // pixel (1, 0), channel 1
+	if err := rawp.Save(b, m, &rawp.Options{UseSnappy: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rawp.Save(c, rawp.NewMemPImage(image.Rect(0, 0, 4, 2), 1, reflect.Uint8), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := tRun(t, exitOK, "diff", a, a)
+	if !strings.Contains(out, "+Inf") {
+		t.Fatalf("diff: expect infinite PSNR:\n%s", out)
+	}
+
+	out, _ = tRun(t, exitFailure, "diff", "-heatmap", heat, a, b)
+	lines := strings.Split(out, "\n")
+	if f := strings.Fields(lines[4]); len(f) != 4 || f[0] != "1" || f[1] != "6" || f[2] != "0.75" {
+		t.Fatalf("diff: bad channel 1 line %q in:\n%s", lines[4], out)
+	}
+	hm, err := loadImage(heat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := hm.PixelAt(1, 0); p[0] != 255 || p[1] != 255 || p[2] != 255 {
+		t.Fatalf("heatmap: pixel (1, 0) = %v, expect white", p)
+	}
+	if p := hm.PixelAt(0, 0); p[0] != 0 || p[1] != 0 || p[2] != 0 {
+		t.Fatalf("heatmap: pixel (0, 0) = %v, expect black", p)
+	}
+
+	tRun(t, exitOK, "diff", "-tolerance", "6", a, b)
+	tRun(t, exitFailure, "diff", a, c)
+	tRun(t, exitUsage, "diff", a, filepath.Join(dir, "missing.rawp"))
+}
+
+func TestRecompress(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0777); err != nil {
+		t.Fatal(err)
+	}
+	m := rawp.NewMemPImage(image.Rect(10, 20, 74, 84), 3, reflect.Uint16)
+	for i := range m.XPix {
+		m.XPix[i] = byte(i / 64)
+	}
+	names := []string{filepath.Join(dir, "a.rawp"), filepath.Join(sub, "b.RAWP")}
+	for _, name := range names {
+		if err := rawp.Save(name, m, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(other, []byte("not an image"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	size := func(name string) int64 {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	size0 := size(names[0])
+
+	out, _ := tRun(t, exitOK, "recompress", "-dry-run", dir)
+	if !strings.Contains(out, "2 files:") || size(names[0]) != size0 {
+		t.Fatalf("recompress -dry-run: got:\n%s", out)
+	}
+
+	out, _ = tRun(t, exitOK, "recompress", "-j", "2", dir)
+	if !strings.Contains(out, "2 files:") {
+		t.Fatalf("recompress: got:\n%s", out)
+	}
+	for _, name := range names {
+		h, err := loadHeader(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.UseSnappy != 1 || size(name) >= size0 {
+			t.Fatalf("%s: not compressed, %+v", name, h)
+		}
+		m1, err := rawp.LoadImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m1.Bounds() != m.Bounds() || !bytes.Equal(m1.XPix, m.XPix) {
+			t.Fatalf("%s: pixels changed", name)
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			t.Fatalf("temporary file left: %s", fi.Name())
+		}
+	}
+
+	// overlapping paths are processed once, and a missing path does not
+	// stop the others
+	missing := filepath.Join(dir, "missing")
+	out, errOut := tRun(t, exitFailure, "recompress", "-dry-run", dir, missing, sub, filepath.Join(sub, "..", "a.rawp"))
+	if !strings.Contains(out, "2 files:") || !strings.Contains(errOut, missing) {
+		t.Fatalf("recompress overlapping paths: got:\n%s%s", out, errOut)
+	}
+
+	// a broken file fails and is left alone
+	if err := ioutil.WriteFile(other, []byte("RAWP broken"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	tRun(t, exitFailure, "recompress", other)
+	if data, _ := ioutil.ReadFile(other); string(data) != "RAWP broken" {
+		t.Fatalf("broken file changed: %q", data)
+	}
+}
+
+func TestRecompress_YUV(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "frame.rawp")
+	m := rawp.NewYUVImage(image.Rect(0, 0, 64, 48), rawp.YUVNV12)
+	for i := range m.Y {
+		m.Y[i] = byte(i / 64)
+	}
+	for i := range m.Cb {
+		m.Cb[i] = byte(128 + i/32)
+	}
+	if err := rawp.Save(name, m, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tRun(t, exitOK, "recompress", name)
+	h, err := loadHeader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.UseSnappy != 1 || h.YUV != rawp.YUVNV12 {
+		t.Fatalf("recompress: header = %+v", h)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m1, err := rawp.DecodeYUV(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m1.Y, m.Y) || !bytes.Equal(m1.Cb, m.Cb) || m1.Cr != nil {
+		t.Fatal("recompress: planes changed")
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/chai2010/rawp"
+)
+
+var cmdRecompress = &command{
+	name:  "recompress",
+	args:  "[-snappy] [-block-size N] [-j N] [-dry-run] PATH...",
+	short: "re-encode RawP files in place, walking directories for *.rawp files",
+	run:   runRecompress,
+}
+
+type recompressResult struct {
+	name          string
+	before, after int64
+	err           error
+}
+
+func runRecompress(cmd *command, args []string, stdout, stderr io.Writer) int {
+	fs := cmd.flagSet(stderr)
+	useSnappy := fs.Bool("snappy", true, "compress with snappy")
+	blockSize := fs.Int("block-size", 0, "split snappy data into blocks of `N` bytes (0 for one block)")
+	workers := fs.Int("j", runtime.GOMAXPROCS(0), "number of files processed in parallel")
+	dryRun := fs.Bool("dry-run", false, "report the savings without replacing any file")
+	paths, ok := cmd.parse(fs, args, 1, -1)
+	if !ok {
+		return exitUsage
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+	opt := &rawp.Options{UseSnappy: *useSnappy, BlockSize: *blockSize}
+
+	status := exitOK
+	files := make(chan string)
+	results := make(chan recompressResult)
+	go func() {
+		defer close(files)
+		// overlapping paths name the same file more than once
+		seen := make(map[string]bool)
+		for _, path := range paths {
+			filepath.Walk(path, func(name string, fi os.FileInfo, err error) error {
+				if err != nil {
+					// report it and walk on
+					results <- recompressResult{name: name, err: err}
+					return nil
+				}
+				// files named on the command line are always processed
+				if !fi.Mode().IsRegular() || (name != path && !strings.EqualFold(filepath.Ext(name), ".rawp")) {
+					return nil
+				}
+				abs, err := filepath.Abs(name)
+				if err != nil {
+					results <- recompressResult{name: name, err: err}
+					return nil
+				}
+				if !seen[abs] {
+					seen[abs] = true
+					files <- name
+				}
+				return nil
+			})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range files {
+				before, after, err := recompressFile(name, opt, *dryRun)
+				results <- recompressResult{name, before, after, err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var total recompressResult
+	var count int
+	for r := range results {
+		if r.err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", r.name, r.err)
+			status = exitFailure
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: %d -> %d bytes (%s)\n", r.name, r.before, r.after, savings(r.before, r.after))
+		total.before += r.before
+		total.after += r.after
+		count++
+	}
+	fmt.Fprintf(stdout, "%d files: %d -> %d bytes (%s)\n", count, total.before, total.after, savings(total.before, total.after))
+	return status
+}
+
+func savings(before, after int64) string {
+	if before == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%+.1f%%", 100*float64(after-before)/float64(before))
+}
+
+// recompressFile re-encodes the RawP image in name with opt. The new file
+// is written next to name, and replaces it only after it is read back and
+// decoded to the same pixels. YUV frames stay YUV frames.
+func recompressFile(name string, opt *rawp.Options, dryRun bool) (before, after int64, err error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return
+	}
+	before = int64(len(data))
+
+	h, err := rawp.DecodeHeader(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	r := bytes.NewReader(data)
+	var m image.Image
+	var check func(r io.Reader) error
+	if h.YUV != rawp.YUVNone {
+		var y *rawp.YUVImage
+		if y, err = rawp.DecodeYUV(r); err != nil {
+			return
+		}
+		m, check = y, func(r io.Reader) error { return checkSameYUV(y, r) }
+		yuvOpt := *opt
+		yuvOpt.YUV = true
+		opt = &yuvOpt
+	} else {
+		var p *rawp.MemPImage
+		if p, err = rawp.DecodeImage(r); err != nil {
+			return
+		}
+		m, check = p, func(r io.Reader) error { return checkSamePixels(p, r) }
+	}
+	if r.Len() != 0 {
+		err = fmt.Errorf("trailing data after the image")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err = rawp.Encode(&buf, m, opt); err != nil {
+		return
+	}
+	after = int64(buf.Len())
+	if dryRun {
+		err = check(&buf)
+		return
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmp := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err = f.Write(buf.Bytes()); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(tmp, fi.Mode().Perm()); err != nil {
+		return
+	}
+
+	// check what is on disk, not what was meant to be written
+	f, err = os.Open(tmp)
+	if err != nil {
+		return
+	}
+	err = check(bufio.NewReader(f))
+	f.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, name)
+	return
+}
+
+// checkSamePixels decodes r and compares it with m.
+func checkSamePixels(m *rawp.MemPImage, r io.Reader) error {
+	m1, err := rawp.DecodeImage(r)
+	if err != nil {
+		return fmt.Errorf("re-encoded image: %v", err)
+	}
+	if m1.Bounds() != m.Bounds() || m1.XChannels != m.XChannels || m1.XDataType != m.XDataType {
+		return fmt.Errorf("re-encoded image: header mismatch")
+	}
+	n := m.Bounds().Dx() * rawp.SizeofPixel(m.XChannels, m.XDataType)
+	for y := m.XRect.Min.Y; y < m.XRect.Max.Y; y++ {
+		a := m.XPix[m.PixOffset(m.XRect.Min.X, y):][:n]
+		b := m1.XPix[m1.PixOffset(m1.XRect.Min.X, y):][:n]
+		if !bytes.Equal(a, b) {
+			return fmt.Errorf("re-encoded image: pixels of row %d differ", y)
+		}
+	}
+	return nil
+}
+
+// checkSameYUV decodes the YUV frame in r and compares its planes with m.
+func checkSameYUV(m *rawp.YUVImage, r io.Reader) error {
+	m1, err := rawp.DecodeYUV(r)
+	if err != nil {
+		return fmt.Errorf("re-encoded frame: %v", err)
+	}
+	if m1.Layout != m.Layout || m1.Rect != m.Rect || m1.YStride != m.YStride || m1.CStride != m.CStride {
+		return fmt.Errorf("re-encoded frame: header mismatch")
+	}
+	if !bytes.Equal(m1.Y, m.Y) || !bytes.Equal(m1.Cb, m.Cb) || !bytes.Equal(m1.Cr, m.Cr) {
+		return fmt.Errorf("re-encoded frame: planes differ")
+	}
+	return nil
+}
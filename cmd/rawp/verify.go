@@ -0,0 +1,61 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/chai2010/rawp"
+)
+
+var cmdVerify = &command{
+	name:  "verify",
+	args:  "FILE...",
+	short: "check the header and checksum of RawP files",
+	run:   runVerify,
+}
+
+func runVerify(cmd *command, args []string, stdout, stderr io.Writer) int {
+	fs := cmd.flagSet(stderr)
+	files, ok := cmd.parse(fs, args, 1, -1)
+	if !ok {
+		return exitUsage
+	}
+
+	status := exitOK
+	for _, name := range files {
+		if err := verifyFile(name); err != nil {
+			fmt.Fprintf(stdout, "%s: FAIL: %v\n", name, err)
+			status = exitFailure
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: ok\n", name)
+	}
+	return status
+}
+
+// verifyFile decodes the RawP image in name, which must hold nothing else.
+func verifyFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if _, err = rawp.DecodeImage(br); err != nil {
+		return err
+	}
+	if _, err = br.ReadByte(); err != io.EOF {
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("trailing data after the image")
+	}
+	return nil
+}
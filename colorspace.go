@@ -0,0 +1,446 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// ColorSpace records how the channels of a MemPImage are to be read.
+//
+// Conversions work on Float32 and Float64 images with values in [0, 1]
+// for RGB. The first three channels are converted, a fourth (alpha)
+// channel is kept as is.
+type ColorSpace int
+
+const (
+	ColorSpaceUnknown   ColorSpace = iota
+	ColorSpaceSRGB                 // gamma encoded sRGB
+	ColorSpaceLinearRGB            // linear light, sRGB primaries
+	ColorSpaceYCbCr601             // Y in [0, 1], Cb/Cr in [-0.5, 0.5], from sRGB
+	ColorSpaceYCbCr709             // Y in [0, 1], Cb/Cr in [-0.5, 0.5], from sRGB
+	ColorSpaceHSV                  // H in [0, 360), S/V in [0, 1], from sRGB
+	ColorSpaceHSL                  // H in [0, 360), S/L in [0, 1], from sRGB
+	ColorSpaceXYZ                  // CIE 1931 XYZ, D65 white (Y = 1)
+	ColorSpaceLab                  // CIE L*a*b*, D65 white, L in [0, 100]
+)
+
+func (cs ColorSpace) String() string {
+	switch cs {
+	case ColorSpaceUnknown:
+		return "Unknown"
+	case ColorSpaceSRGB:
+		return "sRGB"
+	case ColorSpaceLinearRGB:
+		return "LinearRGB"
+	case ColorSpaceYCbCr601:
+		return "YCbCr601"
+	case ColorSpaceYCbCr709:
+		return "YCbCr709"
+	case ColorSpaceHSV:
+		return "HSV"
+	case ColorSpaceHSL:
+		return "HSL"
+	case ColorSpaceXYZ:
+		return "XYZ"
+	case ColorSpaceLab:
+		return "Lab"
+	}
+	return fmt.Sprintf("ColorSpace(%d)", int(cs))
+}
+
+// YCbCrStandard selects the luma coefficients of RGBToYCbCr.
+type YCbCrStandard int
+
+const (
+	BT601 YCbCrStandard = iota
+	BT709
+)
+
+func (std YCbCrStandard) coeffs() (kr, kb float64) {
+	if std == BT709 {
+		return 0.2126, 0.0722
+	}
+	return 0.299, 0.114
+}
+
+// D65 reference white
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+// ConvertColorSpace converts m from m.XColorSpace to cs in place and
+// records cs in m.XColorSpace.
+func ConvertColorSpace(m *MemPImage, cs ColorSpace) error {
+	if m.XColorSpace == cs {
+		return nil
+	}
+	if cs <= ColorSpaceUnknown || cs > ColorSpaceLab {
+		return fmt.Errorf("rawp: unknown target color space, %v", cs)
+	}
+	if err := m.toLinearRGB(); err != nil {
+		return err
+	}
+	return m.fromLinearRGB(cs)
+}
+
+// valid reports whether cs can be stored, ColorSpaceUnknown is not.
+func (cs ColorSpace) valid() bool {
+	return cs > ColorSpaceUnknown && cs <= ColorSpaceLab
+}
+
+func (m *MemPImage) toLinearRGB() (err error) {
+	switch m.XColorSpace {
+	case ColorSpaceLinearRGB:
+		return nil
+	case ColorSpaceSRGB:
+		err = SRGBToLinear(m)
+	case ColorSpaceYCbCr601:
+		if err = YCbCrToRGB(m, BT601); err == nil {
+			err = SRGBToLinear(m)
+		}
+	case ColorSpaceYCbCr709:
+		if err = YCbCrToRGB(m, BT709); err == nil {
+			err = SRGBToLinear(m)
+		}
+	case ColorSpaceHSV:
+		if err = HSVToRGB(m); err == nil {
+			err = SRGBToLinear(m)
+		}
+	case ColorSpaceHSL:
+		if err = HSLToRGB(m); err == nil {
+			err = SRGBToLinear(m)
+		}
+	case ColorSpaceXYZ:
+		err = XYZToLinearRGB(m)
+	case ColorSpaceLab:
+		if err = LabToXYZ(m); err == nil {
+			err = XYZToLinearRGB(m)
+		}
+	default:
+		return fmt.Errorf("rawp: unknown source color space, %v", m.XColorSpace)
+	}
+	return
+}
+
+func (m *MemPImage) fromLinearRGB(cs ColorSpace) (err error) {
+	switch cs {
+	case ColorSpaceLinearRGB:
+		return nil
+	case ColorSpaceSRGB:
+		err = LinearToSRGB(m)
+	case ColorSpaceYCbCr601:
+		if err = LinearToSRGB(m); err == nil {
+			err = RGBToYCbCr(m, BT601)
+		}
+	case ColorSpaceYCbCr709:
+		if err = LinearToSRGB(m); err == nil {
+			err = RGBToYCbCr(m, BT709)
+		}
+	case ColorSpaceHSV:
+		if err = LinearToSRGB(m); err == nil {
+			err = RGBToHSV(m)
+		}
+	case ColorSpaceHSL:
+		if err = LinearToSRGB(m); err == nil {
+			err = RGBToHSL(m)
+		}
+	case ColorSpaceXYZ:
+		err = LinearRGBToXYZ(m)
+	case ColorSpaceLab:
+		if err = LinearRGBToXYZ(m); err == nil {
+			err = XYZToLab(m)
+		}
+	default:
+		return fmt.Errorf("rawp: unknown target color space, %v", cs)
+	}
+	return
+}
+
+// mapPixels calls fn for every pixel of the float image m, with the
+// pixel's first channels (at most 3) in p, and records cs in
+// m.XColorSpace.
+func mapPixels(m *MemPImage, minChannels int, cs ColorSpace, fn func(p []float64)) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if m.XDataType != reflect.Float32 && m.XDataType != reflect.Float64 {
+		return fmt.Errorf("rawp: color space conversion needs Float32 or Float64, got %s", KindString(m.XDataType))
+	}
+	if m.XChannels < minChannels {
+		return fmt.Errorf("rawp: color space conversion needs %d channels, got %v", minChannels, m.XChannels)
+	}
+	w, h, c := m.XRect.Dx(), m.XRect.Dy(), m.XChannels
+	n := c
+	if n > 3 {
+		n = 3
+	}
+
+	parallelRows(h, w, func(y0, y1 int) {
+		row := make([]float64, w*c)
+		for y := y0; y < y1; y++ {
+			pix := m.rowPix(m.XRect.Min.Y + y)
+			loadRow(row, pix, m.XDataType)
+			for x := 0; x < len(row); x += c {
+				fn(row[x:][:n])
+			}
+			storeRow(pix, m.XDataType, row)
+		}
+	})
+	m.XColorSpace = cs
+	return nil
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// The conversions below work in place on Float32 and Float64 images and
+// record the color space of the result in m.XColorSpace. They do not
+// check the color space m is in, ConvertColorSpace does.
+
+// SRGBToLinear decodes the sRGB transfer function of every color channel.
+func SRGBToLinear(m *MemPImage) error {
+	return mapPixels(m, 1, ColorSpaceLinearRGB, func(p []float64) {
+		for i, v := range p {
+			p[i] = srgbToLinear(v)
+		}
+	})
+}
+
+// LinearToSRGB applies the sRGB transfer function to every color channel.
+func LinearToSRGB(m *MemPImage) error {
+	return mapPixels(m, 1, ColorSpaceSRGB, func(p []float64) {
+		for i, v := range p {
+			p[i] = linearToSRGB(v)
+		}
+	})
+}
+
+// RGBToYCbCr converts R'G'B' to Y'CbCr with the luma coefficients of std.
+func RGBToYCbCr(m *MemPImage, std YCbCrStandard) error {
+	kr, kb := std.coeffs()
+	kg := 1 - kr - kb
+	cs := ColorSpaceYCbCr601
+	if std == BT709 {
+		cs = ColorSpaceYCbCr709
+	}
+	return mapPixels(m, 3, cs, func(p []float64) {
+		r, g, b := p[0], p[1], p[2]
+		y := kr*r + kg*g + kb*b
+		p[0] = y
+		p[1] = (b - y) / (2 * (1 - kb))
+		p[2] = (r - y) / (2 * (1 - kr))
+	})
+}
+
+// YCbCrToRGB converts Y'CbCr to R'G'B' with the luma coefficients of std.
+func YCbCrToRGB(m *MemPImage, std YCbCrStandard) error {
+	kr, kb := std.coeffs()
+	kg := 1 - kr - kb
+	return mapPixels(m, 3, ColorSpaceSRGB, func(p []float64) {
+		y, cb, cr := p[0], p[1], p[2]
+		r := y + 2*(1-kr)*cr
+		b := y + 2*(1-kb)*cb
+		p[0] = r
+		p[1] = (y - kr*r - kb*b) / kg
+		p[2] = b
+	})
+}
+
+// rgbHue returns the hue in degrees of a pixel with the given max and
+// chroma (max - min).
+func rgbHue(r, g, b, max, chroma float64) float64 {
+	if chroma == 0 {
+		return 0
+	}
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/chroma, 6)
+	case g:
+		h = (b-r)/chroma + 2
+	default:
+		h = (r-g)/chroma + 4
+	}
+	if h *= 60; h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// hueRGB returns the RGB of hue h (degrees) and chroma c, plus m.
+func hueRGB(h, c, m float64) (r, g, b float64) {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	h /= 60
+	x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+	switch int(h) {
+	case 0:
+		r, g, b = c, x, 0
+	case 1:
+		r, g, b = x, c, 0
+	case 2:
+		r, g, b = 0, c, x
+	case 3:
+		r, g, b = 0, x, c
+	case 4:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return r + m, g + m, b + m
+}
+
+// RGBToHSV converts RGB to hue (degrees), saturation and value.
+func RGBToHSV(m *MemPImage) error {
+	return mapPixels(m, 3, ColorSpaceHSV, func(p []float64) {
+		r, g, b := p[0], p[1], p[2]
+		max := math.Max(r, math.Max(g, b))
+		min := math.Min(r, math.Min(g, b))
+		p[0] = rgbHue(r, g, b, max, max-min)
+		if p[1] = 0; max != 0 {
+			p[1] = (max - min) / max
+		}
+		p[2] = max
+	})
+}
+
+// HSVToRGB converts hue (degrees), saturation and value to RGB.
+func HSVToRGB(m *MemPImage) error {
+	return mapPixels(m, 3, ColorSpaceSRGB, func(p []float64) {
+		c := p[2] * p[1]
+		p[0], p[1], p[2] = hueRGB(p[0], c, p[2]-c)
+	})
+}
+
+// RGBToHSL converts RGB to hue (degrees), saturation and lightness.
+func RGBToHSL(m *MemPImage) error {
+	return mapPixels(m, 3, ColorSpaceHSL, func(p []float64) {
+		r, g, b := p[0], p[1], p[2]
+		max := math.Max(r, math.Max(g, b))
+		min := math.Min(r, math.Min(g, b))
+		l := (max + min) / 2
+		p[0] = rgbHue(r, g, b, max, max-min)
+		if p[1] = 0; l > 0 && l < 1 {
+			p[1] = (max - min) / (1 - math.Abs(2*l-1))
+		}
+		p[2] = l
+	})
+}
+
+// HSLToRGB converts hue (degrees), saturation and lightness to RGB.
+func HSLToRGB(m *MemPImage) error {
+	return mapPixels(m, 3, ColorSpaceSRGB, func(p []float64) {
+		l := p[2]
+		c := (1 - math.Abs(2*l-1)) * p[1]
+		p[0], p[1], p[2] = hueRGB(p[0], c, l-c/2)
+	})
+}
+
+// linear sRGB to XYZ (D65), and its inverse
+var (
+	rgbToXYZ = [3][3]float64{
+		{0.4124564, 0.3575761, 0.1804375},
+		{0.2126729, 0.7151522, 0.0721750},
+		{0.0193339, 0.1191920, 0.9503041},
+	}
+	xyzToRGB = invert3x3(rgbToXYZ)
+)
+
+func invert3x3(a [3][3]float64) (b [3][3]float64) {
+	det := a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+		a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+		a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// cofactor of a[j][i]
+			r0, r1 := (j+1)%3, (j+2)%3
+			c0, c1 := (i+1)%3, (i+2)%3
+			b[i][j] = (a[r0][c0]*a[r1][c1] - a[r0][c1]*a[r1][c0]) / det
+		}
+	}
+	return
+}
+
+func mul3x3(m *[3][3]float64, p []float64) {
+	x, y, z := p[0], p[1], p[2]
+	p[0] = m[0][0]*x + m[0][1]*y + m[0][2]*z
+	p[1] = m[1][0]*x + m[1][1]*y + m[1][2]*z
+	p[2] = m[2][0]*x + m[2][1]*y + m[2][2]*z
+}
+
+// LinearRGBToXYZ converts linear RGB (sRGB primaries) to CIE XYZ.
+func LinearRGBToXYZ(m *MemPImage) error {
+	return mapPixels(m, 3, ColorSpaceXYZ, func(p []float64) {
+		mul3x3(&rgbToXYZ, p)
+	})
+}
+
+// XYZToLinearRGB converts CIE XYZ to linear RGB (sRGB primaries).
+func XYZToLinearRGB(m *MemPImage) error {
+	return mapPixels(m, 3, ColorSpaceLinearRGB, func(p []float64) {
+		mul3x3(&xyzToRGB, p)
+	})
+}
+
+const (
+	labEpsilon = 216.0 / 24389.0
+	labKappa   = 24389.0 / 27.0
+)
+
+func labF(t float64) float64 {
+	if t > labEpsilon {
+		return math.Cbrt(t)
+	}
+	return (labKappa*t + 16) / 116
+}
+
+func labFInv(f float64) float64 {
+	if t := f * f * f; t > labEpsilon {
+		return t
+	}
+	return (116*f - 16) / labKappa
+}
+
+// XYZToLab converts CIE XYZ to CIE L*a*b* (D65 white).
+func XYZToLab(m *MemPImage) error {
+	return mapPixels(m, 3, ColorSpaceLab, func(p []float64) {
+		fx := labF(p[0] / whiteX)
+		fy := labF(p[1] / whiteY)
+		fz := labF(p[2] / whiteZ)
+		p[0] = 116*fy - 16
+		p[1] = 500 * (fx - fy)
+		p[2] = 200 * (fy - fz)
+	})
+}
+
+// LabToXYZ converts CIE L*a*b* (D65 white) to CIE XYZ.
+func LabToXYZ(m *MemPImage) error {
+	return mapPixels(m, 3, ColorSpaceXYZ, func(p []float64) {
+		fy := (p[0] + 16) / 116
+		fx := fy + p[1]/500
+		fz := fy - p[2]/200
+		p[0] = whiteX * labFInv(fx)
+		p[1] = whiteY * labFInv(fy)
+		p[2] = whiteZ * labFInv(fz)
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestConvertColorSpace(t *testing.T) {
+	m0 := NewMemPImage(image.Rect(0, 0, 4, 4), 4, reflect.Float64)
+	v := m0.XPix.Float64s()
+	for i := range v {
+		v[i] = float64(i%7) / 6
+	}
+	m0.XColorSpace = ColorSpaceSRGB
+
+	for _, cs := range []ColorSpace{
+		ColorSpaceLinearRGB, ColorSpaceYCbCr601, ColorSpaceYCbCr709,
+		ColorSpaceHSV, ColorSpaceHSL, ColorSpaceXYZ, ColorSpaceLab,
+	} {
+		m1 := m0.Clone()
+		if err := ConvertColorSpace(m1, cs); err != nil {
+			t.Fatal(err)
+		}
+		if m1.XColorSpace != cs {
+			t.Fatalf("%v: color space not recorded: %v", cs, m1.XColorSpace)
+		}
+		if err := ConvertColorSpace(m1, ColorSpaceSRGB); err != nil {
+			t.Fatal(err)
+		}
+		v1 := m1.XPix.Float64s()
+		for i := range v {
+			if math.Abs(v[i]-v1[i]) > 1e-9 {
+				t.Fatalf("%v: %d: %v != %v", cs, i, v[i], v1[i])
+			}
+		}
+	}
+}
+
+func TestRGBToLab(t *testing.T) {
+	m := NewMemPImage(image.Rect(0, 0, 1, 1), 3, reflect.Float32)
+	copy(m.XPix.Float32s(), []float32{1, 1, 1})
+	m.XColorSpace = ColorSpaceSRGB
+	if err := ConvertColorSpace(m, ColorSpaceLab); err != nil {
+		t.Fatal(err)
+	}
+	if lab := m.XPix.Float32s(); math.Abs(float64(lab[0])-100) > 1e-3 || math.Abs(float64(lab[1])) > 1e-3 || math.Abs(float64(lab[2])) > 1e-3 {
+		t.Fatalf("white: got Lab = %v", lab)
+	}
+
+	if err := SRGBToLinear(NewMemPImage(image.Rect(0, 0, 1, 1), 3, reflect.Uint8)); err == nil {
+		t.Fatal("expect DataType error")
+	}
+}
+
+func TestColorSpaceRecorded(t *testing.T) {
+	m := NewMemPImage(image.Rect(0, 0, 2, 2), 3, reflect.Float32)
+	for _, v := range []struct {
+		fn func(*MemPImage) error
+		cs ColorSpace
+	}{
+		{SRGBToLinear, ColorSpaceLinearRGB},
+		{LinearRGBToXYZ, ColorSpaceXYZ},
+		{XYZToLab, ColorSpaceLab},
+		{LabToXYZ, ColorSpaceXYZ},
+		{XYZToLinearRGB, ColorSpaceLinearRGB},
+		{LinearToSRGB, ColorSpaceSRGB},
+		{func(m *MemPImage) error { return RGBToYCbCr(m, BT709) }, ColorSpaceYCbCr709},
+		{func(m *MemPImage) error { return YCbCrToRGB(m, BT709) }, ColorSpaceSRGB},
+		{func(m *MemPImage) error { return RGBToYCbCr(m, BT601) }, ColorSpaceYCbCr601},
+		{func(m *MemPImage) error { return YCbCrToRGB(m, BT601) }, ColorSpaceSRGB},
+		{RGBToHSV, ColorSpaceHSV},
+		{HSVToRGB, ColorSpaceSRGB},
+		{RGBToHSL, ColorSpaceHSL},
+		{HSLToRGB, ColorSpaceSRGB},
+	} {
+		if err := v.fn(m); err != nil {
+			t.Fatal(err)
+		}
+		if m.XColorSpace != v.cs {
+			t.Fatalf("expect = %v, got = %v", v.cs, m.XColorSpace)
+		}
+	}
+
+	// a failed conversion keeps the color space
+	gray := NewMemPImage(image.Rect(0, 0, 2, 2), 1, reflect.Float32)
+	gray.XColorSpace = ColorSpaceSRGB
+	if err := RGBToHSV(gray); err == nil || gray.XColorSpace != ColorSpaceSRGB {
+		t.Fatalf("err = %v, XColorSpace = %v", err, gray.XColorSpace)
+	}
+}
+
+func TestEncodeAndDecode_colorSpace(t *testing.T) {
+	m0 := NewMemPImage(image.Rect(0, 0, 3, 2), 3, reflect.Float32)
+	for i := range m0.XPix.Float32s() {
+		m0.XPix.Float32s()[i] = float32(i) / 6
+	}
+	m0.XColorSpace = ColorSpaceSRGB
+	if err := ConvertColorSpace(m0, ColorSpaceLab); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, m0, nil); err != nil {
+		t.Fatal(err)
+	}
+	h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ColorSpace != ColorSpaceLab {
+		t.Fatalf("Header.ColorSpace = %v", h.ColorSpace)
+	}
+	m1, err := DecodeImage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1.XColorSpace != ColorSpaceLab {
+		t.Fatalf("XColorSpace = %v", m1.XColorSpace)
+	}
+	if err := ConvertColorSpace(m1, ColorSpaceSRGB); err != nil {
+		t.Fatal(err)
+	}
+
+	m0.XColorSpace = ColorSpace(100)
+	if err := Encode(new(bytes.Buffer), m0, nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Encode: expect = %v, got = %v", ErrUnsupported, err)
+	}
+	ext := rawpAppendExt(nil, &rawpHeader{ColorSpace: ColorSpace(100)})
+	hdr := rawpHeader{Width: 2, Height: 2, Channels: 3}
+	if err := rawpReadExt(bytes.NewReader(ext), &hdr); !errors.Is(err, ErrFormat) {
+		t.Fatalf("rawpReadExt: expect = %v, got = %v", ErrFormat, err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Convert returns a copy of m with the given channels and kind.
+//
+// Samples are rescaled like in Draw: integer samples are normalized by the
+// largest value of their kind, float samples are used as is. Gray becomes
+// RGB by replication, RGB becomes gray by BT.601 luma, and a missing alpha
+// channel is opaque. Only 1, 3 and 4 channels can be converted to other
+// channels.
+func Convert(m *MemPImage, channels int, dataType reflect.Kind) (*MemPImage, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if SizeofKind(dataType) == 0 {
+		return nil, errUnsupported("DataType", KindString(dataType))
+	}
+	c0, c1 := m.XChannels, channels
+	if c0 != c1 && (!isRGBAChannels(c0) || !isRGBAChannels(c1)) {
+		return nil, fmt.Errorf("rawp: can not convert %v channels to %v", c0, c1)
+	}
+
+	srcMax, dstMax := 1.0, 1.0
+	if _, hi, ok := kindRange(m.XDataType); ok {
+		srcMax = hi
+	}
+	if _, hi, ok := kindRange(dataType); ok {
+		dstMax = hi
+	}
+
+	w, h := m.XRect.Dx(), m.XRect.Dy()
+	dst := NewMemPImage(m.XRect, c1, dataType)
+	dst.XColorSpace = m.XColorSpace
+	if w <= 0 || h <= 0 {
+		return dst, nil
+	}
+
+	parallelRows(h, w, func(y0, y1 int) {
+		s := make([]float64, w*c0)
+		d := make([]float64, w*c1)
+		for y := m.XRect.Min.Y + y0; y < m.XRect.Min.Y+y1; y++ {
+			loadRow(s, m.rowPix(y), m.XDataType)
+			for i := range s {
+				s[i] /= srcMax
+			}
+			convertPixels(d, s, c1, c0)
+			for i := range d {
+				d[i] *= dstMax
+			}
+			storeRow(dst.rowPix(y), dataType, d)
+		}
+	})
+	return dst, nil
+}
+
+func isRGBAChannels(c int) bool {
+	return c == 1 || c == 3 || c == 4
+}
+
+// convertPixels converts the normalized pixels s with c0 channels to d
+// with c1 channels.
+func convertPixels(d, s []float64, c1, c0 int) {
+	if c0 == c1 {
+		copy(d, s)
+		return
+	}
+	for x := 0; x*c0 < len(s); x++ {
+		sp, dp := s[x*c0:][:c0], d[x*c1:][:c1]
+		switch {
+		case c1 == 1:
+			dp[0] = 0.299*sp[0] + 0.587*sp[1] + 0.114*sp[2]
+		case c0 == 1:
+			dp[0], dp[1], dp[2] = sp[0], sp[0], sp[0]
+		default:
+			dp[0], dp[1], dp[2] = sp[0], sp[1], sp[2]
+		}
+		if c1 == 4 {
+			if dp[3] = 1; c0 == 4 {
+				dp[3] = sp[3]
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"image"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	m := NewMemPImage(image.Rect(0, 0, 2, 1), 3, reflect.Uint8)
+	copy(m.XPix, []byte{255, 0, 0, 10, 20, 30})
+
+	tests := []struct {
+		channels int
+		kind     reflect.Kind
+		expect   []float64
+	}{
+		{3, reflect.Uint8, []float64{255, 0, 0, 10, 20, 30}},
+		{3, reflect.Uint16, []float64{65535, 0, 0, 10 * 257, 20 * 257, 30 * 257}},
+		{3, reflect.Float32, []float64{1, 0, 0, 10.0 / 255, 20.0 / 255, 30.0 / 255}},
+		{4, reflect.Uint8, []float64{255, 0, 0, 255, 10, 20, 30, 255}},
+		{1, reflect.Uint8, []float64{76, 0.299*10 + 0.587*20 + 0.114*30}},
+	}
+	for i, v := range tests {
+		q, err := Convert(m, v.channels, v.kind)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if q.XChannels != v.channels || q.XDataType != v.kind || q.Bounds() != m.Bounds() {
+			t.Fatalf("%d: bad image %v, %v, %v", i, q.XChannels, q.XDataType, q.Bounds())
+		}
+		for j, want := range v.expect {
+			got := q.XPix.Value(j, v.kind)
+			if _, _, isInt := kindRange(v.kind); isInt {
+				want = math.Floor(want + 0.5)
+			}
+			if math.Abs(got-want) > 1e-6 {
+				t.Fatalf("%d: sample %d, expect = %v, got = %v", i, j, want, got)
+			}
+		}
+	}
+
+	// gray to RGBA and back
+	g := NewMemPImage(image.Rect(0, 0, 1, 1), 1, reflect.Uint16)
+	g.XPix.SetValue(0, reflect.Uint16, 1000)
+	q, err := Convert(g, 4, reflect.Uint16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := q.XPix.Uint16s(); v[0] != 1000 || v[1] != 1000 || v[2] != 1000 || v[3] != 0xFFFF {
+		t.Fatalf("gray to RGBA: got = %v", v)
+	}
+	if q, err = Convert(q, 1, reflect.Uint16); err != nil || q.XPix.Uint16s()[0] != 1000 {
+		t.Fatalf("RGBA to gray: got = %v, %v", q.XPix, err)
+	}
+
+	if _, err := Convert(m, 2, reflect.Uint8); err == nil {
+		t.Fatalf("expect error for 2 channels")
+	}
+	if _, err := Convert(m, 3, reflect.String); err == nil {
+		t.Fatalf("expect error for string kind")
+	}
+}
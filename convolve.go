@@ -0,0 +1,375 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"fmt"
+	"math"
+)
+
+// BorderMode selects how pixels outside the image are read by Convolve.
+type BorderMode int
+
+const (
+	BorderClamp    BorderMode = iota // aaa|abcd|ddd
+	BorderReflect                    // cb|abcd|cb
+	BorderWrap                       // cd|abcd|ab
+	BorderConstant                   // kk|abcd|kk, k is ConvolveOptions.Constant
+)
+
+// MaxKernelSize is the largest width and height of a Kernel.
+const MaxKernelSize = 1023
+
+func (b BorderMode) String() string {
+	switch b {
+	case BorderClamp:
+		return "BorderClamp"
+	case BorderReflect:
+		return "BorderReflect"
+	case BorderWrap:
+		return "BorderWrap"
+	case BorderConstant:
+		return "BorderConstant"
+	}
+	return fmt.Sprintf("BorderMode(%d)", int(b))
+}
+
+// index maps i to [0, n). ok is false if the sample is the constant border.
+func (b BorderMode) index(i, n int) (j int, ok bool) {
+	if i >= 0 && i < n {
+		return i, true
+	}
+	switch b {
+	case BorderClamp:
+		if i < 0 {
+			return 0, true
+		}
+		return n - 1, true
+	case BorderReflect:
+		if n == 1 {
+			return 0, true
+		}
+		period := 2 * (n - 1)
+		if i = i % period; i < 0 {
+			i += period
+		}
+		if i >= n {
+			i = period - i
+		}
+		return i, true
+	case BorderWrap:
+		if i = i % n; i < 0 {
+			i += n
+		}
+		return i, true
+	}
+	return 0, false
+}
+
+// Kernel is a Width x Height filter with the anchor at its center.
+//
+// Separable kernels also hold the horizontal factor X and the vertical
+// factor Y, with Data[y*Width+x] = Y[y]*X[x]. Convolve uses two 1D passes
+// for them.
+type Kernel struct {
+	Width  int
+	Height int
+	Data   []float64 // row major weights, len(Data) == Width*Height
+	X      []float64 // optional, len(X) == Width
+	Y      []float64 // optional, len(Y) == Height
+}
+
+// NewKernel returns a w x h kernel. w and h must be odd, and at most
+// MaxKernelSize.
+func NewKernel(w, h int, data []float64) (*Kernel, error) {
+	if err := checkKernelSize(w, h); err != nil {
+		return nil, err
+	}
+	k := &Kernel{
+		Width:  w,
+		Height: h,
+		Data:   append([]float64(nil), data...),
+	}
+	if err := k.check(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewSeparableKernel returns the len(x) x len(y) kernel y*x.
+func NewSeparableKernel(x, y []float64) (*Kernel, error) {
+	if err := checkKernelSize(len(x), len(y)); err != nil {
+		return nil, err
+	}
+	k := &Kernel{
+		Width:  len(x),
+		Height: len(y),
+		Data:   make([]float64, len(x)*len(y)),
+		X:      append([]float64(nil), x...),
+		Y:      append([]float64(nil), y...),
+	}
+	for j, vy := range y {
+		for i, vx := range x {
+			k.Data[j*k.Width+i] = vy * vx
+		}
+	}
+	if err := k.check(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func checkKernelSize(w, h int) error {
+	if w <= 0 || h <= 0 || w%2 == 0 || h%2 == 0 || w > MaxKernelSize || h > MaxKernelSize {
+		return fmt.Errorf("rawp: bad kernel size, width = %v, height = %v", w, h)
+	}
+	return nil
+}
+
+func (k *Kernel) check() error {
+	if err := checkKernelSize(k.Width, k.Height); err != nil {
+		return err
+	}
+	if len(k.Data) != k.Width*k.Height {
+		return fmt.Errorf("rawp: bad kernel data size, %v", len(k.Data))
+	}
+	if (k.X == nil) != (k.Y == nil) || (k.X != nil && (len(k.X) != k.Width || len(k.Y) != k.Height)) {
+		return fmt.Errorf("rawp: bad separable kernel, len(X) = %v, len(Y) = %v", len(k.X), len(k.Y))
+	}
+	return nil
+}
+
+// Separable reports whether k has the factors X and Y.
+func (k *Kernel) Separable() bool {
+	return k.X != nil && k.Y != nil
+}
+
+func mustKernel(k *Kernel, err error) *Kernel {
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// GaussianKernel returns a normalized separable Gaussian kernel with the
+// radius ceil(3*sigma).
+func GaussianKernel(sigma float64) (*Kernel, error) {
+	if !(sigma > 0) || math.Ceil(3*sigma) > MaxKernelSize/2 {
+		return nil, fmt.Errorf("rawp: bad Gaussian sigma, %v", sigma)
+	}
+	r := int(math.Ceil(3 * sigma))
+	w := make([]float64, 2*r+1)
+	sum := 0.0
+	for i := range w {
+		x := float64(i - r)
+		w[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += w[i]
+	}
+	for i := range w {
+		w[i] /= sum
+	}
+	return NewSeparableKernel(w, w)
+}
+
+// BoxKernel returns a normalized separable (2*radius+1)^2 mean kernel.
+func BoxKernel(radius int) (*Kernel, error) {
+	if radius < 0 || radius > MaxKernelSize/2 {
+		return nil, fmt.Errorf("rawp: bad box radius, %v", radius)
+	}
+	w := make([]float64, 2*radius+1)
+	for i := range w {
+		w[i] = 1 / float64(len(w))
+	}
+	return NewSeparableKernel(w, w)
+}
+
+// SobelXKernel returns the 3x3 Sobel kernel of the horizontal gradient.
+func SobelXKernel() *Kernel {
+	return mustKernel(NewSeparableKernel([]float64{-1, 0, 1}, []float64{1, 2, 1}))
+}
+
+// SobelYKernel returns the 3x3 Sobel kernel of the vertical gradient.
+func SobelYKernel() *Kernel {
+	return mustKernel(NewSeparableKernel([]float64{1, 2, 1}, []float64{-1, 0, 1}))
+}
+
+// LaplacianKernel returns the 3x3 4-neighbour Laplacian kernel.
+func LaplacianKernel() *Kernel {
+	return mustKernel(NewKernel(3, 3, []float64{
+		0, 1, 0,
+		1, -4, 1,
+		0, 1, 0,
+	}))
+}
+
+// SharpenKernel returns the 3x3 sharpen kernel (identity minus Laplacian).
+func SharpenKernel() *Kernel {
+	return mustKernel(NewKernel(3, 3, []float64{
+		0, -1, 0,
+		-1, 5, -1,
+		0, -1, 0,
+	}))
+}
+
+// ConvolveOptions are the options of ConvolveWithOptions.
+type ConvolveOptions struct {
+	Border BorderMode
+
+	// Constant is the sample value of the pixels outside the image for
+	// BorderConstant, in the range of the kind of the image.
+	Constant float64
+}
+
+// Convolve filters every channel of m with k and returns the result as a
+// new image of the same size, channels and kind.
+//
+// The kernel is applied without flipping (as a correlation, like most
+// image libraries), so SobelXKernel is positive where m gets brighter to
+// the right. Sums are computed in float64 and rounded and saturated for
+// integer kinds.
+func Convolve(m *MemPImage, k *Kernel, border BorderMode) (*MemPImage, error) {
+	return ConvolveWithOptions(m, k, &ConvolveOptions{Border: border})
+}
+
+// ConvolveWithOptions is like Convolve, with the options opt (nil for
+// BorderClamp).
+func ConvolveWithOptions(m *MemPImage, k *Kernel, opt *ConvolveOptions) (*MemPImage, error) {
+	var o ConvolveOptions
+	if opt != nil {
+		o = *opt
+	}
+	border := o.Border
+	if k == nil {
+		return nil, fmt.Errorf("rawp: nil kernel")
+	}
+	if err := k.check(); err != nil {
+		return nil, err
+	}
+	if border < BorderClamp || border > BorderConstant {
+		return nil, fmt.Errorf("rawp: bad border mode, %v", border)
+	}
+	if math.IsNaN(o.Constant) || math.IsInf(o.Constant, 0) {
+		return nil, fmt.Errorf("rawp: bad border constant, %v", o.Constant)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	w, h, c := m.XRect.Dx(), m.XRect.Dy(), m.XChannels
+	dst := NewMemPImage(m.XRect, c, m.XDataType)
+	if w <= 0 || h <= 0 {
+		return dst, nil
+	}
+
+	src := make([]float64, w*h*c)
+	parallelRows(h, w, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			loadRow(src[y*w*c:][:w*c], m.rowPix(m.XRect.Min.Y+y), m.XDataType)
+		}
+	})
+
+	if k.Separable() {
+		tmp := make([]float64, w*h*c)
+		convolveRows(tmp, src, w, h, c, k.X, border, o.Constant)
+
+		// rows outside the image are constant rows after the first pass
+		sum := 0.0
+		for _, kv := range k.X {
+			sum += kv
+		}
+		convolveCols(dst, tmp, w, h, c, k.Y, border, o.Constant*sum)
+		return dst, nil
+	}
+
+	rx, ry := k.Width/2, k.Height/2
+	parallelRows(h, w, func(y0, y1 int) {
+		acc := make([]float64, w*c)
+		for y := y0; y < y1; y++ {
+			for i := range acc {
+				acc[i] = 0
+			}
+			for j := 0; j < k.Height; j++ {
+				sy, rowOK := border.index(y+j-ry, h)
+				row := src[sy*w*c:][:w*c]
+				for i := 0; i < k.Width; i++ {
+					kv := k.Data[j*k.Width+i]
+					if kv == 0 {
+						continue
+					}
+					for x := 0; x < w; x++ {
+						sx, ok := border.index(x+i-rx, w)
+						if !ok || !rowOK {
+							for ch := 0; ch < c; ch++ {
+								acc[x*c+ch] += kv * o.Constant
+							}
+							continue
+						}
+						for ch := 0; ch < c; ch++ {
+							acc[x*c+ch] += kv * row[sx*c+ch]
+						}
+					}
+				}
+			}
+			storeRow(dst.rowPix(dst.XRect.Min.Y+y), dst.XDataType, acc)
+		}
+	})
+	return dst, nil
+}
+
+// convolveRows applies the 1D kernel kx along every row of src into dst.
+// k is the value of the samples of the constant border.
+func convolveRows(dst, src []float64, w, h, c int, kx []float64, border BorderMode, k float64) {
+	r := len(kx) / 2
+	parallelRows(h, w, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			s := src[y*w*c:][:w*c]
+			d := dst[y*w*c:][:w*c]
+			for x := 0; x < w; x++ {
+				for ch := 0; ch < c; ch++ {
+					sum := 0.0
+					for i, kv := range kx {
+						if sx, ok := border.index(x+i-r, w); ok {
+							sum += kv * s[sx*c+ch]
+						} else {
+							sum += kv * k
+						}
+					}
+					d[x*c+ch] = sum
+				}
+			}
+		}
+	})
+}
+
+// convolveCols applies the 1D kernel ky along every column of src and
+// stores the result in m. k is the value of the samples of the constant
+// border.
+func convolveCols(m *MemPImage, src []float64, w, h, c int, ky []float64, border BorderMode, k float64) {
+	r := len(ky) / 2
+	parallelRows(h, w, func(y0, y1 int) {
+		acc := make([]float64, w*c)
+		for y := y0; y < y1; y++ {
+			for i := range acc {
+				acc[i] = 0
+			}
+			for j, kv := range ky {
+				if kv == 0 {
+					continue
+				}
+				sy, ok := border.index(y+j-r, h)
+				if !ok {
+					for i := range acc {
+						acc[i] += kv * k
+					}
+					continue
+				}
+				for i, v := range src[sy*w*c:][:w*c] {
+					acc[i] += kv * v
+				}
+			}
+			storeRow(m.rowPix(m.XRect.Min.Y+y), m.XDataType, acc)
+		}
+	})
+}
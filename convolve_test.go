@@ -0,0 +1,147 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"image"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBorderModeIndex(t *testing.T) {
+	tests := []struct {
+		border BorderMode
+		expect []int // for i = -3 ... 6, n = 4
+	}{
+		{BorderClamp, []int{0, 0, 0, 0, 1, 2, 3, 3, 3, 3}},
+		{BorderReflect, []int{3, 2, 1, 0, 1, 2, 3, 2, 1, 0}},
+		{BorderWrap, []int{1, 2, 3, 0, 1, 2, 3, 0, 1, 2}},
+		{BorderConstant, []int{-1, -1, -1, 0, 1, 2, 3, -1, -1, -1}},
+	}
+	for _, v := range tests {
+		for i := -3; i <= 6; i++ {
+			j, ok := v.border.index(i, 4)
+			if !ok {
+				j = -1
+			}
+			if expect := v.expect[i+3]; j != expect {
+				t.Fatalf("%v: index(%d): expect = %v, got = %v", v.border, i, expect, j)
+			}
+		}
+	}
+}
+
+func TestConvolve(t *testing.T) {
+	// horizontal ramp: v = 10*x
+	m := NewMemPImage(image.Rect(0, 0, 8, 5), 2, reflect.Float32)
+	for y := 0; y < 5; y++ {
+		for x := 0; x < 8; x++ {
+			p := m.PixelAt(x, y)
+			PixSlice(p).SetValue(0, reflect.Float32, float64(10*x))
+			PixSlice(p).SetValue(1, reflect.Float32, 7)
+		}
+	}
+
+	sobel, err := Convolve(m, SobelXKernel(), BorderClamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := PixSlice(sobel.PixelAt(3, 2)).Float32s(); v[0] != 80 || v[1] != 0 {
+		t.Fatalf("sobel: got = %v", v)
+	}
+
+	// the separable and the full 2D path must agree
+	g, err := GaussianKernel(1.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _ := NewKernel(g.Width, g.Height, g.Data)
+	for _, opt := range []ConvolveOptions{
+		{Border: BorderClamp},
+		{Border: BorderReflect},
+		{Border: BorderWrap},
+		{Border: BorderConstant},
+		{Border: BorderConstant, Constant: 50},
+	} {
+		border := opt.Border
+		m0, err := ConvolveWithOptions(m, g, &opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m1, err := ConvolveWithOptions(m, full, &opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v0, v1 := m0.XPix.Float32s(), m1.XPix.Float32s()
+		for i := range v0 {
+			if math.Abs(float64(v0[i]-v1[i])) > 1e-4 {
+				t.Fatalf("%v: %d: %v != %v", border, i, v0[i], v1[i])
+			}
+		}
+	}
+}
+
+func TestConvolveSaturate(t *testing.T) {
+	m := NewMemPImage(image.Rect(0, 0, 3, 1), 1, reflect.Uint8)
+	copy(m.XPix, []byte{200, 0, 100})
+	d, err := Convolve(m, LaplacianKernel(), BorderConstant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := []byte{0, 255, 0}; string(d.XPix) != string(expect) {
+		t.Fatalf("expect = %v, got = %v", expect, d.XPix)
+	}
+	if _, err := NewKernel(2, 2, make([]float64, 4)); err == nil {
+		t.Fatal("expect even kernel size error")
+	}
+}
+
+func TestConvolveConstant(t *testing.T) {
+	m := NewMemPImage(image.Rect(0, 0, 4, 3), 1, reflect.Uint8)
+	for i := range m.XPix {
+		m.XPix[i] = 90
+	}
+	box, err := BoxKernel(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _ := NewKernel(box.Width, box.Height, box.Data)
+	for _, k := range []*Kernel{box, full} {
+		d, err := ConvolveWithOptions(m, k, &ConvolveOptions{Border: BorderConstant, Constant: 180})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the corner sees 4 image pixels and 5 border pixels
+		if v := d.XPix[0]; v != (4*90+5*180)/9 {
+			t.Fatalf("corner: got = %v", v)
+		}
+		if v := d.XPix[1]; v != (6*90+3*180)/9 {
+			t.Fatalf("edge: got = %v", v)
+		}
+	}
+	if _, err := ConvolveWithOptions(m, box, &ConvolveOptions{Border: BorderConstant, Constant: math.NaN()}); err == nil {
+		t.Fatal("expect bad constant error")
+	}
+}
+
+func TestKernelLimits(t *testing.T) {
+	for _, sigma := range []float64{0, -1, math.NaN(), math.Inf(1), 1e9} {
+		if _, err := GaussianKernel(sigma); err == nil {
+			t.Fatalf("GaussianKernel(%v): expect error", sigma)
+		}
+	}
+	for _, r := range []int{-1, MaxKernelSize, 1 << 40} {
+		if _, err := BoxKernel(r); err == nil {
+			t.Fatalf("BoxKernel(%v): expect error", r)
+		}
+	}
+	if _, err := BoxKernel(MaxKernelSize / 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSeparableKernel(make([]float64, MaxKernelSize+2), []float64{1}); err == nil {
+		t.Fatal("NewSeparableKernel: expect size error")
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// CFAPattern is the color filter array of raw sensor data, named by the
+// colors of the 2x2 pixels at even coordinates (x, y), (x+1, y), (x, y+1)
+// and (x+1, y+1). The coordinates are those of the image bounds, so the
+// pattern does not change for sub images.
+type CFAPattern int
+
+const (
+	CFANone CFAPattern = iota // not raw sensor data
+	CFARGGB
+	CFABGGR
+	CFAGRBG
+	CFAGBRG
+)
+
+// cfaColors holds the channel (0=R, 1=G, 2=B) of each pixel of the 2x2
+// cell of the patterns.
+var cfaColors = [...][4]int{
+	CFARGGB: {0, 1, 1, 2},
+	CFABGGR: {2, 1, 1, 0},
+	CFAGRBG: {1, 0, 2, 1},
+	CFAGBRG: {1, 2, 0, 1},
+}
+
+func (p CFAPattern) String() string {
+	switch p {
+	case CFANone:
+		return "None"
+	case CFARGGB:
+		return "RGGB"
+	case CFABGGR:
+		return "BGGR"
+	case CFAGRBG:
+		return "GRBG"
+	case CFAGBRG:
+		return "GBRG"
+	}
+	return fmt.Sprintf("CFAPattern(%d)", int(p))
+}
+
+// ParseCFAPattern returns the pattern named s, like "RGGB" (any case).
+func ParseCFAPattern(s string) (CFAPattern, error) {
+	for p := CFARGGB; p <= CFAGBRG; p++ {
+		if strings.EqualFold(s, p.String()) {
+			return p, nil
+		}
+	}
+	return CFANone, fmt.Errorf("rawp: unknown CFA pattern %q", s)
+}
+
+// CFA describes the raw sensor data of 1 channel images. It is stored in
+// the header extensions of RawP images.
+type CFA struct {
+	Pattern    CFAPattern
+	BlackLevel float64 // sample value of black
+	WhiteLevel float64 // sample value of saturation, 0 for the largest value
+}
+
+// valid reports whether c can be stored, a zero CFA is not.
+func (c CFA) valid() bool {
+	if c.Pattern < CFARGGB || c.Pattern > CFAGBRG {
+		return false
+	}
+	if math.IsNaN(c.BlackLevel) || math.IsInf(c.BlackLevel, 0) || math.IsNaN(c.WhiteLevel) || math.IsInf(c.WhiteLevel, 0) {
+		return false
+	}
+	return c.WhiteLevel == 0 || c.WhiteLevel > c.BlackLevel
+}
+
+// DemosaicMethod selects how Demosaic interpolates the missing colors.
+type DemosaicMethod int
+
+const (
+	DemosaicBilinear  DemosaicMethod = iota // average of the nearest samples of each color
+	DemosaicEdgeAware                       // Hamilton-Adams, green along edges, then color differences
+)
+
+func (d DemosaicMethod) String() string {
+	switch d {
+	case DemosaicBilinear:
+		return "DemosaicBilinear"
+	case DemosaicEdgeAware:
+		return "DemosaicEdgeAware"
+	}
+	return fmt.Sprintf("DemosaicMethod(%d)", int(d))
+}
+
+// Demosaic interpolates the 1 channel raw sensor image m into an RGB
+// image of the same kind. pattern CFANone uses m.XCFA.Pattern.
+//
+// Samples are scaled from m.XCFA.BlackLevel and WhiteLevel to the range of
+// the kind (0 to 1 for floats). A WhiteLevel of 0 is the largest value of
+// the kind, or of m.XDepth bits for packed depths.
+func Demosaic(m *MemPImage, pattern CFAPattern, method DemosaicMethod) (*MemPImage, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if m.XChannels != 1 {
+		return nil, errUnsupported("Channels", m.XChannels)
+	}
+	if pattern == CFANone {
+		pattern = m.XCFA.Pattern
+	}
+	cfa := CFA{Pattern: pattern, BlackLevel: m.XCFA.BlackLevel, WhiteLevel: m.XCFA.WhiteLevel}
+	if !cfa.valid() {
+		return nil, errUnsupported("CFA", fmt.Sprintf("%v, levels %v-%v", pattern, cfa.BlackLevel, cfa.WhiteLevel))
+	}
+	if method != DemosaicBilinear && method != DemosaicEdgeAware {
+		return nil, errUnsupported("Method", method)
+	}
+	w, h := m.XRect.Dx(), m.XRect.Dy()
+	if w < 2 || h < 2 {
+		return nil, errUnsupported("Size", m.XRect.Size())
+	}
+
+	max := 1.0
+	if _, hi, ok := kindRange(m.XDataType); ok {
+		max = hi
+	}
+	white := cfa.WhiteLevel
+	if white == 0 {
+		if white = max; m.XDepth > 0 {
+			white = float64(uint64(1)<<uint(m.XDepth) - 1)
+		}
+	}
+	if white <= cfa.BlackLevel {
+		return nil, errUnsupported("CFA", fmt.Sprintf("%v, levels %v-%v", pattern, cfa.BlackLevel, white))
+	}
+	scale := max / (white - cfa.BlackLevel)
+
+	d := &demosaicState{
+		w:   w,
+		h:   h,
+		x0:  m.XRect.Min.X & 1,
+		y0:  m.XRect.Min.Y & 1,
+		cfa: cfaColors[pattern],
+		v:   make([]float64, w*h),
+	}
+	parallelRows(h, w, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			row := d.v[y*w:][:w]
+			loadRow(row, m.rowPix(m.XRect.Min.Y+y), m.XDataType)
+			for i := range row {
+				row[i] = (row[i] - cfa.BlackLevel) * scale
+			}
+		}
+	})
+	if method == DemosaicEdgeAware {
+		d.g = make([]float64, w*h)
+		parallelRows(h, w, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				for x := 0; x < w; x++ {
+					d.g[y*w+x] = d.green(x, y)
+				}
+			}
+		})
+	}
+
+	dst := NewMemPImage(m.XRect, 3, m.XDataType)
+	parallelRows(h, w, func(y0, y1 int) {
+		s := make([]float64, w*3)
+		for y := y0; y < y1; y++ {
+			for x := 0; x < w; x++ {
+				for c := 0; c < 3; c++ {
+					s[x*3+c] = d.sample(x, y, c)
+				}
+			}
+			storeRow(dst.rowPix(m.XRect.Min.Y+y), dst.XDataType, s)
+		}
+	})
+	return dst, nil
+}
+
+// demosaicState holds the scaled samples v of a w x h raw image, and the
+// interpolated green plane g of the edge aware method. (x0, y0) is the
+// parity of the image origin.
+type demosaicState struct {
+	w, h   int
+	x0, y0 int
+	cfa    [4]int
+	v      []float64
+	g      []float64
+}
+
+// color returns the channel of the pixel (x, y).
+func (d *demosaicState) color(x, y int) int {
+	return d.cfa[((y+d.y0)&1)*2+(x+d.x0)&1]
+}
+
+// at returns the sample (x, y), reflected at the borders, which keeps
+// the colors of the pattern.
+func (d *demosaicState) at(p []float64, x, y int) float64 {
+	x, _ = BorderReflect.index(x, d.w)
+	y, _ = BorderReflect.index(y, d.h)
+	return p[y*d.w+x]
+}
+
+// mean returns the mean of the pixels of channel c around (x, y), the
+// 3x3 window minus the center. With diff, it is the mean of the color
+// differences to the green plane.
+func (d *demosaicState) mean(x, y, c int, diff bool) float64 {
+	var sum float64
+	var n int
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if (dx != 0 || dy != 0) && d.color(x+dx, y+dy) == c {
+				v := d.at(d.v, x+dx, y+dy)
+				if diff {
+					v -= d.at(d.g, x+dx, y+dy)
+				}
+				sum += v
+				n++
+			}
+		}
+	}
+	return sum / float64(n)
+}
+
+// green interpolates green at (x, y) along the smoother direction, with
+// the second derivative of the color of the pixel as correction.
+func (d *demosaicState) green(x, y int) float64 {
+	v := d.at(d.v, x, y)
+	if d.color(x, y) == 1 {
+		return v
+	}
+	l, r := d.at(d.v, x-1, y), d.at(d.v, x+1, y)
+	u, b := d.at(d.v, x, y-1), d.at(d.v, x, y+1)
+	ch := 2*v - d.at(d.v, x-2, y) - d.at(d.v, x+2, y)
+	cv := 2*v - d.at(d.v, x, y-2) - d.at(d.v, x, y+2)
+
+	gh, gv := (l+r)/2+ch/4, (u+b)/2+cv/4
+	dh, dv := math.Abs(l-r)+math.Abs(ch), math.Abs(u-b)+math.Abs(cv)
+	switch {
+	case dh < dv:
+		return gh
+	case dv < dh:
+		return gv
+	}
+	return (gh + gv) / 2
+}
+
+// sample returns channel c of the pixel (x, y).
+func (d *demosaicState) sample(x, y, c int) float64 {
+	if d.g == nil {
+		if d.color(x, y) == c {
+			return d.at(d.v, x, y)
+		}
+		return d.mean(x, y, c, false)
+	}
+
+	g := d.g[y*d.w+x]
+	switch {
+	case c == 1:
+		return g
+	case d.color(x, y) == c:
+		return d.v[y*d.w+x]
+	}
+	return g + d.mean(x, y, c, true)
+}
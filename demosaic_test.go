@@ -0,0 +1,192 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tMosaic samples the RGB image m through the pattern p.
+func tMosaic(m *MemPImage, p CFAPattern) *MemPImage {
+	raw := NewMemPImage(m.XRect, 1, m.XDataType)
+	raw.XCFA.Pattern = p
+	for y := m.XRect.Min.Y; y < m.XRect.Max.Y; y++ {
+		for x := m.XRect.Min.X; x < m.XRect.Max.X; x++ {
+			c := cfaColors[p][(y&1)*2+x&1]
+			copy(raw.PixelAt(x, y), m.PixelAt(x, y)[c*SizeofKind(m.XDataType):][:SizeofKind(m.XDataType)])
+		}
+	}
+	return raw
+}
+
+func TestDemosaic_flat(t *testing.T) {
+	for _, kind := range []reflect.Kind{reflect.Uint8, reflect.Uint16, reflect.Float32} {
+		m := NewMemPImage(image.Rect(-3, 5, 10, 14), 3, kind)
+		for i := 0; i < 13*9; i++ {
+			m.XPix.SetValue(i*3+0, kind, 200)
+			m.XPix.SetValue(i*3+1, kind, 100)
+			m.XPix.SetValue(i*3+2, kind, 50)
+		}
+		for p := CFARGGB; p <= CFAGBRG; p++ {
+			raw := tMosaic(m, p).SubImage(image.Rect(-2, 6, 9, 13)).(*MemPImage)
+			for _, method := range []DemosaicMethod{DemosaicBilinear, DemosaicEdgeAware} {
+				if kind == reflect.Float32 {
+					raw.XCFA.WhiteLevel = 255
+				}
+				rgb, err := Demosaic(raw, CFANone, method)
+				if err != nil {
+					t.Fatalf("%v %v %v: %v", kind, p, method, err)
+				}
+				want := m.SubImage(raw.Bounds()).(*MemPImage)
+				if kind == reflect.Float32 {
+					want = NewMemPImage(raw.Bounds(), 3, kind)
+					for i := 0; i < 11*7; i++ {
+						copy(want.XPix.Float32s()[i*3:], []float32{200.0 / 255, 100.0 / 255, 50.0 / 255})
+					}
+					for i, v := range rgb.XPix.Float32s() {
+						if w := want.XPix.Float32s()[i]; math.Abs(float64(v-w)) > 1e-6 {
+							t.Fatalf("%v %v %v: sample %d = %v, want %v", kind, p, method, i, v, w)
+						}
+					}
+					continue
+				}
+				tCheckPixels(t, rgb, want)
+			}
+		}
+	}
+}
+
+func TestDemosaic_levels(t *testing.T) {
+	raw := NewMemPImage(image.Rect(0, 0, 4, 4), 1, reflect.Uint16)
+	for i := range raw.XPix.Uint16s() {
+		raw.XPix.Uint16s()[i] = 1023
+	}
+	raw.XPix.Uint16s()[0] = 64
+	raw.XDepth = 10
+	raw.XCFA = CFA{Pattern: CFARGGB, BlackLevel: 64}
+
+	rgb, err := Demosaic(raw, CFANone, DemosaicBilinear)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := rgb.XPix.Uint16s(); v[0] != 0 || v[1] != 65535 || v[2] != 65535 {
+		t.Fatalf("samples = %v", v[:6])
+	}
+	if rgb.XDepth != 0 || rgb.XCFA != (CFA{}) {
+		t.Fatalf("XDepth = %d, XCFA = %v", rgb.XDepth, rgb.XCFA)
+	}
+
+	// the pattern argument wins over m.XCFA.Pattern
+	if rgb, err = Demosaic(raw, CFABGGR, DemosaicBilinear); err != nil {
+		t.Fatal(err)
+	}
+	if v := rgb.XPix.Uint16s(); v[0] != 65535 || v[2] != 0 {
+		t.Fatalf("BGGR: samples = %v", v[:3])
+	}
+}
+
+func TestDemosaic_edge(t *testing.T) {
+	// a gray vertical step, which bilinear fringes with color
+	m := NewMemPImage(image.Rect(0, 0, 16, 16), 3, reflect.Uint8)
+	for y := 0; y < 16; y++ {
+		for x := 8; x < 16; x++ {
+			copy(m.PixelAt(x, y), []byte{200, 200, 200})
+		}
+	}
+	raw := tMosaic(m, CFAGRBG)
+
+	var errs [2]int
+	for i, method := range []DemosaicMethod{DemosaicBilinear, DemosaicEdgeAware} {
+		rgb, err := Demosaic(raw, CFANone, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, v := range rgb.XPix {
+			if d := int(v) - int(m.XPix[j]); d < 0 {
+				errs[i] -= d
+			} else {
+				errs[i] += d
+			}
+		}
+	}
+	if errs[1] >= errs[0] {
+		t.Fatalf("errors: bilinear = %d, edge aware = %d", errs[0], errs[1])
+	}
+}
+
+func TestDemosaic_errors(t *testing.T) {
+	raw := NewMemPImage(image.Rect(0, 0, 4, 4), 1, reflect.Uint16)
+	if _, err := Demosaic(raw, CFANone, DemosaicBilinear); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("no pattern: expect = %v, got = %v", ErrUnsupported, err)
+	}
+	if _, err := Demosaic(raw, CFARGGB, DemosaicMethod(7)); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("method: expect = %v, got = %v", ErrUnsupported, err)
+	}
+	raw.XCFA.BlackLevel = 70000
+	if _, err := Demosaic(raw, CFARGGB, DemosaicBilinear); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("levels: expect = %v, got = %v", ErrUnsupported, err)
+	}
+	if _, err := Demosaic(NewMemPImage(image.Rect(0, 0, 4, 1), 1, reflect.Uint16), CFARGGB, DemosaicBilinear); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("size: expect = %v, got = %v", ErrUnsupported, err)
+	}
+	if _, err := Demosaic(NewMemPImage(image.Rect(0, 0, 4, 4), 3, reflect.Uint16), CFARGGB, DemosaicBilinear); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("channels: expect = %v, got = %v", ErrUnsupported, err)
+	}
+}
+
+func TestEncodeAndDecode_CFA(t *testing.T) {
+	raw := NewMemPImage(image.Rect(1, 1, 9, 7), 1, reflect.Uint16)
+	raw.XCFA = CFA{Pattern: CFAGBRG, BlackLevel: 64, WhiteLevel: 4000}
+	sub := raw.SubImage(image.Rect(2, 2, 8, 6)).(*MemPImage)
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, sub, nil); err != nil {
+		t.Fatal(err)
+	}
+	h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.CFA != raw.XCFA {
+		t.Fatalf("Header.CFA = %v", h.CFA)
+	}
+	m, err := DecodeImage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.XCFA != raw.XCFA || m.Bounds() != sub.Bounds() {
+		t.Fatalf("XCFA = %v, bounds = %v", m.XCFA, m.Bounds())
+	}
+
+	// raw sensor data has 1 channel
+	rgb := NewMemPImage(image.Rect(0, 0, 2, 2), 3, reflect.Uint16)
+	rgb.XCFA.Pattern = CFARGGB
+	if err := Encode(new(bytes.Buffer), rgb, nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("Encode: expect = %v, got = %v", ErrUnsupported, err)
+	}
+
+	for _, cfa := range []CFA{{Pattern: 9}, {Pattern: CFARGGB, BlackLevel: 10, WhiteLevel: 5}, {Pattern: CFARGGB, BlackLevel: math.NaN()}} {
+		ext := rawpAppendExt(nil, &rawpHeader{CFA: cfa})
+		hdr := rawpHeader{Width: 2, Height: 2, Channels: 1}
+		if err := rawpReadExt(bytes.NewReader(ext), &hdr); !errors.Is(err, ErrFormat) {
+			t.Fatalf("%v: expect = %v, got = %v", cfa, ErrFormat, err)
+		}
+	}
+
+	for _, s := range []string{"rggb", "BGGR", "GrBg", "gbrg"} {
+		if p, err := ParseCFAPattern(s); err != nil || !strings.EqualFold(p.String(), s) {
+			t.Fatalf("ParseCFAPattern(%q) = %v, %v", s, p, err)
+		}
+	}
+	if _, err := ParseCFAPattern("RGBW"); err == nil {
+		t.Fatal("ParseCFAPattern(RGBW): expect an error")
+	}
+}
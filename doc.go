@@ -11,14 +11,61 @@
 //		Width        uint16  // 2Bytes, image Width
 //		Height       uint16  // 2Bytes, image Height
 //		Channels     byte    // 1Bytes, 1=Gray, 3=RGB, 4=RGBA
-//		Depth        byte    // 1Bytes, 8/16/32/64 bits
-//		DataType     byte    // 1Bytes, 1=Uint, 2=Int, 3=Float
-//		UseSnappy    byte    // 1Bytes, 0=disabled, 1=enabled (RawPImage.Data)
+//		Depth        byte    // 1Bytes, 8/16/32/64/128 bits, or packed 1/2/4/10/12 bits
+//		DataType     byte    // 1Bytes, 1=Uint, 2=Int, 3=Float, 4=BFloat, 5=Complex
+//		UseSnappy    byte    // 1Bytes, 0=disabled, 1=enabled, 2=blocks (RawPImage.Data)
 //		DataSize     uint32  // 4Bytes, image data size (RawPImage.Data)
 //		DataCheckSum uint32  // 4Bytes, CRC32(RawPImage.Data[RawPImage.DataSize])
 //		Data         []byte  // ?Bytes, image data (RawPImage.DataSize)
 //	}
 //
+// The high bits of UseSnappy are flags, which older readers reject as an
+// unknown compression: 0x80 header extensions, 0x40 MIPI packing and 0x30
+// the YUV layout (1=I420, 2=NV12, 3=I422). The compression is
+// UseSnappy&0x0F. Encode only sets them for images which need them.
+//
+// With UseSnappy == 2 the Data holds a table of independently compressed
+// snappy blocks, so large images can be encoded and decoded on all CPUs
+// (see Options.BlockSize):
+//	type RawPBlocks struct {
+//		BlockCount uint32              // 4Bytes, number of blocks
+//		BlockSize  uint32              // 4Bytes, uncompressed size of every block but the last
+//		Sizes      [BlockCount]uint32  // 4Bytes each, compressed size of each block
+//		Blocks     [BlockCount][?]byte // snappy compressed blocks
+//	}
+//
+// If UseSnappy&0x80 != 0, header extensions follow the header (before
+// Data), see rawp_ext.go. They hold the image origin (Bounds().Min) if it
+// is not (0, 0), the color filter array of raw sensor data, and the
+// MemPImage.XColorSpace:
+//	type RawPExtensions struct {
+//		Size     uint32 // 4Bytes, size of Entries
+//		CheckSum uint32 // 4Bytes, CRC32(Entries)
+//		Entries  [?]struct {
+//			Tag  [4]byte // 4Bytes, "ORIG": MinX, MinY int32
+//			             //         "CFAP": Pattern uint32, BlackLevel, WhiteLevel float64
+//			             //         "CSPC": ColorSpace uint32
+//			Size uint32  // 4Bytes, size of Data
+//			Data [Size]byte
+//		}
+//	}
+//
+// Packed depths (1, 2, 4, 10, 12 bits, Uint only) store the samples of a
+// row MSB first, each row padded to whole bytes. If UseSnappy&0x40 != 0,
+// 10 and 12 bit rows use the MIPI RAW10/RAW12 layout instead, see
+// rawp_pack.go. They decode to Uint8 or Uint16 images, with the packed
+// depth in MemPImage.XDepth.
+//
+// If UseSnappy&0x30 != 0, Data is a planar YUV frame (I420, NV12 or
+// I422, 3 channels, 8 bits Uint), see yuv.go. Encode writes *YUVImage
+// frames, and *image.YCbCr images with Options.YUV (RGBA otherwise).
+// DecodeYUV returns their planes, Decode an *image.YCbCr and DecodeImage
+// RGB.
+//
+// Sequence files record RawP frames with timestamps, with an index at the
+// end which the reader rebuilds by scanning if it is missing, see
+// sequence.go, SequenceWriter and SequenceReader.
+//
 // Please report bugs to chaishushan{AT}gmail.com.
 //
 // Thanks!
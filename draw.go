@@ -0,0 +1,241 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"reflect"
+	"unsafe"
+)
+
+// Op is a Porter-Duff compositing operator.
+type Op int
+
+const (
+	// Over specifies ``(src in mask) over dst''.
+	Over Op = iota
+	// Src specifies ``src in mask''.
+	Src
+	// In keeps src where dst is opaque.
+	In
+	// Out keeps src where dst is transparent.
+	Out
+)
+
+func (op Op) String() string {
+	switch op {
+	case Over:
+		return "Over"
+	case Src:
+		return "Src"
+	case In:
+		return "In"
+	case Out:
+		return "Out"
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+// AlphaMode tells Draw how the color channels relate to the alpha channel.
+type AlphaMode int
+
+const (
+	PremultipliedAlpha AlphaMode = iota // color channels are multiplied by alpha, like image.RGBA
+	StraightAlpha                       // color channels are independent of alpha, like image.NRGBA
+)
+
+// Draw composites src onto the rectangle r of dst with the operator op.
+// The pixel sp of src is aligned with r.Min, like draw.Draw.
+//
+// Only 4-channel images have alpha (the last channel), other images are
+// opaque. Integer samples are normalized by the largest value of their
+// kind, float samples are used as is, so dst and src may have different
+// kinds but must have the same channels. Draw assumes premultiplied alpha,
+// see DrawAlpha for straight alpha.
+func Draw(dst *MemPImage, r image.Rectangle, src *MemPImage, sp image.Point, op Op) error {
+	return DrawAlpha(dst, r, src, sp, op, PremultipliedAlpha)
+}
+
+// DrawAlpha is like Draw, with the given alpha mode for both images.
+func DrawAlpha(dst *MemPImage, r image.Rectangle, src *MemPImage, sp image.Point, op Op, mode AlphaMode) error {
+	if op < Over || op > Out {
+		return fmt.Errorf("rawp: bad draw Op, %v", op)
+	}
+	if mode != PremultipliedAlpha && mode != StraightAlpha {
+		return fmt.Errorf("rawp: bad AlphaMode, %v", mode)
+	}
+	if err := dst.Validate(); err != nil {
+		return err
+	}
+	if err := src.Validate(); err != nil {
+		return err
+	}
+	if dst.XChannels != src.XChannels {
+		return fmt.Errorf("rawp: channels mismatch, dst = %v, src = %v", dst.XChannels, src.XChannels)
+	}
+
+	// clip r to dst and src, see image/draw.clip
+	orig := r.Min
+	r = r.Intersect(dst.XRect)
+	r = r.Intersect(src.XRect.Add(orig.Sub(sp)))
+	if r.Empty() {
+		return nil
+	}
+	sp = sp.Add(r.Min.Sub(orig))
+
+	// work on a copy if src and dst share pixels
+	if pixOverlap(dst.XPix, src.XPix) {
+		src = src.SubImage(image.Rectangle{sp, sp.Add(r.Size())}).(*MemPImage).Clone()
+	}
+
+	w, h := r.Dx(), r.Dy()
+	c := dst.XChannels
+	n := w * SizeofPixel(c, dst.XDataType)
+
+	if src.XDataType == dst.XDataType {
+		switch {
+		case op == Src || (op == Over && c != 4):
+			parallelRows(h, w, func(y0, y1 int) {
+				for y := y0; y < y1; y++ {
+					d := dst.XPix[dst.PixOffset(r.Min.X, r.Min.Y+y):][:n]
+					s := src.XPix[src.PixOffset(sp.X, sp.Y+y):][:n]
+					copy(d, s)
+				}
+			})
+			return nil
+
+		case op == Over && mode == PremultipliedAlpha && dst.XDataType == reflect.Uint8:
+			parallelRows(h, w, func(y0, y1 int) {
+				for y := y0; y < y1; y++ {
+					d := dst.XPix[dst.PixOffset(r.Min.X, r.Min.Y+y):][:n]
+					s := src.XPix[src.PixOffset(sp.X, sp.Y+y):][:n]
+					drawOverRGBA8(d, s)
+				}
+			})
+			return nil
+		}
+	}
+
+	dstMax, srcMax := 1.0, 1.0
+	if _, hi, ok := kindRange(dst.XDataType); ok {
+		dstMax = hi
+	}
+	if _, hi, ok := kindRange(src.XDataType); ok {
+		srcMax = hi
+	}
+
+	parallelRows(h, w, func(y0, y1 int) {
+		d := make([]float64, w*c)
+		s := make([]float64, w*c)
+		for y := y0; y < y1; y++ {
+			drow := dst.XPix[dst.PixOffset(r.Min.X, r.Min.Y+y):][:n]
+			srow := src.XPix[src.PixOffset(sp.X, sp.Y+y):][:w*SizeofPixel(c, src.XDataType)]
+			loadRow(d, drow, dst.XDataType)
+			loadRow(s, srow, src.XDataType)
+			for i := range d {
+				d[i] /= dstMax
+				s[i] /= srcMax
+			}
+			drawPixels(d, s, c, op, mode)
+			for i := range d {
+				d[i] *= dstMax
+			}
+			storeRow(drow, dst.XDataType, d)
+		}
+	})
+	return nil
+}
+
+// drawPixels composites the normalized pixels s onto d.
+func drawPixels(d, s []float64, c int, op Op, mode AlphaMode) {
+	hasAlpha := c == 4
+	for x := 0; x+c <= len(d); x += c {
+		dp, sp := d[x:][:c], s[x:][:c]
+		as, ad := 1.0, 1.0
+		if hasAlpha {
+			as, ad = sp[3], dp[3]
+			if mode == StraightAlpha {
+				for i := 0; i < 3; i++ {
+					dp[i] *= ad
+				}
+			}
+		}
+
+		// Porter-Duff factors of src and dst
+		var fs, fd float64
+		switch op {
+		case Over:
+			fs, fd = 1, 1-as
+		case Src:
+			fs, fd = 1, 0
+		case In:
+			fs, fd = ad, 0
+		case Out:
+			fs, fd = 1-ad, 0
+		}
+
+		for i := 0; i < c; i++ {
+			v := sp[i]
+			if hasAlpha && i < 3 && mode == StraightAlpha {
+				v *= as
+			}
+			dp[i] = v*fs + dp[i]*fd
+		}
+
+		if hasAlpha && mode == StraightAlpha {
+			if a := dp[3]; a != 0 {
+				for i := 0; i < 3; i++ {
+					dp[i] /= a
+				}
+			} else {
+				dp[0], dp[1], dp[2] = 0, 0, 0
+			}
+		}
+	}
+}
+
+// drawOverRGBA8 composites the premultiplied RGBA pixels s over d.
+func drawOverRGBA8(d, s []byte) {
+	for i := 0; i+4 <= len(d); i += 4 {
+		a := 0xFF - uint32(s[i+3])
+		for j := i; j < i+4; j++ {
+			v := uint32(s[j]) + (uint32(d[j])*a+0x7F)/0xFF
+			if v > 0xFF {
+				v = 0xFF
+			}
+			d[j] = uint8(v)
+		}
+	}
+}
+
+// pixOverlap reports whether a and b share memory.
+func pixOverlap(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	a0 := uintptr(unsafe.Pointer(&a[0]))
+	b0 := uintptr(unsafe.Pointer(&b[0]))
+	return a0 < b0+uintptr(len(b)) && b0 < a0+uintptr(len(a))
+}
+
+// DrawImage is like draw.Draw, but uses Draw when dst and src can be
+// viewed as MemPImage (MemPImage, MemP, *image.Gray and *image.RGBA)
+// with the same channels. Other images fall back to draw.Draw.
+func DrawImage(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point, op draw.Op) {
+	if d, ok := AsMemPImage(dst); ok {
+		if s, ok := AsMemPImage(src); ok && d.XChannels == s.XChannels {
+			xop := Over
+			if op == draw.Src {
+				xop = Src
+			}
+			if err := Draw(d, r, s, sp, xop); err == nil {
+				return
+			}
+		}
+	}
+	draw.Draw(dst, r, src, sp, op)
+}
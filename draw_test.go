@@ -0,0 +1,102 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDrawMatchStdDraw(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	dst0 := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i * 7)
+		dst0.Pix[i] = uint8(i * 13)
+	}
+	// keep src premultiplied
+	for i := 0; i < len(src.Pix); i += 4 {
+		a := src.Pix[i+3]
+		for j := 0; j < 3; j++ {
+			if src.Pix[i+j] > a {
+				src.Pix[i+j] = a
+			}
+		}
+	}
+
+	for _, op := range []draw.Op{draw.Over, draw.Src} {
+		dst1 := image.NewRGBA(dst0.Bounds())
+		copy(dst1.Pix, dst0.Pix)
+		dst2 := image.NewRGBA(dst0.Bounds())
+		copy(dst2.Pix, dst0.Pix)
+
+		r := image.Rect(5, 3, 30, 30)
+		draw.Draw(dst1, r, src, image.Pt(2, 1), op)
+		DrawImage(dst2, r, src, image.Pt(2, 1), op)
+
+		for i := range dst1.Pix {
+			if d := int(dst1.Pix[i]) - int(dst2.Pix[i]); d < -1 || d > 1 {
+				t.Fatalf("%v: %d: %v != %v", op, i, dst1.Pix[i], dst2.Pix[i])
+			}
+		}
+	}
+}
+
+func TestDrawFloat(t *testing.T) {
+	dst := NewMemPImage(image.Rect(0, 0, 1, 1), 4, reflect.Float32)
+	src := NewMemPImage(image.Rect(0, 0, 1, 1), 4, reflect.Float32)
+
+	tests := []struct {
+		op     Op
+		mode   AlphaMode
+		expect []float32
+	}{
+		{Over, StraightAlpha, []float32{0.55 / 0.75, 0.2 / 0.75, 0.1 / 0.75, 0.75}},
+		{Over, PremultipliedAlpha, []float32{0.5, 0.3, 0.1, 0.75}},
+		{Src, StraightAlpha, []float32{1, 0, 0, 0.5}},
+		{In, StraightAlpha, []float32{1, 0, 0, 0.25}},
+		{Out, PremultipliedAlpha, []float32{0.25, 0, 0, 0.25}},
+	}
+	for _, v := range tests {
+		copy(dst.XPix.Float32s(), []float32{0.2, 0.8, 0.4, 0.5})
+		copy(src.XPix.Float32s(), []float32{1, 0, 0, 0.5})
+		if v.mode == PremultipliedAlpha {
+			copy(dst.XPix.Float32s(), []float32{0, 0.6, 0.2, 0.5})
+			copy(src.XPix.Float32s(), []float32{0.5, 0, 0, 0.5})
+		}
+		if err := DrawAlpha(dst, dst.Bounds(), src, image.ZP, v.op, v.mode); err != nil {
+			t.Fatal(err)
+		}
+		got := dst.XPix.Float32s()
+		for i := range got {
+			if math.Abs(float64(got[i]-v.expect[i])) > 1e-6 {
+				t.Fatalf("%v/%v: expect = %v, got = %v", v.op, v.mode, v.expect, got)
+			}
+		}
+	}
+}
+
+func TestDrawMixedKinds(t *testing.T) {
+	dst := NewMemPImage(image.Rect(0, 0, 2, 2), 3, reflect.Uint16)
+	src := NewMemPImage(image.Rect(0, 0, 2, 2), 3, reflect.Uint8)
+	src.Set(1, 1, color.RGBA{0xFF, 0x80, 0, 0xFF})
+
+	if err := Draw(dst, image.Rect(1, 1, 2, 2), src, image.Pt(1, 1), Src); err != nil {
+		t.Fatal(err)
+	}
+	if got := PixSlice(dst.PixelAt(1, 1)).Uint16s(); got[0] != 0xFFFF || got[1] != 0x8080 || got[2] != 0 {
+		t.Fatalf("got = %x", got)
+	}
+	if got := PixSlice(dst.PixelAt(0, 0)).Uint16s(); got[0] != 0 {
+		t.Fatalf("pixel outside r changed: %x", got)
+	}
+	if err := Draw(dst, dst.Bounds(), NewMemPImage(dst.Bounds(), 4, reflect.Uint16), image.ZP, Over); err == nil {
+		t.Fatal("expect channels mismatch error")
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned by the decoder and encoder. They are wrapped in a
+// *FormatError, test them with errors.Is.
+var (
+	ErrFormat      = errors.New("rawp: invalid format")
+	ErrChecksum    = errors.New("rawp: checksum mismatch")
+	ErrTruncated   = errors.New("rawp: truncated data")
+	ErrUnsupported = errors.New("rawp: unsupported image")
+	ErrTooLarge    = errors.New("rawp: image too large")
+)
+
+// A FormatError reports a bad header field or image data.
+//
+// Err is one of ErrFormat, ErrChecksum, ErrTruncated, ErrUnsupported and
+// ErrTooLarge. Got and Want are nil if unknown.
+type FormatError struct {
+	Field string      // header field, like "DataCheckSum", or "Data"
+	Got   interface{} // value found
+	Want  interface{} // value expected
+	Err   error       // kind of error
+}
+
+func (e *FormatError) Error() string {
+	s := "rawp: bad " + e.Field
+	if e.Err != nil {
+		s += " (" + strings.TrimPrefix(e.Err.Error(), "rawp: ") + ")"
+	}
+	if e.Want != nil {
+		s += fmt.Sprintf(", expect = %v", e.Want)
+	}
+	if e.Got != nil {
+		s += fmt.Sprintf(", got = %v", e.Got)
+	}
+	return s
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+func errFormat(field string, got interface{}) error {
+	return &FormatError{Field: field, Got: got, Err: ErrFormat}
+}
+
+func errUnsupported(field string, got interface{}) error {
+	return &FormatError{Field: field, Got: got, Err: ErrUnsupported}
+}
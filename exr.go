@@ -0,0 +1,524 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+)
+
+// OpenEXR, single part scanline images only, see "OpenEXR File Layout":
+//
+//	Magic      uint32 // 20000630
+//	Version    uint32 // 2, and flags in the upper bytes
+//	Header     []Attribute, up to an empty name
+//	Offsets    []uint64, of every block of lines
+//	Blocks     []Block
+//
+//	Attribute: Name string, Type string, Size int32, Value [Size]byte
+//	Block:     Y int32, Size int32, Data [Size]byte
+//
+// Strings end with a zero byte, numbers are little endian. The lines of a
+// block hold every channel in turn, in the (alphabetical) order of the
+// channel list. ZIP data is zlib compressed after the bytes are split in
+// two halves and delta encoded, a block is stored as is if that is not
+// smaller.
+const (
+	exrMagic   = 20000630
+	exrVersion = 2
+
+	exrFlag_Tiled     = 0x200
+	exrFlag_NonImage  = 0x800
+	exrFlag_MultiPart = 0x1000
+
+	exrCompression_None = 0
+	exrCompression_ZIPS = 2 // zip, 1 line blocks
+	exrCompression_ZIP  = 3 // zip, 16 lines blocks
+
+	exrPixelType_Uint  = 0
+	exrPixelType_Half  = 1
+	exrPixelType_Float = 2
+
+	exrMaxName = 255
+)
+
+// EXROptions are the encoding parameters of OpenEXR.
+type EXROptions struct {
+	UseZip bool // ZIP compression, of 16 lines blocks
+	Half   bool // store the channels as HALF, not FLOAT
+}
+
+// LoadEXR reads the OpenEXR image in the file name.
+func LoadEXR(name string) (m *MemPImage, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeEXR(f)
+}
+
+// SaveEXR writes m to the file name as OpenEXR with opt (nil for defaults).
+func SaveEXR(name string, m *MemPImage, opt *EXROptions) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if err = EncodeEXR(w, m, opt); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// exrChannelNames returns the channel names of images with channels.
+func exrChannelNames(channels int) []string {
+	switch channels {
+	case 1:
+		return []string{"Y"}
+	case 2:
+		return []string{"Y", "A"}
+	case 3:
+		return []string{"R", "G", "B"}
+	case 4:
+		return []string{"R", "G", "B", "A"}
+	}
+	return nil
+}
+
+// exrChannelIndex returns the image channel of the channels names of a
+// file. The usual names (Y, A, R, G, B) map as in exrChannelNames, others
+// keep the order of the file.
+func exrChannelIndex(names []string) []int {
+	index := make([]int, len(names))
+	for i := range index {
+		index[i] = i
+	}
+	want := exrChannelNames(len(names))
+	if want == nil {
+		return index
+	}
+	for i, name := range names {
+		found := false
+		for j, s := range want {
+			if s == name {
+				index[i], found = j, true
+			}
+		}
+		if !found {
+			for i := range index {
+				index[i] = i
+			}
+			return index
+		}
+	}
+	return index
+}
+
+// EncodeEXR writes m to w as a scanline OpenEXR image. m must hold Float32
+// samples, of 1 to 4 channels, named Y, YA, RGB and RGBA. The data window
+// is the bounds of m.
+func EncodeEXR(w io.Writer, m *MemPImage, opt *EXROptions) (err error) {
+	if err = m.Validate(); err != nil {
+		return
+	}
+	if m.XDataType != reflect.Float32 {
+		return errUnsupported("XDataType", KindString(m.XDataType))
+	}
+	names := exrChannelNames(m.XChannels)
+	if names == nil {
+		return errUnsupported("XChannels", m.XChannels)
+	}
+	b := m.XRect
+	if b.Empty() {
+		return errUnsupported("Size", fmt.Sprintf("%vx%v", b.Dx(), b.Dy()))
+	}
+	if err = rawpCheckOrigin(b.Min, b.Dx(), b.Dy()); err != nil {
+		return
+	}
+	if opt == nil {
+		opt = new(EXROptions)
+	}
+
+	pixelType, sampleSize := exrPixelType_Float, 4
+	if opt.Half {
+		pixelType, sampleSize = exrPixelType_Half, 2
+	}
+	compression, linesPerBlock := exrCompression_None, 1
+	if opt.UseZip {
+		compression, linesPerBlock = exrCompression_ZIP, 16
+	}
+
+	// channels of the file, in alphabetical order
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	for i := 1; i < len(order); i++ {
+		for j := i; j > 0 && names[order[j]] < names[order[j-1]]; j-- {
+			order[j], order[j-1] = order[j-1], order[j]
+		}
+	}
+	var chlist []byte
+	for _, ch := range order {
+		chlist = append(chlist, names[ch]...)
+		chlist = append(chlist, 0)
+		chlist = appendUint32(chlist, uint32(pixelType))
+		chlist = append(chlist, 0, 0, 0, 0) // pLinear, reserved
+		chlist = appendUint32(chlist, 1)    // xSampling
+		chlist = appendUint32(chlist, 1)    // ySampling
+	}
+	chlist = append(chlist, 0)
+
+	var window []byte
+	for _, v := range []int{b.Min.X, b.Min.Y, b.Max.X - 1, b.Max.Y - 1} {
+		window = appendUint32(window, uint32(int32(v)))
+	}
+	header := appendUint32(nil, exrMagic)
+	header = appendUint32(header, exrVersion)
+	header = exrAppendAttr(header, "channels", "chlist", chlist)
+	header = exrAppendAttr(header, "compression", "compression", []byte{byte(compression)})
+	header = exrAppendAttr(header, "dataWindow", "box2i", window)
+	header = exrAppendAttr(header, "displayWindow", "box2i", window)
+	header = exrAppendAttr(header, "lineOrder", "lineOrder", []byte{0}) // increasing Y
+	header = exrAppendAttr(header, "pixelAspectRatio", "float", appendUint32(nil, math.Float32bits(1)))
+	header = exrAppendAttr(header, "screenWindowCenter", "v2f", make([]byte, 8))
+	header = exrAppendAttr(header, "screenWindowWidth", "float", appendUint32(nil, math.Float32bits(1)))
+	header = append(header, 0)
+
+	width, height := b.Dx(), b.Dy()
+	numBlocks := (height + linesPerBlock - 1) / linesPerBlock
+	offsets := make([]byte, 8*numBlocks)
+	offset := uint64(len(header) + len(offsets))
+
+	var blocks [][]byte
+	var raw []byte
+	for i := 0; i < numBlocks; i++ {
+		y0 := b.Min.Y + i*linesPerBlock
+		y1 := y0 + linesPerBlock
+		if y1 > b.Max.Y {
+			y1 = b.Max.Y
+		}
+		raw = growBytes(raw, (y1-y0)*width*len(names)*sampleSize)[:0]
+		for y := y0; y < y1; y++ {
+			row := m.rowPix(y).Float32s()
+			for _, ch := range order {
+				for x := 0; x < width; x++ {
+					f := row[x*len(names)+ch]
+					if opt.Half {
+						raw = append(raw, 0, 0)
+						binary.LittleEndian.PutUint16(raw[len(raw)-2:], Float32ToHalf(f))
+					} else {
+						raw = appendUint32(raw, math.Float32bits(f))
+					}
+				}
+			}
+		}
+
+		data := raw
+		if opt.UseZip {
+			if z := exrZip(raw); len(z) < len(raw) {
+				data = z
+			}
+		}
+		block := appendUint32(nil, uint32(int32(y0)))
+		block = appendUint32(block, uint32(len(data)))
+		block = append(block, data...)
+		blocks = append(blocks, block)
+
+		binary.LittleEndian.PutUint64(offsets[8*i:], offset)
+		offset += uint64(len(block))
+	}
+
+	if _, err = w.Write(header); err != nil {
+		return
+	}
+	if _, err = w.Write(offsets); err != nil {
+		return
+	}
+	for _, block := range blocks {
+		if _, err = w.Write(block); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func exrAppendAttr(buf []byte, name, typ string, value []byte) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, 0)
+	buf = append(buf, typ...)
+	buf = append(buf, 0)
+	buf = appendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+// exrZip compresses raw with the ZIP compression of OpenEXR.
+func exrZip(raw []byte) []byte {
+	tmp := make([]byte, len(raw))
+	half := (len(raw) + 1) / 2
+	for i, c := range raw {
+		if i&1 == 0 {
+			tmp[i/2] = c
+		} else {
+			tmp[half+i/2] = c
+		}
+	}
+	for i := len(tmp) - 1; i > 0; i-- {
+		tmp[i] = tmp[i] - tmp[i-1] + 128
+	}
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(tmp)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// exrUnzip decompresses the ZIP data of OpenEXR, of size bytes.
+func exrUnzip(data []byte, size int) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	tmp := make([]byte, size)
+	if _, err = io.ReadFull(zr, tmp); err != nil {
+		return nil, err
+	}
+	for i := 1; i < len(tmp); i++ {
+		tmp[i] = tmp[i-1] + tmp[i] - 128
+	}
+
+	raw := make([]byte, size)
+	half := (size + 1) / 2
+	for i := range raw {
+		if i&1 == 0 {
+			raw[i] = tmp[i/2]
+		} else {
+			raw[i] = tmp[half+i/2]
+		}
+	}
+	return raw, nil
+}
+
+type exrChannel struct {
+	Name      string
+	PixelType int
+}
+
+// exrSampleSize returns the bytes of a HALF or FLOAT sample.
+func exrSampleSize(pixelType int) int {
+	if pixelType == exrPixelType_Half {
+		return 2
+	}
+	return 4
+}
+
+// DecodeEXR reads a single part scanline OpenEXR image from r, with HALF
+// or FLOAT channels and NO, ZIPS or ZIP compression. The samples are
+// returned as Float32, and the bounds are the data window.
+func DecodeEXR(r io.Reader) (m *MemPImage, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, &FormatError{Field: "exr.Header", Got: len(data), Want: 8, Err: ErrTruncated}
+	}
+	if v := binary.LittleEndian.Uint32(data); v != exrMagic {
+		return nil, &FormatError{Field: "exr.Magic", Got: v, Want: exrMagic, Err: ErrFormat}
+	}
+	version := binary.LittleEndian.Uint32(data[4:])
+	if version&0xFF != exrVersion {
+		return nil, errUnsupported("exr.Version", version&0xFF)
+	}
+	if version&(exrFlag_Tiled|exrFlag_NonImage|exrFlag_MultiPart) != 0 {
+		return nil, errUnsupported("exr.Version", fmt.Sprintf("flags = %#x", version&^0xFF))
+	}
+
+	var channels []exrChannel
+	var window []int
+	compression := -1
+	p := data[8:]
+	for {
+		var name, typ string
+		if name, p, err = exrReadString(p); err != nil {
+			return nil, err
+		}
+		if name == "" {
+			break
+		}
+		if typ, p, err = exrReadString(p); err != nil {
+			return nil, err
+		}
+		if len(p) < 4 || int64(binary.LittleEndian.Uint32(p)) > int64(len(p)-4) {
+			return nil, &FormatError{Field: "exr." + name, Err: ErrTruncated}
+		}
+		value := p[4:][:binary.LittleEndian.Uint32(p)]
+		p = p[4+len(value):]
+
+		switch {
+		case name == "channels" && typ == "chlist":
+			if channels, err = exrReadChannels(value); err != nil {
+				return nil, err
+			}
+		case name == "compression" && typ == "compression" && len(value) == 1:
+			compression = int(value[0])
+		case name == "dataWindow" && typ == "box2i" && len(value) == 16:
+			for i := 0; i < 4; i++ {
+				window = append(window, int(int32(binary.LittleEndian.Uint32(value[4*i:]))))
+			}
+		}
+	}
+	if len(channels) == 0 || window == nil || compression < 0 {
+		return nil, errFormat("exr.Header", "missing channels, compression or dataWindow")
+	}
+
+	linesPerBlock := 1
+	switch compression {
+	case exrCompression_None, exrCompression_ZIPS:
+	case exrCompression_ZIP:
+		linesPerBlock = 16
+	default:
+		return nil, errUnsupported("exr.compression", compression)
+	}
+
+	if w, h := int64(window[2])-int64(window[0])+1, int64(window[3])-int64(window[1])+1; w <= 0 || h <= 0 || w > math.MaxInt32 || h > math.MaxInt32 {
+		return nil, errFormat("exr.dataWindow", fmt.Sprint(window))
+	}
+	bounds := image.Rect(window[0], window[1], window[2]+1, window[3]+1)
+	width, height := bounds.Dx(), bounds.Dy()
+	size := SizeofPixel(len(channels), reflect.Float32)
+	for _, n := range []int{width, height} {
+		if size > maxInt/n {
+			return nil, &FormatError{Field: "exr.dataWindow", Got: fmt.Sprint(window), Err: ErrTooLarge}
+		}
+		size *= n
+	}
+	if size/2/maxDeflateRatio > len(data) {
+		return nil, &FormatError{Field: "exr.dataWindow", Got: fmt.Sprint(window), Err: ErrTooLarge}
+	}
+
+	lineSize := 0
+	for _, c := range channels {
+		lineSize += width * exrSampleSize(c.PixelType)
+	}
+	numBlocks := (height + linesPerBlock - 1) / linesPerBlock
+	if len(p)/8 < numBlocks {
+		return nil, &FormatError{Field: "exr.Offsets", Got: len(p) / 8, Want: numBlocks, Err: ErrTruncated}
+	}
+	names := make([]string, len(channels))
+	for i, c := range channels {
+		names[i] = c.Name
+	}
+	index := exrChannelIndex(names)
+
+	m = &MemPImage{
+		XMemPMagic: MemPMagic,
+		XRect:      bounds,
+		XStride:    width * SizeofPixel(len(channels), reflect.Float32),
+		XChannels:  len(channels),
+		XDataType:  reflect.Float32,
+		XPix:       make([]byte, size),
+	}
+	pix := m.XPix.Float32s()
+	for i := 0; i < numBlocks; i++ {
+		offset := binary.LittleEndian.Uint64(p[8*i:])
+		if offset > uint64(len(data)) || uint64(len(data))-offset < 8 {
+			return nil, &FormatError{Field: "exr.Offsets", Got: offset, Want: len(data), Err: ErrTruncated}
+		}
+		block := data[offset:]
+		y := int(int32(binary.LittleEndian.Uint32(block)))
+		n := int64(binary.LittleEndian.Uint32(block[4:]))
+		if y < window[1] || y > window[3] || (y-window[1])%linesPerBlock != 0 {
+			return nil, errFormat("exr.Block.Y", y)
+		}
+		if n > int64(len(block)-8) {
+			return nil, &FormatError{Field: "exr.Block.Size", Got: n, Want: len(block) - 8, Err: ErrTruncated}
+		}
+		lines := linesPerBlock
+		if y+lines > window[3]+1 {
+			lines = window[3] + 1 - y
+		}
+
+		raw := block[8:][:n]
+		if want := lines * lineSize; len(raw) != want {
+			if compression == exrCompression_None {
+				return nil, &FormatError{Field: "exr.Block.Size", Got: len(raw), Want: want, Err: ErrFormat}
+			}
+			if raw, err = exrUnzip(raw, want); err != nil {
+				return nil, &FormatError{Field: "exr.Block", Got: err.Error(), Err: ErrFormat}
+			}
+		}
+
+		for line := 0; line < lines; line++ {
+			dst := pix[(y-window[1]+line)*width*len(channels):]
+			for ch, c := range channels {
+				for x := 0; x < width; x++ {
+					var f float32
+					if c.PixelType == exrPixelType_Half {
+						f = HalfToFloat32(binary.LittleEndian.Uint16(raw))
+						raw = raw[2:]
+					} else {
+						f = math.Float32frombits(binary.LittleEndian.Uint32(raw))
+						raw = raw[4:]
+					}
+					dst[x*len(channels)+index[ch]] = f
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// exrReadString reads a string ending with a zero byte from p.
+func exrReadString(p []byte) (s string, rest []byte, err error) {
+	i := bytes.IndexByte(p, 0)
+	if i < 0 {
+		return "", nil, &FormatError{Field: "exr.Header", Err: ErrTruncated}
+	}
+	if i > exrMaxName {
+		return "", nil, errFormat("exr.Header", fmt.Sprintf("name of %d bytes", i))
+	}
+	return string(p[:i]), p[i+1:], nil
+}
+
+func exrReadChannels(p []byte) (channels []exrChannel, err error) {
+	for {
+		var name string
+		if name, p, err = exrReadString(p); err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return channels, nil
+		}
+		if len(p) < 16 {
+			return nil, &FormatError{Field: "exr.channels", Err: ErrTruncated}
+		}
+		c := exrChannel{Name: name, PixelType: int(binary.LittleEndian.Uint32(p))}
+		if c.PixelType != exrPixelType_Half && c.PixelType != exrPixelType_Float {
+			return nil, errUnsupported("exr.channels", fmt.Sprintf("%s: pixel type %d", name, c.PixelType))
+		}
+		if xs, ys := binary.LittleEndian.Uint32(p[8:]), binary.LittleEndian.Uint32(p[12:]); xs != 1 || ys != 1 {
+			return nil, errUnsupported("exr.channels", fmt.Sprintf("%s: sampling %dx%d", name, xs, ys))
+		}
+		channels = append(channels, c)
+		p = p[16:]
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeAndDecodeEXR(t *testing.T) {
+	for channels := 1; channels <= 4; channels++ {
+		m0 := NewMemPImage(image.Rect(-3, 5, 20, 43), channels, reflect.Float32)
+		for i, v := range m0.XPix.Float32s() {
+			// exact in half precision
+			v = float32(i%2048) / 64
+			if i%3 == 0 {
+				v = -v
+			}
+			m0.XPix.Float32s()[i] = v
+		}
+		sub := m0.SubImage(image.Rect(-2, 6, 19, 42)).(*MemPImage)
+
+		for _, opt := range []*EXROptions{nil, {UseZip: true}, {Half: true}, {UseZip: true, Half: true}} {
+			var buf bytes.Buffer
+			if err := EncodeEXR(&buf, sub, opt); err != nil {
+				t.Fatalf("%d channels, %+v: %v", channels, opt, err)
+			}
+			m1, err := DecodeEXR(&buf)
+			if err != nil {
+				t.Fatalf("%d channels, %+v: %v", channels, opt, err)
+			}
+			if m1.Bounds() != sub.Bounds() {
+				t.Fatalf("%d channels, %+v: bounds = %v", channels, opt, m1.Bounds())
+			}
+			tCheckPixels(t, m1, sub)
+
+			// through RawP, for the channels it supports
+			if channels == 2 {
+				continue
+			}
+			buf.Reset()
+			if err := Encode(&buf, m1, nil); err != nil {
+				t.Fatal(err)
+			}
+			m2, err := DecodeImage(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf.Reset()
+			if err := EncodeEXR(&buf, m2, opt); err != nil {
+				t.Fatal(err)
+			}
+			if m1, err = DecodeEXR(&buf); err != nil {
+				t.Fatal(err)
+			}
+			tCheckPixels(t, m1, sub)
+		}
+	}
+}
+
+// tEXRGray is a 2x1 gray FLOAT image with values 1 and -2 at (10, 20),
+// following the OpenEXR file layout.
+const tEXRGray = "\x76\x2f\x31\x01" + "\x02\x00\x00\x00" +
+	"channels\x00chlist\x00\x13\x00\x00\x00" +
+	"Y\x00\x02\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x01\x00\x00\x00\x00" +
+	"compression\x00compression\x00\x01\x00\x00\x00\x00" +
+	"dataWindow\x00box2i\x00\x10\x00\x00\x00" +
+	"\x0a\x00\x00\x00\x14\x00\x00\x00\x0b\x00\x00\x00\x14\x00\x00\x00" +
+	"displayWindow\x00box2i\x00\x10\x00\x00\x00" +
+	"\x0a\x00\x00\x00\x14\x00\x00\x00\x0b\x00\x00\x00\x14\x00\x00\x00" +
+	"lineOrder\x00lineOrder\x00\x01\x00\x00\x00\x00" +
+	"pixelAspectRatio\x00float\x00\x04\x00\x00\x00\x00\x00\x80\x3f" +
+	"screenWindowCenter\x00v2f\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" +
+	"screenWindowWidth\x00float\x00\x04\x00\x00\x00\x00\x00\x80\x3f" +
+	"\x00" +
+	"\x1d\x01\x00\x00\x00\x00\x00\x00" + // offset of the block
+	"\x14\x00\x00\x00\x08\x00\x00\x00" + "\x00\x00\x80\x3f\x00\x00\x00\xc0"
+
+func TestEncodeEXR_layout(t *testing.T) {
+	m := NewMemPImage(image.Rect(10, 20, 12, 21), 1, reflect.Float32)
+	copy(m.XPix.Float32s(), []float32{1, -2})
+
+	var buf bytes.Buffer
+	if err := EncodeEXR(&buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != tEXRGray {
+		t.Fatalf("expect = %q\ngot    = %q", tEXRGray, got)
+	}
+}
+
+func TestDecodeEXR_errors(t *testing.T) {
+	tests := []struct {
+		data   string
+		expect error
+	}{
+		{tEXRGray[:6], ErrTruncated},
+		{"\x76\x2f\x31\x02" + tEXRGray[4:], ErrFormat},
+		{tEXRGray[:4] + "\x02\x02\x00\x00" + tEXRGray[8:], ErrUnsupported}, // tiled
+		{tEXRGray[:len(tEXRGray)-1], ErrTruncated},
+		{tEXRGray[:len(tEXRGray)-20], ErrTruncated},
+		{tEXRGray[:len(tEXRGray)-16] + "\x14\x00\x00\x00\x07\x00\x00\x00" + tEXRGray[len(tEXRGray)-8:], ErrFormat},
+		{tEXRGray[:len(tEXRGray)-16] + "\x15\x00\x00\x00" + tEXRGray[len(tEXRGray)-12:], ErrFormat},
+	}
+	for i, v := range tests {
+		if _, err := DecodeEXR(bytes.NewReader([]byte(v.data))); !errors.Is(err, v.expect) {
+			t.Fatalf("%d: expect = %v, got = %v", i, v.expect, err)
+		}
+	}
+
+	m := NewMemPImage(image.Rect(0, 0, 1, 1), 3, reflect.Uint16)
+	if err := EncodeEXR(new(bytes.Buffer), m, nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("EncodeEXR: expect = %v, got = %v", ErrUnsupported, err)
+	}
+}
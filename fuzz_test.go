@@ -0,0 +1,258 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fuzzOptions keeps the fuzzer away from huge (valid) images.
+var fuzzOptions = &DecodeOptions{MaxPixels: 1 << 16, MaxBytes: 1 << 20}
+
+// fuzzAddSeeds adds small images of every kind and compression.
+func fuzzAddSeeds(f *testing.F) {
+	kinds := []reflect.Kind{
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, Float16, BFloat16, reflect.Float32, reflect.Float64, reflect.Complex64,
+	}
+	opts := []*Options{
+		nil,
+		{UseSnappy: true},
+		{UseSnappy: true, BlockSize: 16},
+	}
+	for _, kind := range kinds {
+		for _, channels := range []int{1, 3, 4} {
+			m := NewMemPImage(image.Rect(0, 0, 7, 5), channels, kind)
+			for i := range m.XPix {
+				m.XPix[i] = byte(i * 7)
+			}
+			for _, opt := range opts {
+				var buf bytes.Buffer
+				if err := Encode(&buf, m, opt); err != nil {
+					f.Fatal(err)
+				}
+				f.Add(buf.Bytes())
+			}
+		}
+	}
+	for _, packing := range []Packing{PackingMSB, PackingMIPI} {
+		m := NewMemPImage(image.Rect(0, 0, 7, 5), 3, reflect.Uint16)
+		m.XDepth, m.XPacking = 10, packing
+		for _, opt := range opts {
+			var buf bytes.Buffer
+			if err := Encode(&buf, m, opt); err != nil {
+				f.Fatal(err)
+			}
+			f.Add(buf.Bytes())
+		}
+	}
+	for _, opt := range opts {
+		var buf bytes.Buffer
+		if err := Encode(&buf, NewMemPImage(image.Rect(-3, 100, 4, 105), 3, reflect.Uint8), opt); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	raw := NewMemPImage(image.Rect(1, 0, 8, 5), 1, reflect.Uint16)
+	raw.XCFA = CFA{Pattern: CFARGGB, BlackLevel: 64, WhiteLevel: 1023}
+	raw.XDepth = 10
+	var buf bytes.Buffer
+	if err := Encode(&buf, raw, nil); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	lab := NewMemPImage(image.Rect(0, 0, 3, 2), 3, reflect.Float32)
+	lab.XColorSpace = ColorSpaceLab
+	buf.Reset()
+	if err := Encode(&buf, lab, nil); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	for _, layout := range []YUVLayout{YUVI420, YUVNV12, YUVI422} {
+		buf.Reset()
+		if err := Encode(&buf, NewYUVImage(image.Rect(-2, 2, 5, 7), layout), nil); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte("RAWP"))
+	f.Add([]byte{})
+}
+
+func FuzzDecode(f *testing.F) {
+	fuzzAddSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := DecodeWithOptions(bytes.NewReader(data), fuzzOptions)
+		if err != nil {
+			return
+		}
+		b := m.Bounds()
+		if b.Dx()*b.Dy() > fuzzOptions.MaxPixels {
+			t.Fatalf("bounds = %v, over MaxPixels", b)
+		}
+		m.At(b.Min.X, b.Min.Y)
+		m.At(b.Max.X-1, b.Max.Y-1)
+	})
+}
+
+func FuzzDecodeConfig(f *testing.F) {
+	fuzzAddSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cfg, err := DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if cfg.Width <= 0 || cfg.Height <= 0 || cfg.ColorModel == nil {
+			t.Fatalf("bad config: %+v", cfg)
+		}
+	})
+}
+
+func FuzzDecodeImage(f *testing.F) {
+	fuzzAddSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := DecodeImageWithOptions(bytes.NewReader(data), fuzzOptions)
+		if err != nil {
+			return
+		}
+		if err := m.Validate(); err != nil {
+			t.Fatalf("decoded image is invalid: %v", err)
+		}
+
+		// a decoded image must survive a round trip, if the encoder
+		// supports it (the decoder accepts any channels)
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, nil); err != nil {
+			if errors.Is(err, ErrUnsupported) {
+				return
+			}
+			t.Fatal(err)
+		}
+		m1, err := DecodeImage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m1.XRect != m.XRect || m1.XChannels != m.XChannels || m1.XDataType != m.XDataType || !bytes.Equal(m1.XPix, m.XPix) {
+			t.Fatalf("round trip mismatch")
+		}
+	})
+}
+
+func FuzzDecodePNM(f *testing.F) {
+	for _, s := range []string{
+		"P5\n2 1\n255\n\x01\x02",
+		"P6 # rgb\n1 1\n65535\n\x00\x01\x00\x02\x00\x03",
+		"P7\nWIDTH 1\nHEIGHT 1\nDEPTH 2\nMAXVAL 15\nTUPLTYPE GRAYSCALE_ALPHA\nENDHDR\n\x0F\x05",
+		"Pf\n1 2\n-1.0\n\x00\x00\x80\x3F\x00\x00\x00\x40",
+	} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := DecodePNM(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if err := m.Validate(); err != nil {
+			t.Fatalf("decoded image is invalid: %v", err)
+		}
+		var buf bytes.Buffer
+		if err := EncodePNM(&buf, m); err != nil {
+			t.Fatal(err)
+		}
+		m1, err := DecodePNM(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m1.Bounds() != m.Bounds() || !bytes.Equal(m1.XPix, m.XPix) {
+			t.Fatalf("round trip changed the image")
+		}
+	})
+}
+
+func FuzzDecodeTIFF(f *testing.F) {
+	m := NewMemPImage(image.Rect(0, 0, 3, 5), 3, reflect.Uint16)
+	for i := range m.XPix {
+		m.XPix[i] = byte(i)
+	}
+	for _, opt := range []*TIFFOptions{nil, {UseDeflate: true, RowsPerStrip: 2}} {
+		var buf bytes.Buffer
+		if err := EncodeTIFF(&buf, m, opt); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := DecodeTIFF(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if err := m.Validate(); err != nil {
+			t.Fatalf("decoded image is invalid: %v", err)
+		}
+	})
+}
+
+func FuzzDecodeEXR(f *testing.F) {
+	m := NewMemPImage(image.Rect(-1, 2, 4, 20), 4, reflect.Float32)
+	for i := range m.XPix {
+		m.XPix[i] = byte(i)
+	}
+	for _, opt := range []*EXROptions{nil, {UseZip: true, Half: true}} {
+		var buf bytes.Buffer
+		if err := EncodeEXR(&buf, m, opt); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := DecodeEXR(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if err := m.Validate(); err != nil {
+			t.Fatalf("decoded image is invalid: %v", err)
+		}
+	})
+}
+
+func FuzzSequence(f *testing.F) {
+	var buf bytes.Buffer
+	s, err := NewSequenceWriter(&buf, &Options{UseSnappy: true})
+	if err != nil {
+		f.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		m := NewMemPImage(image.Rect(0, 0, 5, 3), 1, reflect.Uint8)
+		if err := s.WriteFrame(m, time.Unix(int64(i), 0)); err != nil {
+			f.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add(buf.Bytes()[:buf.Len()-10])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s, err := NewSequenceReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		s.Options = fuzzOptions
+		for i := 1; i < s.Len(); i++ {
+			if s.Time(i).Before(s.Time(i - 1)) {
+				t.Fatalf("frame %d: time goes back", i)
+			}
+		}
+		for {
+			if _, _, err := s.Next(); err != nil {
+				break
+			}
+		}
+	})
+}
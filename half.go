@@ -0,0 +1,132 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"math"
+	"reflect"
+)
+
+// Kinds of half precision floats, which reflect does not have. Their
+// samples are uint16 bit patterns, see the Float16s and BFloat16s methods
+// of PixSlice.
+const (
+	Float16  reflect.Kind = 64 + iota // IEEE 754 binary16
+	BFloat16                          // bfloat16, the upper half of a float32
+)
+
+// KindString returns the name of kind, like kind.String, with the names
+// float16 and bfloat16 for Float16 and BFloat16.
+func KindString(kind reflect.Kind) string {
+	switch kind {
+	case Float16:
+		return "float16"
+	case BFloat16:
+		return "bfloat16"
+	}
+	return kind.String()
+}
+
+// Float32ToHalf converts f to an IEEE 754 half precision float, rounding
+// to nearest even. Values out of range become infinities or zeros.
+func Float32ToHalf(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int(b>>23&0xFF) - 127 + 15
+	man := b & 0x7FFFFF
+
+	switch {
+	case b>>23&0xFF == 0xFF: // Inf or NaN
+		if man != 0 {
+			return sign | 0x7E00
+		}
+		return sign | 0x7C00
+	case exp >= 0x1F: // overflow
+		return sign | 0x7C00
+	case exp <= 0: // subnormal or zero
+		if exp < -10 {
+			return sign
+		}
+		man |= 0x800000
+		shift := uint(14 - exp)
+		h := man >> shift
+		rem, half := man&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > half || (rem == half && h&1 == 1) {
+			h++
+		}
+		return sign | uint16(h)
+	}
+
+	h := uint32(exp)<<10 | man>>13
+	if rem := man & 0x1FFF; rem > 0x1000 || (rem == 0x1000 && h&1 == 1) {
+		h++ // may carry into the exponent, up to Inf
+	}
+	return sign | uint16(h)
+}
+
+// HalfToFloat32 converts the IEEE 754 half precision float h to float32.
+// The conversion is exact.
+func HalfToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1F
+	man := uint32(h & 0x3FF)
+
+	switch exp {
+	case 0x1F: // Inf or NaN
+		return math.Float32frombits(sign | 0x7F800000 | man<<13)
+	case 0:
+		if man == 0 {
+			return math.Float32frombits(sign)
+		}
+		// subnormal, normalize it
+		exp = 127 - 15 + 1
+		for man&0x400 == 0 {
+			man <<= 1
+			exp--
+		}
+		return math.Float32frombits(sign | exp<<23 | (man&0x3FF)<<13)
+	}
+	return math.Float32frombits(sign | (exp+127-15)<<23 | man<<13)
+}
+
+// Float32ToHalf converts the float32 samples of d to half floats, returned
+// as uint16 samples in native byte order.
+func (d PixSlice) Float32ToHalf() PixSlice {
+	src := d.Float32s()
+	dst := make(PixSlice, len(src)*2)
+	v := dst.Uint16s()
+	for i, f := range src {
+		v[i] = Float32ToHalf(f)
+	}
+	return dst
+}
+
+// HalfToFloat32 converts the half float samples of d, uint16 in native
+// byte order, to float32 samples.
+func (d PixSlice) HalfToFloat32() PixSlice {
+	src := d.Uint16s()
+	dst := make(PixSlice, len(src)*4)
+	v := dst.Float32s()
+	for i, h := range src {
+		v[i] = HalfToFloat32(h)
+	}
+	return dst
+}
+
+// Float32ToBFloat16 converts f to bfloat16, rounding to nearest even.
+func Float32ToBFloat16(f float32) uint16 {
+	b := math.Float32bits(f)
+	if b&0x7FFFFFFF > 0x7F800000 { // NaN, keep it quiet
+		return uint16(b>>16) | 0x40
+	}
+	b += 0x7FFF + (b>>16)&1
+	return uint16(b >> 16)
+}
+
+// BFloat16ToFloat32 converts the bfloat16 h to float32. The conversion is
+// exact.
+func BFloat16ToFloat32(h uint16) float32 {
+	return math.Float32frombits(uint32(h) << 16)
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFloat32ToHalf(t *testing.T) {
+	tests := []struct {
+		f float32
+		h uint16
+	}{
+		{0, 0x0000},
+		{float32(math.Copysign(0, -1)), 0x8000},
+		{1, 0x3C00},
+		{-2, 0xC000},
+		{0.5, 0x3800},
+		{65504, 0x7BFF},                          // max half
+		{65520, 0x7C00},                          // rounds to Inf
+		{1e10, 0x7C00},                           // overflow
+		{float32(math.Inf(-1)), 0xFC00},          // -Inf
+		{6.103515625e-05, 0x0400},                // min normal
+		{5.960464477539063e-08, 0x0001},          // min subnormal
+		{2.9802322387695312e-08, 0x0000},         // half of it, rounds to even
+		{4.470348358154297e-08, 0x0001},          // 0.75 of it, rounds up
+		{1 + 1.0/2048, 0x3C00},                   // tie, rounds to even
+		{1 + 3.0/2048, 0x3C02},                   // tie, rounds to even
+		{1e-10, 0x0000},                          // underflow
+		{0.333251953125, 0x3555},                 // exact
+		{float32(6.097555160522461e-05), 0x03FF}, // max subnormal
+	}
+	for _, v := range tests {
+		if h := Float32ToHalf(v.f); h != v.h {
+			t.Fatalf("Float32ToHalf(%g): expect = %#04x, got = %#04x", v.f, v.h, h)
+		}
+	}
+	if h := Float32ToHalf(float32(math.NaN())); h&0x7C00 != 0x7C00 || h&0x3FF == 0 {
+		t.Fatalf("Float32ToHalf(NaN) = %#04x", h)
+	}
+}
+
+func TestHalfToFloat32(t *testing.T) {
+	// every half but NaNs converts back to itself
+	for i := 0; i < 1<<16; i++ {
+		h := uint16(i)
+		f := HalfToFloat32(h)
+		if h&0x7C00 == 0x7C00 && h&0x3FF != 0 {
+			if !math.IsNaN(float64(f)) {
+				t.Fatalf("HalfToFloat32(%#04x) = %g, expect NaN", h, f)
+			}
+			continue
+		}
+		if h1 := Float32ToHalf(f); h1 != h {
+			t.Fatalf("HalfToFloat32(%#04x) = %g, converts back to %#04x", h, f, h1)
+		}
+	}
+
+	p := PixSlice(nil)
+	for _, f := range []float32{1, -0.5, 3.140625} {
+		p = append(p, AsPixSlice([]float32{f})...)
+	}
+	h := p.Float32ToHalf()
+	if v := h.Uint16s(); len(v) != 3 || v[0] != 0x3C00 || v[1] != 0xB800 {
+		t.Fatalf("PixSlice.Float32ToHalf: got = %#04x", v)
+	}
+	if v := h.HalfToFloat32().Float32s(); len(v) != 3 || v[0] != 1 || v[1] != -0.5 || v[2] != 3.140625 {
+		t.Fatalf("PixSlice.HalfToFloat32: got = %v", v)
+	}
+}
+
+func TestFloat32ToBFloat16(t *testing.T) {
+	tests := []struct {
+		f float32
+		h uint16
+	}{
+		{0, 0x0000},
+		{1, 0x3F80},
+		{-2, 0xC000},
+		{math.Float32frombits(0x3F808000), 0x3F80}, // tie, rounds to even
+		{math.Float32frombits(0x3F818000), 0x3F82}, // tie, rounds to even
+		{math.Float32frombits(0x3F808001), 0x3F81},
+		{math.MaxFloat32, 0x7F80}, // rounds to Inf
+		{float32(math.Inf(-1)), 0xFF80},
+	}
+	for _, v := range tests {
+		if h := Float32ToBFloat16(v.f); h != v.h {
+			t.Fatalf("Float32ToBFloat16(%g): expect = %#04x, got = %#04x", v.f, v.h, h)
+		}
+		if h := Float32ToBFloat16(BFloat16ToFloat32(v.h)); h != v.h {
+			t.Fatalf("BFloat16ToFloat32(%#04x) converts back to %#04x", v.h, h)
+		}
+	}
+	if h := Float32ToBFloat16(math.Float32frombits(0x7F800001)); h&0x7F80 != 0x7F80 || h&0x7F == 0 {
+		t.Fatalf("Float32ToBFloat16(NaN) = %#04x", h)
+	}
+}
+
+func TestPixSlice_half(t *testing.T) {
+	for _, kind := range []reflect.Kind{Float16, BFloat16} {
+		if SizeofKind(kind) != 2 {
+			t.Fatalf("SizeofKind(%s) = %d", KindString(kind), SizeofKind(kind))
+		}
+		p := make(PixSlice, 3*2)
+		for i, v := range []float64{1.5, -0.25, 100} {
+			p.SetValue(i, kind, v)
+		}
+		for i, v := range []float64{1.5, -0.25, 100} {
+			if x := p.Value(i, kind); x != v {
+				t.Fatalf("%s: Value(%d) = %v, expect %v", KindString(kind), i, x, v)
+			}
+		}
+	}
+	p := make(PixSlice, 2)
+	p.SetValue(0, Float16, 1)
+	if p.Float16s()[0] != 0x3C00 {
+		t.Fatalf("Float16s()[0] = %#04x", p.Float16s()[0])
+	}
+	p.SetValue(0, BFloat16, 1)
+	if p.BFloat16s()[0] != 0x3F80 {
+		t.Fatalf("BFloat16s()[0] = %#04x", p.BFloat16s()[0])
+	}
+}
+
+func TestKindString_errors(t *testing.T) {
+	m := NewMemPImage(image.Rect(0, 0, 2, 2), 1, BFloat16)
+	err := EncodePNM(new(bytes.Buffer), m)
+	if !errors.Is(err, ErrUnsupported) || !strings.Contains(err.Error(), "bfloat16") {
+		t.Fatalf("EncodePNM: got %v", err)
+	}
+}
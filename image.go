@@ -48,20 +48,116 @@ type MemPImage struct {
 	XDataType  reflect.Kind
 	XPix       PixSlice
 	XStride    int
+
+	XColorSpace ColorSpace // optional, see ConvertColorSpace
+
+	// XDepth, if not 0, is the bits per sample of Uint8 (1, 2, 4) or
+	// Uint16 (10, 12) images stored with packed depths, see Packing.
+	// Encode fails if a sample does not fit in XDepth bits.
+	XDepth   int
+	XPacking Packing
+
+	XCFA CFA // optional, color filter array of raw sensor data, see Demosaic
 }
 
+// NewMemPImage returns a new image with the given bounds, channels and
+// data type. Bad arguments give an image without pixels, which fails
+// Validate.
 func NewMemPImage(r image.Rectangle, channels int, dataType reflect.Kind) *MemPImage {
 	m := &MemPImage{
 		XMemPMagic: MemPMagic,
 		XRect:      r,
-		XStride:    r.Dx() * channels * SizeofKind(dataType),
 		XChannels:  channels,
 		XDataType:  dataType,
 	}
+	if r.Empty() || channels <= 0 || SizeofKind(dataType) == 0 {
+		return m
+	}
+	m.XStride = r.Dx() * channels * SizeofKind(dataType)
 	m.XPix = make([]byte, r.Dy()*m.XStride)
 	return m
 }
 
+// NewMemPImageAligned is like NewMemPImage, but the rows (XStride) and the
+// first pixel (&XPix[0]) are aligned to align bytes. align must be a power
+// of two, 0 and 1 mean no alignment.
+func NewMemPImageAligned(r image.Rectangle, channels int, dataType reflect.Kind, align int) (*MemPImage, error) {
+	if align > 1 && !isPowerOfTwo(align) {
+		return nil, errUnsupported("Align", align)
+	}
+	if align <= 1 {
+		return NewMemPImage(r, channels, dataType), nil
+	}
+	m := &MemPImage{
+		XMemPMagic: MemPMagic,
+		XRect:      r,
+		XChannels:  channels,
+		XDataType:  dataType,
+	}
+	if r.Empty() || channels <= 0 || SizeofKind(dataType) == 0 {
+		return m, nil
+	}
+	m.XStride = alignedStride(r.Dx()*channels*SizeofKind(dataType), SizeofKind(dataType), align)
+	m.XPix = alignedBytes(nil, r.Dy()*m.XStride, align)
+	return m, nil
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// alignedStride rounds rowSize up to a multiple of align and size.
+func alignedStride(rowSize, size, align int) int {
+	if align < size {
+		align = size
+	}
+	return (rowSize + align - 1) &^ (align - 1)
+}
+
+// alignedBytes returns n bytes starting at an address aligned to align,
+// buf if it has enough capacity and is aligned.
+func alignedBytes(buf []byte, n, align int) []byte {
+	if cap(buf) >= n && n > 0 && uintptr(unsafe.Pointer(&buf[:1][0]))&uintptr(align-1) == 0 {
+		return buf[:n]
+	}
+	buf = make([]byte, n+align-1)
+	off := 0
+	if m := int(uintptr(unsafe.Pointer(&buf[0])) & uintptr(align-1)); m != 0 {
+		off = align - m
+	}
+	return buf[off:][:n:n]
+}
+
+// Validate reports whether the fields of p describe a usable image:
+// a known data type, positive channels, and a stride and pixel buffer
+// large enough for p.XRect.
+func (p *MemPImage) Validate() error {
+	if p == nil {
+		return errFormat("MemPImage", nil)
+	}
+	if p.XChannels <= 0 {
+		return errFormat("XChannels", p.XChannels)
+	}
+	size := SizeofKind(p.XDataType)
+	if size == 0 {
+		return errUnsupported("XDataType", KindString(p.XDataType))
+	}
+	if p.XRect.Min.X > p.XRect.Max.X || p.XRect.Min.Y > p.XRect.Max.Y {
+		return errFormat("XRect", p.XRect)
+	}
+	if p.XRect.Empty() {
+		return nil
+	}
+	rowSize := p.XRect.Dx() * SizeofPixel(p.XChannels, p.XDataType)
+	if p.XStride < rowSize || p.XStride%size != 0 {
+		return &FormatError{Field: "XStride", Got: p.XStride, Want: rowSize, Err: ErrFormat}
+	}
+	if n := (p.XRect.Dy()-1)*p.XStride + rowSize; len(p.XPix) < n {
+		return &FormatError{Field: "XPix", Got: len(p.XPix), Want: n, Err: ErrTruncated}
+	}
+	return nil
+}
+
 // m is MemP or image.Image
 func AsMemPImage(m interface{}) (p *MemPImage, ok bool) {
 	if m, ok := m.(*MemPImage); ok {
@@ -114,11 +210,7 @@ func NewMemPImageFrom(m image.Image) *MemPImage {
 		p := NewMemPImage(b, 1, reflect.Uint8)
 
 		for y := b.Min.Y; y < b.Max.Y; y++ {
-			off0 := m.PixOffset(b.Min.X, y)
-			off1 := p.PixOffset(b.Min.X, y)
-			copy(p.XPix[off1:][:p.XStride], m.Pix[off0:][:m.Stride])
-			off0 += m.Stride
-			off1 += p.XStride
+			copy(p.rowPix(y), m.Pix[m.PixOffset(b.Min.X, y):])
 		}
 		return p
 
@@ -127,11 +219,7 @@ func NewMemPImageFrom(m image.Image) *MemPImage {
 		p := NewMemPImage(b, 1, reflect.Uint16)
 
 		for y := b.Min.Y; y < b.Max.Y; y++ {
-			off0 := m.PixOffset(b.Min.X, y)
-			off1 := p.PixOffset(b.Min.X, y)
-			copy(p.XPix[off1:][:p.XStride], m.Pix[off0:][:m.Stride])
-			off0 += m.Stride
-			off1 += p.XStride
+			copy(p.rowPix(y), m.Pix[m.PixOffset(b.Min.X, y):])
 		}
 		if isLittleEndian {
 			p.XPix.SwapEndian(p.XDataType)
@@ -143,11 +231,7 @@ func NewMemPImageFrom(m image.Image) *MemPImage {
 		p := NewMemPImage(b, 4, reflect.Uint8)
 
 		for y := b.Min.Y; y < b.Max.Y; y++ {
-			off0 := m.PixOffset(b.Min.X, y)
-			off1 := p.PixOffset(b.Min.X, y)
-			copy(p.XPix[off1:][:p.XStride], m.Pix[off0:][:m.Stride])
-			off0 += m.Stride
-			off1 += p.XStride
+			copy(p.rowPix(y), m.Pix[m.PixOffset(b.Min.X, y):])
 		}
 		return p
 
@@ -156,11 +240,7 @@ func NewMemPImageFrom(m image.Image) *MemPImage {
 		p := NewMemPImage(b, 4, reflect.Uint16)
 
 		for y := b.Min.Y; y < b.Max.Y; y++ {
-			off0 := m.PixOffset(b.Min.X, y)
-			off1 := p.PixOffset(b.Min.X, y)
-			copy(p.XPix[off1:][:p.XStride], m.Pix[off0:][:m.Stride])
-			off0 += m.Stride
-			off1 += p.XStride
+			copy(p.rowPix(y), m.Pix[m.PixOffset(b.Min.X, y):])
 		}
 		if isLittleEndian {
 			p.XPix.SwapEndian(p.XDataType)
@@ -241,68 +321,87 @@ func (p *MemPImage) ColorModel() color.Model {
 }
 
 func (p *MemPImage) At(x, y int) color.Color {
-	if !(image.Point{x, y}.In(p.XRect)) {
-		return MemPColor{
-			Channels: p.XChannels,
-			DataType: p.XDataType,
-		}
-	}
-	i := p.PixOffset(x, y)
-	n := SizeofPixel(p.XChannels, p.XDataType)
 	return MemPColor{
 		Channels: p.XChannels,
 		DataType: p.XDataType,
-		Pix:      p.XPix[i:][:n],
+		Pix:      p.PixelAt(x, y),
 	}
 }
 
+// PixelAt returns the pixel (x, y), or nil if (x, y) is outside the image
+// or not covered by p.XPix.
 func (p *MemPImage) PixelAt(x, y int) []byte {
 	if !(image.Point{x, y}.In(p.XRect)) {
 		return nil
 	}
 	i := p.PixOffset(x, y)
 	n := SizeofPixel(p.XChannels, p.XDataType)
+	if n <= 0 || i < 0 || i+n > len(p.XPix) {
+		return nil
+	}
 	return p.XPix[i:][:n]
 }
 
 func (p *MemPImage) Set(x, y int, c color.Color) {
-	if !(image.Point{x, y}.In(p.XRect)) {
-		return
+	if pix := p.PixelAt(x, y); pix != nil {
+		v := p.ColorModel().Convert(c).(MemPColor)
+		copy(pix, v.Pix)
 	}
-	i := p.PixOffset(x, y)
-	n := SizeofPixel(p.XChannels, p.XDataType)
-	v := p.ColorModel().Convert(c).(MemPColor)
-	copy(p.XPix[i:][:n], v.Pix)
 }
 
 func (p *MemPImage) SetPixel(x, y int, c []byte) {
-	if !(image.Point{x, y}.In(p.XRect)) {
-		return
+	if pix := p.PixelAt(x, y); pix != nil {
+		copy(pix, c)
 	}
-	i := p.PixOffset(x, y)
-	n := SizeofPixel(p.XChannels, p.XDataType)
-	copy(p.XPix[i:][:n], c)
 }
 
 func (p *MemPImage) PixOffset(x, y int) int {
 	return (y-p.XRect.Min.Y)*p.XStride + (x-p.XRect.Min.X)*SizeofPixel(p.XChannels, p.XDataType)
 }
 
+// readPix copies the rows of p, packed without padding, from the byte
+// offset off into buf and returns buf.
+func (p *MemPImage) readPix(buf []byte, off int) []byte {
+	rowSize := p.XRect.Dx() * SizeofPixel(p.XChannels, p.XDataType)
+	for d := buf; len(d) > 0; {
+		n := copy(d, p.rowPix(p.XRect.Min.Y + off/rowSize)[off%rowSize:])
+		d, off = d[n:], off+n
+	}
+	return buf
+}
+
+// rowPix returns the pixels of row y inside p.XRect.
+func (p *MemPImage) rowPix(y int) PixSlice {
+	i := p.PixOffset(p.XRect.Min.X, y)
+	return p.XPix[i:][:p.XRect.Dx()*SizeofPixel(p.XChannels, p.XDataType)]
+}
+
 func (p *MemPImage) SubImage(r image.Rectangle) image.Image {
 	r = r.Intersect(p.XRect)
 	// If r1 and r2 are Rectangles, r1.Intersect(r2) is not guaranteed to be inside
 	// either r1 or r2 if the intersection is empty. Without explicitly checking for
 	// this, the Pix[i:] expression below can panic.
-	if r.Empty() {
-		return &MemPImage{}
+	if r.Empty() || p.Validate() != nil {
+		return &MemPImage{
+			XMemPMagic: MemPMagic,
+			XChannels:  p.XChannels,
+			XDataType:  p.XDataType,
+		}
 	}
 	i := p.PixOffset(r.Min.X, r.Min.Y)
+	j := p.PixOffset(r.Max.X, r.Max.Y-1)
 	return &MemPImage{
-		XRect:     r,
-		XChannels: p.XChannels,
-		XDataType: p.XDataType,
-		XPix:      p.XPix[i:],
-		XStride:   p.XStride,
+		XMemPMagic: MemPMagic,
+		XRect:      r,
+		XChannels:  p.XChannels,
+		XDataType:  p.XDataType,
+		XPix:       p.XPix[i:j:j],
+		XStride:    p.XStride,
+
+		XColorSpace: p.XColorSpace,
+		XDepth:      p.XDepth,
+		XPacking:    p.XPacking,
+		XCFA:        p.XCFA,
 	}
 }
 
@@ -386,7 +485,7 @@ func DepthOf(m image.Image) int {
 		return SizeofKind(m.XDataType) * 8
 	}
 	if m, ok := m.(MemP); ok {
-		return SizeofKind(m.DataType() * 8)
+		return SizeofKind(m.DataType()) * 8
 	}
 	switch m.(type) {
 	case *image.Gray:
@@ -6,6 +6,8 @@ package rawp
 
 import (
 	"image/color"
+	"math"
+	"math/cmplx"
 	"reflect"
 )
 
@@ -16,9 +18,12 @@ type MemPColor struct {
 }
 
 func (c MemPColor) RGBA() (r, g, b, a uint32) {
-	if len(c.Pix) == 0 {
+	if len(c.Pix) == 0 || len(c.Pix) < SizeofPixel(c.Channels, c.DataType) {
 		return
 	}
+	if k := reflect.Kind(c.DataType); k == reflect.Complex64 || k == reflect.Complex128 {
+		return c.complexRGBA()
+	}
 	switch c.Channels {
 	case 1:
 		switch reflect.Kind(c.DataType) {
@@ -111,6 +116,37 @@ func (c MemPColor) RGBA() (r, g, b, a uint32) {
 	return
 }
 
+// complexRGBA maps complex samples to their magnitudes, clamped to the
+// uint16 range, so FFT and SAR images can be displayed.
+func (c MemPColor) complexRGBA() (r, g, b, a uint32) {
+	var v [4]uint16
+	for i := 0; i < c.Channels && i < len(v); i++ {
+		var z complex128
+		if reflect.Kind(c.DataType) == reflect.Complex64 {
+			z = complex128(c.Pix.Complex64s()[i])
+		} else {
+			z = c.Pix.Complex128s()[i]
+		}
+		switch abs := cmplx.Abs(z); {
+		case abs >= math.MaxUint16:
+			v[i] = math.MaxUint16
+		case abs > 0:
+			v[i] = uint16(abs)
+		}
+	}
+	switch c.Channels {
+	case 1:
+		return color.Gray16{Y: v[0]}.RGBA()
+	case 2:
+		return color.RGBA64{R: v[0], G: v[1], B: 0xFFFF, A: 0xFFFF}.RGBA()
+	case 3:
+		return color.RGBA64{R: v[0], G: v[1], B: v[2], A: 0xFFFF}.RGBA()
+	case 4:
+		return color.RGBA64{R: v[0], G: v[1], B: v[2], A: v[3]}.RGBA()
+	}
+	return
+}
+
 type ColorModelInterface interface {
 	Channels() int
 	DataType() reflect.Kind
@@ -144,6 +180,9 @@ func ColorModel(channels int, dataType reflect.Kind) color.Model {
 }
 
 func colorModelConvert(channels int, dataType reflect.Kind, c color.Color) color.Color {
+	if channels < 0 || SizeofKind(dataType) == 0 {
+		return MemPColor{Channels: channels, DataType: dataType}
+	}
 	c2 := MemPColor{
 		Channels: channels,
 		DataType: dataType,
@@ -236,6 +275,8 @@ func SizeofKind(dataType reflect.Kind) int {
 		return 4
 	case reflect.Uint64:
 		return 8
+	case Float16, BFloat16:
+		return 2
 	case reflect.Float32:
 		return 4
 	case reflect.Float64:
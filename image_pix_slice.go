@@ -18,8 +18,13 @@ type PixSlice []byte
 //	x := make([]X, xLen)
 //	y := AsPixSlice(x)
 //
+//
+// AsPixSlice returns nil if slice is not a slice.
 func AsPixSlice(slice interface{}) (d PixSlice) {
 	sv := reflect.ValueOf(slice)
+	if sv.Kind() != reflect.Slice {
+		return nil
+	}
 	h := (*reflect.SliceHeader)((unsafe.Pointer(&d)))
 	h.Cap = sv.Cap() * int(sv.Type().Elem().Size())
 	h.Len = sv.Len() * int(sv.Type().Elem().Size())
@@ -33,7 +38,11 @@ func AsPixSlice(slice interface{}) (d PixSlice) {
 //	x := make([]byte, xLen)
 //	y := PixSlice(x).Slice(reflect.TypeOf([]Y(nil))).([]Y)
 //
+// Slice returns nil if newSliceType is not a slice of sized elements.
 func (d PixSlice) Slice(newSliceType reflect.Type) interface{} {
+	if newSliceType == nil || newSliceType.Kind() != reflect.Slice || newSliceType.Elem().Size() == 0 {
+		return nil
+	}
 	sv := reflect.ValueOf(d)
 	newSlice := reflect.New(newSliceType)
 	hdr := (*reflect.SliceHeader)(unsafe.Pointer(newSlice.Pointer()))
@@ -145,8 +154,8 @@ func (d PixSlice) Complex64s() (v []complex64) {
 	h0 := (*reflect.SliceHeader)(unsafe.Pointer(&d))
 	h1 := (*reflect.SliceHeader)(unsafe.Pointer(&v))
 
-	h1.Cap = h0.Cap / 16
-	h1.Len = h0.Len / 16
+	h1.Cap = h0.Cap / 8
+	h1.Len = h0.Len / 8
 	h1.Data = h0.Data
 	return
 }
@@ -155,13 +164,28 @@ func (d PixSlice) Complex128s() (v []complex128) {
 	h0 := (*reflect.SliceHeader)(unsafe.Pointer(&d))
 	h1 := (*reflect.SliceHeader)(unsafe.Pointer(&v))
 
-	h1.Cap = h0.Cap / 32
-	h1.Len = h0.Len / 32
+	h1.Cap = h0.Cap / 16
+	h1.Len = h0.Len / 16
 	h1.Data = h0.Data
 	return
 }
 
+// Float16s returns the samples of d as the bits of Float16 values.
+func (d PixSlice) Float16s() []uint16 {
+	return d.Uint16s()
+}
+
+// BFloat16s returns the samples of d as the bits of BFloat16 values.
+func (d PixSlice) BFloat16s() []uint16 {
+	return d.Uint16s()
+}
+
+// Value returns the i-th value of type dataType, or 0 if i is out of
+// range or dataType is unknown.
 func (d PixSlice) Value(i int, dataType reflect.Kind) float64 {
+	if !d.inRange(i, dataType) {
+		return 0
+	}
 	switch dataType {
 	case reflect.Int8:
 		return float64(d.Int8s()[i])
@@ -179,6 +203,10 @@ func (d PixSlice) Value(i int, dataType reflect.Kind) float64 {
 		return float64(d.Uint32s()[i])
 	case reflect.Uint64:
 		return float64(d.Uint64s()[i])
+	case Float16:
+		return float64(HalfToFloat32(d.Float16s()[i]))
+	case BFloat16:
+		return float64(BFloat16ToFloat32(d.BFloat16s()[i]))
 	case reflect.Float32:
 		return float64(d.Float32s()[i])
 	case reflect.Float64:
@@ -191,7 +219,12 @@ func (d PixSlice) Value(i int, dataType reflect.Kind) float64 {
 	return 0
 }
 
+// SetValue sets the i-th value of type dataType. It does nothing if i is
+// out of range or dataType is unknown.
 func (d PixSlice) SetValue(i int, dataType reflect.Kind, v float64) {
+	if !d.inRange(i, dataType) {
+		return
+	}
 	switch dataType {
 	case reflect.Int8:
 		d.Int8s()[i] = int8(v)
@@ -209,6 +242,10 @@ func (d PixSlice) SetValue(i int, dataType reflect.Kind, v float64) {
 		d.Uint32s()[i] = uint32(v)
 	case reflect.Uint64:
 		d.Uint64s()[i] = uint64(v)
+	case Float16:
+		d.Float16s()[i] = Float32ToHalf(float32(v))
+	case BFloat16:
+		d.BFloat16s()[i] = Float32ToBFloat16(float32(v))
 	case reflect.Float32:
 		d.Float32s()[i] = float32(v)
 	case reflect.Float64:
@@ -220,9 +257,14 @@ func (d PixSlice) SetValue(i int, dataType reflect.Kind, v float64) {
 	}
 }
 
+func (d PixSlice) inRange(i int, dataType reflect.Kind) bool {
+	n := SizeofKind(dataType)
+	return n > 0 && i >= 0 && i < len(d)/n
+}
+
 func (d PixSlice) SwapEndian(dataType reflect.Kind) {
 	switch dataType {
-	case reflect.Int16, reflect.Uint16:
+	case reflect.Int16, reflect.Uint16, Float16, BFloat16:
 		for i := 0; i+2-1 < len(d); i = i + 2 {
 			d[i+0], d[i+1] = d[i+1], d[i+0]
 		}
@@ -0,0 +1,187 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+func tMalformedImages() map[string]*MemPImage {
+	good := NewMemPImage(image.Rect(0, 0, 4, 4), 3, reflect.Uint16)
+	short := good.Clone()
+	short.XPix = short.XPix[:len(short.XPix)-1]
+	stride := good.Clone()
+	stride.XStride = 5
+	inverted := good.Clone()
+	inverted.XRect = image.Rectangle{Min: image.Pt(4, 4)}
+	return map[string]*MemPImage{
+		"nil":      nil,
+		"channels": NewMemPImage(image.Rect(0, 0, 4, 4), -1, reflect.Uint8),
+		"kind":     NewMemPImage(image.Rect(0, 0, 4, 4), 1, reflect.String),
+		"short":    short,
+		"stride":   stride,
+		"inverted": inverted,
+		"empty":    {XRect: image.Rect(0, 0, 4, 4)},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := NewMemPImage(image.Rect(0, 0, 4, 4), 3, reflect.Float32).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, m := range tMalformedImages() {
+		err := m.Validate()
+		if err == nil {
+			t.Fatalf("%s: expect error", name)
+		}
+		var e *FormatError
+		if !errors.As(err, &e) {
+			t.Fatalf("%s: expect *FormatError, got %T", name, err)
+		}
+		if name == "inverted" && e.Field != "XRect" {
+			t.Fatalf("%s: expect field XRect, got = %v", name, err)
+		}
+	}
+}
+
+func TestMalformedImageErrors(t *testing.T) {
+	good := NewMemPImage(image.Rect(0, 0, 4, 4), 3, reflect.Uint16)
+	for name, m := range tMalformedImages() {
+		if err := Encode(ioutil.Discard, m, nil); err == nil {
+			t.Fatalf("%s: Encode: expect error", name)
+		}
+		if err := Map(m, func(v float64) float64 { return v }); err == nil {
+			t.Fatalf("%s: Map: expect error", name)
+		}
+		if err := Add(good, good, m); err == nil {
+			t.Fatalf("%s: Add: expect error", name)
+		}
+		if _, err := Convolve(m, SobelXKernel(), BorderClamp); err == nil {
+			t.Fatalf("%s: Convolve: expect error", name)
+		}
+		if err := Draw(good, good.Bounds(), m, image.ZP, Over); err == nil {
+			t.Fatalf("%s: Draw: expect error", name)
+		}
+		if err := SRGBToLinear(m); err == nil {
+			t.Fatalf("%s: SRGBToLinear: expect error", name)
+		}
+	}
+	if _, err := Convolve(good, nil, BorderClamp); err == nil {
+		t.Fatal("Convolve: expect nil kernel error")
+	}
+}
+
+func TestMalformedImageNoPanic(t *testing.T) {
+	for name, m := range tMalformedImages() {
+		if m == nil {
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("%s: panic: %v", name, r)
+				}
+			}()
+			for _, pt := range []image.Point{{0, 0}, {3, 3}, {-1, 0}, {9, 9}} {
+				m.At(pt.X, pt.Y).RGBA()
+				m.Set(pt.X, pt.Y, color.White)
+				m.SetPixel(pt.X, pt.Y, []byte{1, 2, 3})
+				if pix := m.PixelAt(pt.X, pt.Y); !pt.In(m.XRect) && pix != nil {
+					t.Fatalf("%s: PixelAt(%v): expect nil, got %v", name, pt, pix)
+				}
+			}
+			if pix := m.PixelAt(3, 3); name == "short" && pix != nil {
+				t.Fatalf("%s: PixelAt(3, 3): expect nil, got %v", name, pix)
+			}
+			if sub := m.SubImage(image.Rect(1, 1, 3, 3)).(*MemPImage); sub.Validate() != nil && !sub.Bounds().Empty() {
+				t.Fatalf("%s: SubImage: bad image %v", name, sub.Bounds())
+			}
+		}()
+	}
+}
+
+func TestPixSliceNoPanic(t *testing.T) {
+	d := PixSlice(make([]byte, 6))
+
+	if v := d.Slice(reflect.TypeOf(0)); v != nil {
+		t.Fatalf("Slice(int): expect nil, got %v", v)
+	}
+	if v := d.Slice(reflect.TypeOf([]struct{}(nil))); v != nil {
+		t.Fatalf("Slice([]struct{}): expect nil, got %v", v)
+	}
+	if v := d.Slice(reflect.TypeOf([]uint16(nil))).([]uint16); len(v) != 3 {
+		t.Fatalf("Slice([]uint16): bad len %d", len(v))
+	}
+	if v := AsPixSlice(42); v != nil {
+		t.Fatalf("AsPixSlice(42): expect nil, got %v", v)
+	}
+
+	for _, kind := range []reflect.Kind{reflect.Invalid, reflect.String, reflect.Uint32, reflect.Complex128} {
+		d.SetValue(7, kind, 1)
+		d.SetValue(-1, kind, 1)
+		if v := d.Value(7, kind); v != 0 {
+			t.Fatalf("%v: Value(7): expect 0, got %v", kind, v)
+		}
+		if v := d.Value(-1, kind); v != 0 {
+			t.Fatalf("%v: Value(-1): expect 0, got %v", kind, v)
+		}
+	}
+
+	c := MemPColor{Channels: 4, DataType: reflect.Uint16, Pix: d[:2]}
+	if r, g, b, a := c.RGBA(); r|g|b|a != 0 {
+		t.Fatalf("short MemPColor: expect zero color")
+	}
+	ColorModel(-1, reflect.Uint8).Convert(color.White)
+}
+
+func TestNewMemPImageAligned(t *testing.T) {
+	for _, align := range []int{0, 1, 16, 64} {
+		for _, kind := range []reflect.Kind{reflect.Uint8, reflect.Uint16, reflect.Float64} {
+			m, err := NewMemPImageAligned(image.Rect(3, 5, 3+13, 5+7), 3, kind, align)
+			if err != nil {
+				t.Fatalf("align = %d, %v: %v", align, kind, err)
+			}
+			if err := m.Validate(); err != nil {
+				t.Fatalf("align = %d, %v: %v", align, kind, err)
+			}
+			if align > 1 {
+				if m.XStride%align != 0 || uintptr(unsafe.Pointer(&m.XPix[0]))%uintptr(align) != 0 {
+					t.Fatalf("align = %d, %v: stride = %d, not aligned", align, kind, m.XStride)
+				}
+			}
+
+			// fill with a pattern, compare with a tight image
+			tight := NewMemPImage(m.Bounds(), 3, kind)
+			for i := range tight.XPix {
+				tight.XPix[i] = byte(i)
+			}
+			if err := Draw(m, m.Bounds(), tight, tight.Bounds().Min, Src); err != nil {
+				t.Fatal(err)
+			}
+			for y := m.XRect.Min.Y; y < m.XRect.Max.Y; y++ {
+				for x := m.XRect.Min.X; x < m.XRect.Max.X; x++ {
+					if !bytes.Equal(m.PixelAt(x, y), tight.PixelAt(x, y)) {
+						t.Fatalf("align = %d, %v: pixel (%d, %d) mismatch", align, kind, x, y)
+					}
+				}
+			}
+			sub := m.SubImage(image.Rect(5, 6, 9, 10)).(*MemPImage)
+			if sub.XStride != m.XStride || !bytes.Equal(sub.PixelAt(8, 9), tight.PixelAt(8, 9)) {
+				t.Fatalf("align = %d, %v: bad SubImage", align, kind)
+			}
+		}
+	}
+
+	if _, err := NewMemPImageAligned(image.Rect(0, 0, 2, 2), 1, reflect.Uint8, 3); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("align = 3: expect = %v, got = %v", ErrUnsupported, err)
+	}
+}
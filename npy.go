@@ -0,0 +1,267 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NumPy .npy format, see numpy/lib/format.py:
+//
+//	Magic      [6]byte // "\x93NUMPY"
+//	Major      byte    // 1, 2 or 3
+//	Minor      byte    // 0
+//	HeaderLen  uint16  // uint32 for versions 2 and 3
+//	Header     [HeaderLen]byte
+//	Data       []byte
+//
+// Header is a Python dict literal, like
+// "{'descr': '<u2', 'fortran_order': False, 'shape': (480, 640, 3), }",
+// padded with spaces and a newline so that Data is aligned to 64 bytes.
+const (
+	npyMagic        = "\x93NUMPY"
+	npyMaxHeaderLen = 1 << 20
+)
+
+var (
+	npyDescrRe   = regexp.MustCompile(`['"]descr['"]\s*:\s*['"]([^'"]*)['"]`)
+	npyFortranRe = regexp.MustCompile(`['"]fortran_order['"]\s*:\s*(True|False)`)
+	npyShapeRe   = regexp.MustCompile(`['"]shape['"]\s*:\s*\(([^)]*)\)`)
+)
+
+// npyKinds maps the type codes of npy descr, without byte order.
+var npyKinds = map[string]reflect.Kind{
+	"u1":  reflect.Uint8,
+	"u2":  reflect.Uint16,
+	"u4":  reflect.Uint32,
+	"u8":  reflect.Uint64,
+	"i1":  reflect.Int8,
+	"i2":  reflect.Int16,
+	"i4":  reflect.Int32,
+	"i8":  reflect.Int64,
+	"f2":  Float16,
+	"f4":  reflect.Float32,
+	"f8":  reflect.Float64,
+	"c8":  reflect.Complex64,
+	"c16": reflect.Complex128,
+}
+
+func npyDescr(dataType reflect.Kind) (string, bool) {
+	for code, kind := range npyKinds {
+		if kind == dataType {
+			switch {
+			case SizeofKind(kind) == 1:
+				return "|" + code, true
+			case isLittleEndian:
+				return "<" + code, true
+			default:
+				return ">" + code, true
+			}
+		}
+	}
+	return "", false
+}
+
+func LoadNpy(name string) (m *MemPImage, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeNpy(bufio.NewReader(f))
+}
+
+func SaveNpy(name string, m *MemPImage) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if err = EncodeNpy(w, m); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// EncodeNpy writes m to w as a NumPy array of shape (H, W, C), with the
+// dtype of m.XDataType in native byte order.
+func EncodeNpy(w io.Writer, m *MemPImage) (err error) {
+	if err = m.Validate(); err != nil {
+		return
+	}
+	descr, ok := npyDescr(m.XDataType)
+	if !ok {
+		return errUnsupported("XDataType", KindString(m.XDataType))
+	}
+
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%d, %d, %d), }",
+		descr, m.XRect.Dy(), m.XRect.Dx(), m.XChannels)
+	// pad with spaces and a newline, to align the data to 64 bytes
+	n := len(npyMagic) + 2 + 2 + len(header) + 1
+	header += strings.Repeat(" ", (64-n%64)%64) + "\n"
+
+	if len(header) > 0xFFFF {
+		return &FormatError{Field: "npy.Header", Got: len(header), Err: ErrTooLarge}
+	}
+	prefix := []byte(npyMagic + "\x01\x00\x00\x00")
+	binary.LittleEndian.PutUint16(prefix[8:], uint16(len(header)))
+	if _, err = w.Write(prefix); err != nil {
+		return
+	}
+	if _, err = io.WriteString(w, header); err != nil {
+		return
+	}
+	for y := m.XRect.Min.Y; y < m.XRect.Max.Y; y++ {
+		if _, err = w.Write(m.rowPix(y)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DecodeNpy reads a NumPy array of shape (H, W) or (H, W, C) from r.
+// Arrays in Fortran order or in the other byte order are converted.
+func DecodeNpy(r io.Reader) (m *MemPImage, err error) {
+	var prefix [10]byte
+	if _, err = io.ReadFull(r, prefix[:]); err != nil {
+		return nil, readError("npy.Magic", err)
+	}
+	if string(prefix[:6]) != npyMagic {
+		return nil, &FormatError{Field: "npy.Magic", Got: fmt.Sprintf("%q", prefix[:6]), Want: fmt.Sprintf("%q", npyMagic), Err: ErrFormat}
+	}
+
+	var headerLen int
+	switch prefix[6] {
+	case 1:
+		headerLen = int(binary.LittleEndian.Uint16(prefix[8:]))
+	case 2, 3:
+		var b [2]byte
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return nil, readError("npy.HeaderLen", err)
+		}
+		headerLen = int(binary.LittleEndian.Uint32(append(prefix[8:10:10], b[:]...)))
+	default:
+		return nil, errUnsupported("npy.Version", fmt.Sprintf("%d.%d", prefix[6], prefix[7]))
+	}
+	if headerLen < 0 || headerLen > npyMaxHeaderLen {
+		return nil, &FormatError{Field: "npy.HeaderLen", Got: headerLen, Want: npyMaxHeaderLen, Err: ErrFormat}
+	}
+	header := make([]byte, headerLen)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, readError("npy.Header", err)
+	}
+
+	kind, swap, fortran, shape, err := npyParseHeader(string(header))
+	if err != nil {
+		return nil, err
+	}
+
+	h, w, c := shape[0], shape[1], 1
+	if len(shape) == 3 {
+		c = shape[2]
+	}
+	size := SizeofKind(kind)
+	for _, n := range shape {
+		if size > maxInt/n {
+			return nil, &FormatError{Field: "npy.shape", Got: fmt.Sprint(shape), Err: ErrTooLarge}
+		}
+		size *= n
+	}
+
+	data, err := readChunks(r, nil, size)
+	if err == io.ErrUnexpectedEOF {
+		return nil, &FormatError{Field: "npy.Data", Got: len(data), Want: size, Err: ErrTruncated}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if swap {
+		PixSlice(data).SwapEndian(kind)
+	}
+
+	m = &MemPImage{
+		XMemPMagic: MemPMagic,
+		XRect:      image.Rect(0, 0, w, h),
+		XStride:    w * c * SizeofKind(kind),
+		XChannels:  c,
+		XDataType:  kind,
+		XPix:       data,
+	}
+	if !fortran {
+		return m, nil
+	}
+
+	// element (y, x, ch) is at y + h*(x + w*ch)
+	m.XPix = make([]byte, len(data))
+	n := SizeofKind(kind)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			for ch := 0; ch < c; ch++ {
+				i := ((y*w+x)*c + ch) * n
+				j := (y + h*(x+w*ch)) * n
+				copy(m.XPix[i:][:n], data[j:][:n])
+			}
+		}
+	}
+	return m, nil
+}
+
+// npyParseHeader parses the dict literal of a npy header.
+func npyParseHeader(header string) (kind reflect.Kind, swap, fortran bool, shape []int, err error) {
+	descr := npyDescrRe.FindStringSubmatch(header)
+	order := npyFortranRe.FindStringSubmatch(header)
+	dims := npyShapeRe.FindStringSubmatch(header)
+	if descr == nil || order == nil || dims == nil {
+		err = errFormat("npy.Header", strconv.Quote(header))
+		return
+	}
+
+	code := descr[1]
+	if code != "" && strings.IndexByte("<>|=", code[0]) >= 0 {
+		switch code[0] {
+		case '<':
+			swap = !isLittleEndian
+		case '>':
+			swap = isLittleEndian
+		}
+		code = code[1:]
+	}
+	var ok bool
+	if kind, ok = npyKinds[code]; !ok {
+		err = errUnsupported("npy.descr", descr[1])
+		return
+	}
+	fortran = order[1] == "True"
+
+	for _, s := range strings.Split(dims[1], ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		n, e := strconv.Atoi(s)
+		if e != nil || n <= 0 {
+			err = errFormat("npy.shape", dims[1])
+			return
+		}
+		shape = append(shape, n)
+	}
+	if len(shape) != 2 && len(shape) != 3 {
+		err = errUnsupported("npy.shape", "("+dims[1]+")")
+	}
+	return
+}
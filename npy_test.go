@@ -0,0 +1,113 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tNpy returns a version 1.0 npy file with the given header dict and data.
+func tNpy(dict string, data []byte) []byte {
+	n := 10 + len(dict) + 1
+	header := dict + strings.Repeat(" ", (64-n%64)%64) + "\n"
+	b := []byte(npyMagic + "\x01\x00\x00\x00")
+	binary.LittleEndian.PutUint16(b[8:], uint16(len(header)))
+	return append(append(b, header...), data...)
+}
+
+func TestEncodeAndDecodeNpy(t *testing.T) {
+	for _, kind := range []reflect.Kind{reflect.Uint8, reflect.Uint16, reflect.Int32, reflect.Float32, reflect.Float64, reflect.Complex64} {
+		m0 := NewMemPImage(image.Rect(0, 0, 5, 3), 3, kind)
+		for i := range m0.XPix {
+			m0.XPix[i] = byte(i * 3)
+		}
+		var buf bytes.Buffer
+		if err := EncodeNpy(&buf, m0.SubImage(image.Rect(1, 1, 4, 3)).(*MemPImage)); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		if i := bytes.IndexByte(data, '\n'); (i+1)%64 != 0 {
+			t.Fatalf("%v: data at %d, not aligned", kind, i+1)
+		}
+		descr, _ := npyDescr(kind)
+		if !bytes.Contains(data, []byte(fmt.Sprintf("'descr': '%s'", descr))) || !bytes.Contains(data, []byte("'shape': (2, 3, 3)")) {
+			t.Fatalf("%v: bad header %q", kind, data[:64])
+		}
+
+		m1, err := DecodeNpy(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 1; y < 3; y++ {
+			for x := 1; x < 4; x++ {
+				if !bytes.Equal(m1.PixelAt(x-1, y-1), m0.PixelAt(x, y)) {
+					t.Fatalf("%v: pixel (%d, %d) mismatch", kind, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeNpy_orders(t *testing.T) {
+	// a 2x3 array of big endian uint16 in Fortran order: [[1, 2, 3], [4, 5, 6]]
+	be := []byte{0, 1, 0, 4, 0, 2, 0, 5, 0, 3, 0, 6}
+	m, err := DecodeNpy(bytes.NewReader(tNpy("{'descr': '>u2', 'fortran_order': True, 'shape': (2, 3), }", be)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Bounds() != image.Rect(0, 0, 3, 2) || m.XChannels != 1 || m.XDataType != reflect.Uint16 {
+		t.Fatalf("bad image: %v, %v, %v", m.Bounds(), m.XChannels, m.XDataType)
+	}
+	if v := m.XPix.Uint16s(); fmt.Sprint(v) != "[1 2 3 4 5 6]" {
+		t.Fatalf("expect = [1 2 3 4 5 6], got = %v", v)
+	}
+
+	// (H, W, C) in Fortran order: element (y, x, c) = 100*y + 10*x + c
+	var f []byte
+	for c := 0; c < 2; c++ {
+		for x := 0; x < 3; x++ {
+			for y := 0; y < 2; y++ {
+				f = append(f, byte(100*y+10*x+c))
+			}
+		}
+	}
+	if m, err = DecodeNpy(bytes.NewReader(tNpy("{'descr': '|u1', 'fortran_order': True, 'shape': (2, 3, 2), }", f))); err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			if p := m.PixelAt(x, y); p[0] != byte(100*y+10*x) || p[1] != byte(100*y+10*x+1) {
+				t.Fatalf("pixel (%d, %d) = %v", x, y, p)
+			}
+		}
+	}
+}
+
+func TestDecodeNpy_errors(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		expect error
+	}{
+		{[]byte("\x93NUMP"), ErrTruncated},
+		{[]byte("\x93NUMPX\x01\x00\x00\x00"), ErrFormat},
+		{tNpy("{'descr': '<U2', 'fortran_order': False, 'shape': (2, 2), }", make([]byte, 16)), ErrUnsupported},
+		{tNpy("{'descr': '<u2', 'fortran_order': False, 'shape': (2,), }", make([]byte, 4)), ErrUnsupported},
+		{tNpy("{'descr': '<u2', 'fortran_order': False, 'shape': (2, 2), }", make([]byte, 7)), ErrTruncated},
+		{tNpy("{'descr': '<u2', 'shape': (2, 2), }", make([]byte, 8)), ErrFormat},
+		{tNpy("{'descr': '<u8', 'fortran_order': False, 'shape': (4294967296, 4294967296, 4294967296), }", nil), ErrTooLarge},
+	}
+	for i, v := range tests {
+		if _, err := DecodeNpy(bytes.NewReader(v.data)); !errors.Is(err, v.expect) {
+			t.Fatalf("%d: expect = %v, got = %v", i, v.expect, err)
+		}
+	}
+}
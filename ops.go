@@ -0,0 +1,502 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// images smaller than this are processed on the calling goroutine.
+const minParallelPixels = 64 * 1024
+
+// parallelRows splits the rows [0, height) into one range per CPU and
+// calls fn for each range concurrently. It returns when all calls are done.
+func parallelRows(height, width int, fn func(y0, y1 int)) {
+	n := runtime.GOMAXPROCS(0)
+	if n > height {
+		n = height
+	}
+	if n <= 1 || height*width < minParallelPixels {
+		fn(0, height)
+		return
+	}
+
+	var wg sync.WaitGroup
+	step := (height + n - 1) / n
+	for y := 0; y < height; y += step {
+		y1 := y + step
+		if y1 > height {
+			y1 = height
+		}
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			fn(y0, y1)
+		}(y, y1)
+	}
+	wg.Wait()
+}
+
+// kindRange returns the value range of an integer kind.
+// ok is false for float and complex kinds, which are not saturated.
+func kindRange(dataType reflect.Kind) (lo, hi float64, ok bool) {
+	switch dataType {
+	case reflect.Int8:
+		return math.MinInt8, math.MaxInt8, true
+	case reflect.Int16:
+		return math.MinInt16, math.MaxInt16, true
+	case reflect.Int32:
+		return math.MinInt32, math.MaxInt32, true
+	case reflect.Int64:
+		// the largest float64 below 1<<63
+		return math.MinInt64, math.Nextafter(1<<63, 0), true
+	case reflect.Uint8:
+		return 0, math.MaxUint8, true
+	case reflect.Uint16:
+		return 0, math.MaxUint16, true
+	case reflect.Uint32:
+		return 0, math.MaxUint32, true
+	case reflect.Uint64:
+		// the largest float64 below 1<<64
+		return 0, math.Nextafter(1<<64, 0), true
+	}
+	return 0, 0, false
+}
+
+// saturateValue rounds v to the nearest value representable by dataType.
+// Integer kinds are clamped to their range and NaN becomes zero.
+func saturateValue(dataType reflect.Kind, v float64) float64 {
+	lo, hi, ok := kindRange(dataType)
+	if !ok {
+		return v
+	}
+	if v != v {
+		return 0
+	}
+	v = math.Floor(v + 0.5)
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// opsCheck reports whether dst and src have the same size and channels.
+func opsCheck(dst, src *MemPImage) error {
+	if err := dst.Validate(); err != nil {
+		return err
+	}
+	if err := src.Validate(); err != nil {
+		return err
+	}
+	if dst.XChannels != src.XChannels {
+		return fmt.Errorf("rawp: channels mismatch, dst = %v, src = %v", dst.XChannels, src.XChannels)
+	}
+	if a, b := dst.XRect.Size(), src.XRect.Size(); a != b {
+		return fmt.Errorf("rawp: size mismatch, dst = %v, src = %v", a, b)
+	}
+	return nil
+}
+
+// Map replaces every sample v of m with fn(v).
+//
+// Results are rounded and saturated for integer kinds.
+// For Uint8 and Uint16 images fn is evaluated once per possible value.
+func Map(m *MemPImage, fn func(v float64) float64) error {
+	return MapTo(m, m, fn)
+}
+
+// MapTo writes fn(v) for every sample v of src into dst.
+// dst and src must have the same size and channels, but may have
+// different kinds. dst may be src.
+func MapTo(dst, src *MemPImage, fn func(v float64) float64) error {
+	if err := opsCheck(dst, src); err != nil {
+		return err
+	}
+	w, h := src.XRect.Dx(), src.XRect.Dy()
+
+	switch {
+	case src.XDataType == reflect.Uint8 && dst.XDataType == reflect.Uint8:
+		lut := make([]uint8, 1<<8)
+		for i := range lut {
+			lut[i] = uint8(saturateValue(reflect.Uint8, fn(float64(i))))
+		}
+		return ApplyLUTTo(dst, src, lut)
+
+	case src.XDataType == reflect.Uint16 && dst.XDataType == reflect.Uint16 && w*h*src.XChannels > 1<<16:
+		lut := make([]uint16, 1<<16)
+		for i := range lut {
+			lut[i] = uint16(saturateValue(reflect.Uint16, fn(float64(i))))
+		}
+		return ApplyLUT16To(dst, src, lut)
+
+	case src.XDataType == reflect.Float32 && dst.XDataType == reflect.Float32:
+		parallelRows(h, w, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				d := dst.rowPix(dst.XRect.Min.Y + y).Float32s()
+				s := src.rowPix(src.XRect.Min.Y + y).Float32s()
+				for i, v := range s {
+					d[i] = float32(fn(float64(v)))
+				}
+			}
+		})
+		return nil
+
+	case src.XDataType == reflect.Float64 && dst.XDataType == reflect.Float64:
+		parallelRows(h, w, func(y0, y1 int) {
+			for y := y0; y < y1; y++ {
+				d := dst.rowPix(dst.XRect.Min.Y + y).Float64s()
+				s := src.rowPix(src.XRect.Min.Y + y).Float64s()
+				for i, v := range s {
+					d[i] = fn(v)
+				}
+			}
+		})
+		return nil
+	}
+
+	n := w * src.XChannels
+	parallelRows(h, w, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			d := dst.rowPix(dst.XRect.Min.Y + y)
+			s := src.rowPix(src.XRect.Min.Y + y)
+			for i := 0; i < n; i++ {
+				v := fn(s.Value(i, src.XDataType))
+				d.SetValue(i, dst.XDataType, saturateValue(dst.XDataType, v))
+			}
+		}
+	})
+	return nil
+}
+
+// ScaleOffset replaces every sample v of m with v*scale + offset.
+func ScaleOffset(m *MemPImage, scale, offset float64) error {
+	return Map(m, func(v float64) float64 {
+		return v*scale + offset
+	})
+}
+
+// Clamp limits every sample of m to the range [min, max].
+func Clamp(m *MemPImage, min, max float64) error {
+	if min > max {
+		return fmt.Errorf("rawp: bad clamp range, min = %v, max = %v", min, max)
+	}
+	return Map(m, func(v float64) float64 {
+		if v < min {
+			return min
+		}
+		if v > max {
+			return max
+		}
+		return v
+	})
+}
+
+// Gamma applies the power law max*(v/max)^gamma to every sample of m.
+// max is the largest value of integer kinds and 1 for float kinds.
+func Gamma(m *MemPImage, gamma float64) error {
+	if gamma <= 0 {
+		return fmt.Errorf("rawp: bad gamma, %v", gamma)
+	}
+	max := 1.0
+	if _, hi, ok := kindRange(m.XDataType); ok {
+		max = hi
+	}
+	return Map(m, func(v float64) float64 {
+		if v <= 0 {
+			return 0
+		}
+		return max * math.Pow(v/max, gamma)
+	})
+}
+
+// ApplyLUT replaces every sample v of the Uint8 image m with lut[v].
+func ApplyLUT(m *MemPImage, lut []uint8) error {
+	return ApplyLUTTo(m, m, lut)
+}
+
+// ApplyLUTTo writes lut[v] for every sample v of src into dst.
+// Both images must be Uint8, and lut must have 256 entries.
+func ApplyLUTTo(dst, src *MemPImage, lut []uint8) error {
+	if err := opsCheck(dst, src); err != nil {
+		return err
+	}
+	if src.XDataType != reflect.Uint8 || dst.XDataType != reflect.Uint8 {
+		return fmt.Errorf("rawp: ApplyLUT, bad DataType, dst = %s, src = %s", KindString(dst.XDataType), KindString(src.XDataType))
+	}
+	if len(lut) < 1<<8 {
+		return fmt.Errorf("rawp: ApplyLUT, bad lut size, %v", len(lut))
+	}
+	lut = lut[:1<<8]
+
+	parallelRows(src.XRect.Dy(), src.XRect.Dx(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			d := dst.rowPix(dst.XRect.Min.Y + y)
+			s := src.rowPix(src.XRect.Min.Y + y)
+			for i, v := range s {
+				d[i] = lut[v]
+			}
+		}
+	})
+	return nil
+}
+
+// ApplyLUT16 replaces every sample v of the Uint16 image m with lut[v].
+func ApplyLUT16(m *MemPImage, lut []uint16) error {
+	return ApplyLUT16To(m, m, lut)
+}
+
+// ApplyLUT16To writes lut[v] for every sample v of src into dst.
+// Both images must be Uint16, and lut must have 65536 entries.
+func ApplyLUT16To(dst, src *MemPImage, lut []uint16) error {
+	if err := opsCheck(dst, src); err != nil {
+		return err
+	}
+	if src.XDataType != reflect.Uint16 || dst.XDataType != reflect.Uint16 {
+		return fmt.Errorf("rawp: ApplyLUT16, bad DataType, dst = %s, src = %s", KindString(dst.XDataType), KindString(src.XDataType))
+	}
+	if len(lut) < 1<<16 {
+		return fmt.Errorf("rawp: ApplyLUT16, bad lut size, %v", len(lut))
+	}
+	lut = lut[:1<<16]
+
+	parallelRows(src.XRect.Dy(), src.XRect.Dx(), func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			d := dst.rowPix(dst.XRect.Min.Y + y).Uint16s()
+			s := src.rowPix(src.XRect.Min.Y + y).Uint16s()
+			for i, v := range s {
+				d[i] = lut[v]
+			}
+		}
+	})
+	return nil
+}
+
+type binaryOp int
+
+const (
+	opAdd binaryOp = iota
+	opSub
+	opMul
+	opDiv
+)
+
+func (op binaryOp) String() string {
+	switch op {
+	case opAdd:
+		return "Add"
+	case opSub:
+		return "Sub"
+	case opMul:
+		return "Mul"
+	case opDiv:
+		return "Div"
+	}
+	return "?"
+}
+
+func (op binaryOp) apply(a, b float64) float64 {
+	switch op {
+	case opAdd:
+		return a + b
+	case opSub:
+		return a - b
+	case opMul:
+		return a * b
+	case opDiv:
+		return a / b
+	}
+	return 0
+}
+
+// Add sets dst = a + b for every sample.
+//
+// a, b and dst must have the same size and channels. Integer results
+// are rounded and saturated to the range of dst's kind, float results
+// follow IEEE 754. dst may be a or b.
+func Add(dst, a, b *MemPImage) error {
+	return binaryOpTo(opAdd, dst, a, b)
+}
+
+// Sub sets dst = a - b for every sample, see Add.
+func Sub(dst, a, b *MemPImage) error {
+	return binaryOpTo(opSub, dst, a, b)
+}
+
+// Mul sets dst = a * b for every sample, see Add.
+func Mul(dst, a, b *MemPImage) error {
+	return binaryOpTo(opMul, dst, a, b)
+}
+
+// Div sets dst = a / b for every sample, see Add.
+//
+// For integer kinds dividing by zero saturates to the largest (a > 0)
+// or smallest (a < 0) value of the kind, and 0/0 is 0.
+func Div(dst, a, b *MemPImage) error {
+	return binaryOpTo(opDiv, dst, a, b)
+}
+
+func binaryOpTo(op binaryOp, dst, a, b *MemPImage) error {
+	if err := opsCheck(dst, a); err != nil {
+		return fmt.Errorf("rawp: %v, %v", op, err)
+	}
+	if err := opsCheck(dst, b); err != nil {
+		return fmt.Errorf("rawp: %v, %v", op, err)
+	}
+	w, h := dst.XRect.Dx(), dst.XRect.Dy()
+	kind := dst.XDataType
+
+	if a.XDataType == kind && b.XDataType == kind {
+		switch kind {
+		case reflect.Uint8, reflect.Uint16, reflect.Float32, reflect.Float64:
+			parallelRows(h, w, func(y0, y1 int) {
+				for y := y0; y < y1; y++ {
+					op.rows(kind,
+						dst.rowPix(dst.XRect.Min.Y+y),
+						a.rowPix(a.XRect.Min.Y+y),
+						b.rowPix(b.XRect.Min.Y+y),
+					)
+				}
+			})
+			return nil
+		}
+	}
+
+	n := w * dst.XChannels
+	parallelRows(h, w, func(y0, y1 int) {
+		for y := y0; y < y1; y++ {
+			d := dst.rowPix(dst.XRect.Min.Y + y)
+			s0 := a.rowPix(a.XRect.Min.Y + y)
+			s1 := b.rowPix(b.XRect.Min.Y + y)
+			for i := 0; i < n; i++ {
+				v := op.apply(s0.Value(i, a.XDataType), s1.Value(i, b.XDataType))
+				d.SetValue(i, kind, saturateValue(kind, v))
+			}
+		}
+	})
+	return nil
+}
+
+// rows is the typed fast path of binaryOpTo for rows of the same kind.
+func (op binaryOp) rows(kind reflect.Kind, d, a, b PixSlice) {
+	switch kind {
+	case reflect.Uint8:
+		switch op {
+		case opAdd:
+			for i := range d {
+				v := int(a[i]) + int(b[i])
+				if v > math.MaxUint8 {
+					v = math.MaxUint8
+				}
+				d[i] = uint8(v)
+			}
+		case opSub:
+			for i := range d {
+				v := int(a[i]) - int(b[i])
+				if v < 0 {
+					v = 0
+				}
+				d[i] = uint8(v)
+			}
+		default:
+			for i := range d {
+				d[i] = uint8(saturateValue(kind, op.apply(float64(a[i]), float64(b[i]))))
+			}
+		}
+
+	case reflect.Uint16:
+		d, a, b := d.Uint16s(), a.Uint16s(), b.Uint16s()
+		switch op {
+		case opAdd:
+			for i := range d {
+				v := int(a[i]) + int(b[i])
+				if v > math.MaxUint16 {
+					v = math.MaxUint16
+				}
+				d[i] = uint16(v)
+			}
+		case opSub:
+			for i := range d {
+				v := int(a[i]) - int(b[i])
+				if v < 0 {
+					v = 0
+				}
+				d[i] = uint16(v)
+			}
+		default:
+			for i := range d {
+				d[i] = uint16(saturateValue(kind, op.apply(float64(a[i]), float64(b[i]))))
+			}
+		}
+
+	case reflect.Float32:
+		d, a, b := d.Float32s(), a.Float32s(), b.Float32s()
+		for i := range d {
+			d[i] = float32(op.apply(float64(a[i]), float64(b[i])))
+		}
+
+	case reflect.Float64:
+		d, a, b := d.Float64s(), a.Float64s(), b.Float64s()
+		for i := range d {
+			d[i] = op.apply(a[i], b[i])
+		}
+	}
+}
+
+// loadRow converts the samples of row to float64 and stores them in d.
+func loadRow(d []float64, row PixSlice, dataType reflect.Kind) {
+	switch dataType {
+	case reflect.Uint8:
+		for i, v := range row[:len(d)] {
+			d[i] = float64(v)
+		}
+	case reflect.Uint16:
+		for i, v := range row.Uint16s()[:len(d)] {
+			d[i] = float64(v)
+		}
+	case reflect.Float32:
+		for i, v := range row.Float32s()[:len(d)] {
+			d[i] = float64(v)
+		}
+	case reflect.Float64:
+		copy(d, row.Float64s())
+	default:
+		for i := range d {
+			d[i] = row.Value(i, dataType)
+		}
+	}
+}
+
+// storeRow writes the values of s into row, rounded and saturated to dataType.
+func storeRow(row PixSlice, dataType reflect.Kind, s []float64) {
+	switch dataType {
+	case reflect.Uint8:
+		for i, v := range s {
+			row[i] = uint8(saturateValue(dataType, v))
+		}
+	case reflect.Uint16:
+		d := row.Uint16s()
+		for i, v := range s {
+			d[i] = uint16(saturateValue(dataType, v))
+		}
+	case reflect.Float32:
+		d := row.Float32s()
+		for i, v := range s {
+			d[i] = float32(v)
+		}
+	case reflect.Float64:
+		copy(row.Float64s(), s)
+	default:
+		for i, v := range s {
+			row.SetValue(i, dataType, saturateValue(dataType, v))
+		}
+	}
+}
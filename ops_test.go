@@ -0,0 +1,102 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"image"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMap(t *testing.T) {
+	for _, kind := range []reflect.Kind{
+		reflect.Uint8, reflect.Uint16, reflect.Int16, reflect.Float32, reflect.Float64,
+	} {
+		m := NewMemPImage(image.Rect(0, 0, 300, 300), 3, kind)
+		for i := 0; i < len(m.XPix)/SizeofKind(kind); i++ {
+			m.XPix.SetValue(i, kind, float64(i%100))
+		}
+		if err := ScaleOffset(m, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(m.XPix)/SizeofKind(kind); i++ {
+			if v, expect := m.XPix.Value(i, kind), float64(i%100)*2+1; v != expect {
+				t.Fatalf("%v: %d: expect = %v, got = %v", kind, i, expect, v)
+			}
+		}
+	}
+}
+
+func TestMapSaturate(t *testing.T) {
+	m := NewMemPImage(image.Rect(0, 0, 4, 1), 1, reflect.Uint8)
+	copy(m.XPix, []byte{0, 10, 200, 255})
+	if err := ScaleOffset(m, 2, -15); err != nil {
+		t.Fatal(err)
+	}
+	if expect := []byte{0, 5, 255, 255}; string(m.XPix) != string(expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m.XPix)
+	}
+}
+
+func TestBinaryOps(t *testing.T) {
+	a := NewMemPImage(image.Rect(0, 0, 3, 1), 1, reflect.Uint16)
+	b := NewMemPImage(image.Rect(5, 5, 8, 6), 1, reflect.Uint16)
+	copy(a.XPix.Uint16s(), []uint16{100, 65000, 7})
+	copy(b.XPix.Uint16s(), []uint16{200, 1000, 0})
+
+	dst := NewMemPImage(image.Rect(0, 0, 3, 1), 1, reflect.Uint16)
+	tests := []struct {
+		fn     func(dst, a, b *MemPImage) error
+		expect []uint16
+	}{
+		{Add, []uint16{300, 65535, 7}},
+		{Sub, []uint16{0, 64000, 7}},
+		{Mul, []uint16{20000, 65535, 0}},
+		{Div, []uint16{1, 65, 65535}},
+	}
+	for i, v := range tests {
+		if err := v.fn(dst, a, b); err != nil {
+			t.Fatal(err)
+		}
+		if got := dst.XPix.Uint16s(); !reflect.DeepEqual(got, v.expect) {
+			t.Fatalf("%d: expect = %v, got = %v", i, v.expect, got)
+		}
+	}
+
+	// mixed kinds use the generic path
+	f := NewMemPImage(image.Rect(0, 0, 3, 1), 1, reflect.Float32)
+	if err := Div(f, a, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.XPix.Float32s(); got[0] != 0.5 || !math.IsInf(float64(got[2]), 1) {
+		t.Fatalf("bad float result: %v", got)
+	}
+
+	if err := Add(dst, a, NewMemPImage(image.Rect(0, 0, 2, 1), 1, reflect.Uint16)); err == nil {
+		t.Fatal("expect size mismatch error")
+	}
+}
+
+func TestApplyLUT(t *testing.T) {
+	m := NewMemPImage(image.Rect(0, 0, 2, 2), 1, reflect.Uint8)
+	copy(m.XPix, []byte{0, 1, 2, 255})
+	lut := make([]uint8, 256)
+	for i := range lut {
+		lut[i] = uint8(255 - i)
+	}
+	if err := ApplyLUT(m, lut); err != nil {
+		t.Fatal(err)
+	}
+	if expect := []byte{255, 254, 253, 0}; string(m.XPix) != string(expect) {
+		t.Fatalf("expect = %v, got = %v", expect, m.XPix)
+	}
+	if err := ApplyLUT(m, lut[:10]); err == nil {
+		t.Fatal("expect lut size error")
+	}
+	if err := ApplyLUT16(m, nil); err == nil {
+		t.Fatal("expect DataType error")
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Netpbm formats, see http://netpbm.sourceforge.net/doc/:
+//
+//	P5  PGM, gray, "P5 Width Height MaxVal" and big endian samples
+//	P6  PPM, RGB, "P6 Width Height MaxVal" and big endian samples
+//	P7  PAM, any channels, header lines "WIDTH w", "HEIGHT h", "DEPTH d",
+//	    "MAXVAL m", "TUPLTYPE t" up to "ENDHDR"
+//	Pf  PFM, gray float32, "Pf Width Height Scale"
+//	PF  PFM, RGB float32, "PF Width Height Scale"
+//
+// Samples of P5, P6 and P7 are 8 bit if MaxVal < 256, 16 bit otherwise.
+// Rows of PFM are stored bottom-up, and their samples are little endian if
+// Scale is negative, big endian otherwise.
+const (
+	pnmMaxToken = 1 << 10
+)
+
+type pnmHeader struct {
+	Format   string // "P5", "P6", "P7", "Pf" or "PF"
+	Width    int
+	Height   int
+	Channels int
+	MaxVal   int     // P5, P6 and P7
+	Scale    float64 // PFM
+}
+
+func (hdr *pnmHeader) kind() reflect.Kind {
+	switch {
+	case hdr.Format == "Pf" || hdr.Format == "PF":
+		return reflect.Float32
+	case hdr.MaxVal < 256:
+		return reflect.Uint8
+	default:
+		return reflect.Uint16
+	}
+}
+
+type pnmReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// LoadPNM reads the PNM or PAM image in the file name.
+func LoadPNM(name string) (m *MemPImage, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodePNM(f)
+}
+
+// SavePNM writes m to the file name, as PAM if name ends with ".pam".
+func SavePNM(name string, m *MemPImage) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if strings.EqualFold(filepath.Ext(name), ".pam") {
+		err = EncodePAM(w, m)
+	} else {
+		err = EncodePNM(w, m)
+	}
+	if err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// DecodePNMConfig returns the color model and dimensions of a PGM, PPM, PAM
+// or PFM image without decoding the entire image.
+func DecodePNMConfig(r io.Reader) (config image.Config, err error) {
+	hdr, err := pnmReadHeader(pnmByteReader(r))
+	if err != nil {
+		return
+	}
+	config = image.Config{
+		ColorModel: ColorModel(hdr.Channels, hdr.kind()),
+		Width:      hdr.Width,
+		Height:     hdr.Height,
+	}
+	return
+}
+
+// DecodePNM reads a binary PGM (P5), PPM (P6), PAM (P7) or PFM (Pf, PF)
+// image from r. Netpbm samples are scaled to the full range of 8 or 16 bit
+// if MaxVal is not 255 or 65535. PFM samples are not scaled.
+func DecodePNM(r io.Reader) (m *MemPImage, err error) {
+	br := pnmByteReader(r)
+	hdr, err := pnmReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := hdr.kind()
+	size := SizeofKind(kind)
+	for _, n := range []int{hdr.Width, hdr.Height, hdr.Channels} {
+		if size > maxInt/n {
+			return nil, &FormatError{Field: "pnm.Size", Got: fmt.Sprintf("%vx%vx%v", hdr.Width, hdr.Height, hdr.Channels), Err: ErrTooLarge}
+		}
+		size *= n
+	}
+	data, err := readChunks(br, nil, size)
+	if err == io.ErrUnexpectedEOF {
+		return nil, &FormatError{Field: "pnm.Data", Got: len(data), Want: size, Err: ErrTruncated}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m = &MemPImage{
+		XMemPMagic: MemPMagic,
+		XRect:      image.Rect(0, 0, hdr.Width, hdr.Height),
+		XStride:    hdr.Width * SizeofPixel(hdr.Channels, kind),
+		XChannels:  hdr.Channels,
+		XDataType:  kind,
+		XPix:       data,
+	}
+
+	if kind == reflect.Float32 {
+		if (hdr.Scale < 0) != isLittleEndian {
+			m.XPix.SwapEndian(kind)
+		}
+		// rows are bottom-up
+		for y0, y1 := 0, hdr.Height-1; y0 < y1; y0, y1 = y0+1, y1-1 {
+			a, b := m.rowPix(y0), m.rowPix(y1)
+			for i := range a {
+				a[i], b[i] = b[i], a[i]
+			}
+		}
+		return m, nil
+	}
+
+	if kind == reflect.Uint16 && isLittleEndian {
+		m.XPix.SwapEndian(kind)
+	}
+	if hdr.MaxVal != 255 && hdr.MaxVal != 65535 {
+		pnmScale(m.XPix, kind, hdr.MaxVal)
+	}
+	return m, nil
+}
+
+// pnmScale scales the samples in pix from [0, maxVal] to the full range
+// of kind. Samples over maxVal are clamped.
+func pnmScale(pix PixSlice, kind reflect.Kind, maxVal int) {
+	full := uint32(255)
+	if kind == reflect.Uint16 {
+		full = 65535
+	}
+	scale := func(v uint32) uint32 {
+		if v >= uint32(maxVal) {
+			return full
+		}
+		return (v*full + uint32(maxVal)/2) / uint32(maxVal)
+	}
+	switch kind {
+	case reflect.Uint8:
+		for i, v := range pix {
+			pix[i] = uint8(scale(uint32(v)))
+		}
+	case reflect.Uint16:
+		s := pix.Uint16s()
+		for i, v := range s {
+			s[i] = uint16(scale(uint32(v)))
+		}
+	}
+}
+
+func pnmByteReader(r io.Reader) pnmReader {
+	if br, ok := r.(pnmReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+func pnmReadHeader(r pnmReader) (hdr *pnmHeader, err error) {
+	hdr = new(pnmHeader)
+	if hdr.Format, err = pnmReadToken(r); err != nil {
+		return nil, err
+	}
+	switch hdr.Format {
+	case "P5", "P6":
+		hdr.Channels = 1
+		if hdr.Format == "P6" {
+			hdr.Channels = 3
+		}
+		if hdr.Width, err = pnmReadInt(r, "pnm.Width"); err != nil {
+			return nil, err
+		}
+		if hdr.Height, err = pnmReadInt(r, "pnm.Height"); err != nil {
+			return nil, err
+		}
+		if hdr.MaxVal, err = pnmReadInt(r, "pnm.MaxVal"); err != nil {
+			return nil, err
+		}
+	case "P7":
+		if err = pnmReadPAMHeader(r, hdr); err != nil {
+			return nil, err
+		}
+	case "Pf", "PF":
+		hdr.Channels = 1
+		if hdr.Format == "PF" {
+			hdr.Channels = 3
+		}
+		if hdr.Width, err = pnmReadInt(r, "pnm.Width"); err != nil {
+			return nil, err
+		}
+		if hdr.Height, err = pnmReadInt(r, "pnm.Height"); err != nil {
+			return nil, err
+		}
+		s, err := pnmReadToken(r)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Scale, err = strconv.ParseFloat(s, 64); err != nil || hdr.Scale == 0 {
+			return nil, errFormat("pnm.Scale", s)
+		}
+		return hdr, nil
+	default:
+		return nil, errUnsupported("pnm.Format", strconv.Quote(hdr.Format))
+	}
+	if hdr.MaxVal <= 0 || hdr.MaxVal > 65535 {
+		return nil, errFormat("pnm.MaxVal", hdr.MaxVal)
+	}
+	return hdr, nil
+}
+
+// pnmReadPAMHeader reads the header lines of a PAM image, after "P7".
+func pnmReadPAMHeader(r pnmReader, hdr *pnmHeader) error {
+	for {
+		line, err := pnmReadLine(r)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0][0] == '#' {
+			continue
+		}
+		if fields[0] == "ENDHDR" {
+			break
+		}
+		if fields[0] == "TUPLTYPE" {
+			continue
+		}
+		if len(fields) != 2 {
+			return errFormat("pam.Header", strconv.Quote(line))
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n <= 0 {
+			return errFormat("pam."+fields[0], fields[1])
+		}
+		switch fields[0] {
+		case "WIDTH":
+			hdr.Width = n
+		case "HEIGHT":
+			hdr.Height = n
+		case "DEPTH":
+			hdr.Channels = n
+		case "MAXVAL":
+			hdr.MaxVal = n
+		default:
+			return errFormat("pam.Header", strconv.Quote(line))
+		}
+	}
+	if hdr.Width == 0 || hdr.Height == 0 || hdr.Channels == 0 {
+		return errFormat("pam.Header", fmt.Sprintf("WIDTH %d HEIGHT %d DEPTH %d", hdr.Width, hdr.Height, hdr.Channels))
+	}
+	return nil
+}
+
+// pnmReadToken skips white space and comments, and reads the next token
+// and the single white space after it.
+func pnmReadToken(r io.ByteReader) (string, error) {
+	var tok []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(tok) > 0 {
+				return string(tok), nil
+			}
+			return "", readError("pnm.Header", err)
+		}
+		switch {
+		case c == '#' && len(tok) == 0:
+			if _, err = pnmReadLine(r); err != nil {
+				return "", err
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f':
+			if len(tok) > 0 {
+				return string(tok), nil
+			}
+		default:
+			if len(tok) >= pnmMaxToken {
+				return "", errFormat("pnm.Header", strconv.Quote(string(tok)))
+			}
+			tok = append(tok, c)
+		}
+	}
+}
+
+func pnmReadInt(r io.ByteReader, field string) (int, error) {
+	s, err := pnmReadToken(r)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errFormat(field, s)
+	}
+	return n, nil
+}
+
+// pnmReadLine reads up to and including the next newline.
+func pnmReadLine(r io.ByteReader) (string, error) {
+	var line []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", readError("pnm.Header", err)
+		}
+		if c == '\n' {
+			return string(line), nil
+		}
+		if len(line) >= pnmMaxToken {
+			return "", errFormat("pnm.Header", strconv.Quote(string(line)))
+		}
+		line = append(line, c)
+	}
+}
+
+// EncodePNM writes m to w as PGM (P5) or PPM (P6) for 1 or 3 channels of
+// Uint8 or Uint16, as PFM for 1 or 3 channels of Float32, and as PAM (P7)
+// for the other channels of Uint8 or Uint16.
+func EncodePNM(w io.Writer, m *MemPImage) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	switch {
+	case m.XDataType == reflect.Float32 && m.XChannels == 1:
+		return pnmWrite(w, m, "Pf")
+	case m.XDataType == reflect.Float32 && m.XChannels == 3:
+		return pnmWrite(w, m, "PF")
+	case m.XDataType != reflect.Uint8 && m.XDataType != reflect.Uint16:
+		return errUnsupported("XDataType", KindString(m.XDataType))
+	case m.XChannels == 1:
+		return pnmWrite(w, m, "P5")
+	case m.XChannels == 3:
+		return pnmWrite(w, m, "P6")
+	default:
+		return pnmWrite(w, m, "P7")
+	}
+}
+
+// EncodePAM writes m to w as PAM (P7), for any channels of Uint8 or Uint16.
+// The TUPLTYPE is GRAYSCALE, GRAYSCALE_ALPHA, RGB or RGB_ALPHA for 1 to 4
+// channels, and left out for the others.
+func EncodePAM(w io.Writer, m *MemPImage) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if m.XDataType != reflect.Uint8 && m.XDataType != reflect.Uint16 {
+		return errUnsupported("XDataType", KindString(m.XDataType))
+	}
+	return pnmWrite(w, m, "P7")
+}
+
+func pnmWrite(w io.Writer, m *MemPImage, format string) (err error) {
+	b := m.XRect
+	maxVal := 255
+	if m.XDataType == reflect.Uint16 {
+		maxVal = 65535
+	}
+
+	var header string
+	switch format {
+	case "P5", "P6":
+		header = fmt.Sprintf("%s\n%d %d\n%d\n", format, b.Dx(), b.Dy(), maxVal)
+	case "P7":
+		header = fmt.Sprintf("P7\nWIDTH %d\nHEIGHT %d\nDEPTH %d\nMAXVAL %d\n", b.Dx(), b.Dy(), m.XChannels, maxVal)
+		if m.XChannels <= 4 {
+			header += "TUPLTYPE " + [...]string{"GRAYSCALE", "GRAYSCALE_ALPHA", "RGB", "RGB_ALPHA"}[m.XChannels-1] + "\n"
+		}
+		header += "ENDHDR\n"
+	default:
+		scale := "1.0"
+		if isLittleEndian {
+			scale = "-1.0"
+		}
+		header = fmt.Sprintf("%s\n%d %d\n%s\n", format, b.Dx(), b.Dy(), scale)
+	}
+	if _, err = io.WriteString(w, header); err != nil {
+		return
+	}
+
+	// Netpbm samples are big endian, PFM ones are native
+	swap := m.XDataType == reflect.Uint16 && isLittleEndian
+	var buf PixSlice
+	for i := 0; i < b.Dy(); i++ {
+		y := b.Min.Y + i
+		if m.XDataType == reflect.Float32 {
+			y = b.Max.Y - 1 - i
+		}
+		row := m.rowPix(y)
+		if swap {
+			buf = append(buf[:0], row...)
+			buf.SwapEndian(m.XDataType)
+			row = buf
+		}
+		if _, err = w.Write(row); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func decodePNM(r io.Reader) (image.Image, error) {
+	m, err := DecodePNM(r)
+	if err != nil {
+		return nil, err
+	}
+	return m.StdImage(), nil
+}
+
+func init() {
+	image.RegisterFormat("pgm", "P5", decodePNM, DecodePNMConfig)
+	image.RegisterFormat("ppm", "P6", decodePNM, DecodePNMConfig)
+	image.RegisterFormat("pam", "P7", decodePNM, DecodePNMConfig)
+	image.RegisterFormat("pfm", "Pf", decodePNM, DecodePNMConfig)
+	image.RegisterFormat("pfm", "PF", decodePNM, DecodePNMConfig)
+}
@@ -0,0 +1,162 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeAndDecodePNM(t *testing.T) {
+	tests := []struct {
+		channels int
+		kind     reflect.Kind
+		format   string
+	}{
+		{1, reflect.Uint8, "pgm"},
+		{1, reflect.Uint16, "pgm"},
+		{3, reflect.Uint8, "ppm"},
+		{3, reflect.Uint16, "ppm"},
+		{2, reflect.Uint8, "pam"},
+		{4, reflect.Uint16, "pam"},
+		{1, reflect.Float32, "pfm"},
+		{3, reflect.Float32, "pfm"},
+	}
+	for _, v := range tests {
+		m0 := NewMemPImage(image.Rect(0, 0, 7, 5), v.channels, v.kind)
+		for i := range m0.XPix {
+			m0.XPix[i] = byte(i * 7)
+		}
+		if v.kind == reflect.Float32 {
+			for i := range m0.XPix.Float32s() {
+				m0.XPix.Float32s()[i] = float32(i) / 3
+			}
+		}
+		sub := m0.SubImage(image.Rect(1, 1, 6, 4)).(*MemPImage)
+
+		var buf bytes.Buffer
+		if err := EncodePNM(&buf, sub); err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		m, format, err := image.Decode(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		if format != v.format {
+			t.Fatalf("%v: format = %q", v, format)
+		}
+		m1, ok := m.(*MemPImage)
+		if !ok {
+			m1 = NewMemPImageFrom(m)
+		}
+		tCheckPixels(t, m1, sub)
+
+		// through RawP, for the channels it supports
+		if v.channels == 2 {
+			continue
+		}
+		buf.Reset()
+		if err := Encode(&buf, m1, &Options{UseSnappy: true}); err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		m2, err := DecodeImage(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		buf.Reset()
+		if err := EncodePNM(&buf, m2); err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		m3, err := DecodePNM(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", v, err)
+		}
+		tCheckPixels(t, m3, sub)
+	}
+}
+
+// tCheckPixels checks that m and want have the same size, type and pixels.
+func tCheckPixels(t *testing.T, m, want *MemPImage) {
+	t.Helper()
+	if m.Bounds().Size() != want.Bounds().Size() || m.XChannels != want.XChannels || m.XDataType != want.XDataType {
+		t.Fatalf("got %v, %d channels, %v; want %v, %d channels, %v",
+			m.Bounds(), m.XChannels, m.XDataType, want.Bounds(), want.XChannels, want.XDataType)
+	}
+	d := want.Bounds().Min.Sub(m.Bounds().Min)
+	for y := m.XRect.Min.Y; y < m.XRect.Max.Y; y++ {
+		for x := m.XRect.Min.X; x < m.XRect.Max.X; x++ {
+			if !bytes.Equal(m.PixelAt(x, y), want.PixelAt(x+d.X, y+d.Y)) {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, m.PixelAt(x, y), want.PixelAt(x+d.X, y+d.Y))
+			}
+		}
+	}
+}
+
+func TestDecodePNM_headers(t *testing.T) {
+	// comments, a 10 bit MaxVal, and big endian samples
+	m, err := DecodePNM(strings.NewReader("P5 # gray\n2 # width\n1\n1023\n\x03\xFF\x01\xFF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := m.XPix.Uint16s(); v[0] != 65535 || v[1] != 32735 {
+		t.Fatalf("samples = %v", v)
+	}
+
+	m, err = DecodePNM(strings.NewReader("P7\n# comment\nWIDTH 1\nHEIGHT 1\nDEPTH 2\nMAXVAL 15\nTUPLTYPE GRAYSCALE_ALPHA\nENDHDR\n\x0F\x05"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.XChannels != 2 || m.XDataType != reflect.Uint8 || m.XPix[0] != 255 || m.XPix[1] != 85 {
+		t.Fatalf("PAM: %d channels, %v, %v", m.XChannels, m.XDataType, m.XPix)
+	}
+
+	// big endian PFM, rows bottom-up
+	m, err = DecodePNM(strings.NewReader("Pf\n1 2\n1.0\n\x3F\x80\x00\x00\x40\x00\x00\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := m.XPix.Float32s(); v[0] != 2 || v[1] != 1 {
+		t.Fatalf("PFM: samples = %v", v)
+	}
+
+	config, format, err := image.DecodeConfig(strings.NewReader("P6\n640 480\n255\n"))
+	if err != nil || format != "ppm" || config.Width != 640 || config.Height != 480 {
+		t.Fatalf("DecodeConfig: %v, %q, %v", config, format, err)
+	}
+	if c, ok := config.ColorModel.(ColorModelInterface); !ok || c.Channels() != 3 || c.DataType() != reflect.Uint8 {
+		t.Fatalf("DecodeConfig: color model = %v", config.ColorModel)
+	}
+}
+
+func TestDecodePNM_errors(t *testing.T) {
+	tests := []struct {
+		data   string
+		expect error
+	}{
+		{"P5\n2 2\n255\n\x00\x00\x00", ErrTruncated},
+		{"P5\n2 2", ErrTruncated},
+		{"P5\n2 -2\n255\n", ErrFormat},
+		{"P5\n2 2\n70000\n", ErrFormat},
+		{"P3\n1 1\n255\n0 0 0\n", ErrUnsupported},
+		{"P7\nWIDTH 1\nHEIGHT 1\nENDHDR\n", ErrFormat},
+		{"P7\nWIDTH 1\nHEIGHT 1\nDEPTH 1\nMAXVAL 255\nFOO 1\nENDHDR\n", ErrFormat},
+		{"PF\n1 1\n0\n", ErrFormat},
+		{"P7\nWIDTH 4294967296\nHEIGHT 4294967296\nDEPTH 4294967296\nMAXVAL 255\nENDHDR\n", ErrTooLarge},
+	}
+	for i, v := range tests {
+		if _, err := DecodePNM(strings.NewReader(v.data)); !errors.Is(err, v.expect) {
+			t.Fatalf("%d: expect = %v, got = %v", i, v.expect, err)
+		}
+	}
+
+	m := NewMemPImage(image.Rect(0, 0, 1, 1), 2, reflect.Float32)
+	if err := EncodePNM(new(bytes.Buffer), m); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("EncodePNM: expect = %v, got = %v", ErrUnsupported, err)
+	}
+}
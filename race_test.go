@@ -0,0 +1,12 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build race
+// +build race
+
+package rawp
+
+// raceEnabled is set in race builds, where sync.Pool drops items at
+// random and allocation counts are not exact.
+const raceEnabled = true
@@ -7,7 +7,9 @@ package rawp
 import (
 	"fmt"
 	"hash/crc32"
+	"image"
 	"image/color"
+	"io"
 	"math"
 	"reflect"
 	"unsafe"
@@ -16,16 +18,26 @@ import (
 )
 
 const (
-	rawpHeaderSize = 24
-	rawpSig        = "RAWP"
-	rawpMagic      = 0x1BF2380A // CRC32("RAWP")
+	rawpHeaderSize   = 24
+	rawpMaxReadAhead = 1 << 20 // buffer size allocated before reading the image data
+	rawpSig          = "RAWP"
+	rawpMagic        = 0x1BF2380A // CRC32("RAWP")
 )
 
 // data type
 const (
-	rawpDataType_UInt  = 1
-	rawpDataType_Int   = 2
-	rawpDataType_Float = 3
+	rawpDataType_UInt    = 1
+	rawpDataType_Int     = 2
+	rawpDataType_Float   = 3
+	rawpDataType_BFloat  = 4 // bfloat16, Depth 16 only
+	rawpDataType_Complex = 5 // real and imaginary floats, Depth 64/128 only
+)
+
+// compress type (UseSnappy)
+const (
+	rawpUseSnappy_Disabled = 0
+	rawpUseSnappy_Enabled  = 1
+	rawpUseSnappy_Blocks   = 2 // snappy blocks, see rawpEncodeBlocks
 )
 
 // RawP Image Spec (Little Endian), 24Bytes.
@@ -35,12 +47,21 @@ type rawpHeader struct {
 	Width        uint16  // 2Bytes, image Width
 	Height       uint16  // 2Bytes, image Height
 	Channels     byte    // 1Bytes, 1=Gray, 3=RGB, 4=RGBA
-	Depth        byte    // 1Bytes, 8/16/32/64 bits
-	DataType     byte    // 1Bytes, 1=Uint, 2=Int, 3=Float
-	UseSnappy    byte    // 1Bytes, 0=disabled, 1=enabled (Header.Data)
+	Depth        byte    // 1Bytes, 8/16/32/64/128 bits, or packed 1/2/4/10/12 bits
+	DataType     byte    // 1Bytes, 1=Uint, 2=Int, 3=Float, 4=BFloat, 5=Complex
+	UseSnappy    byte    // 1Bytes, 0=disabled, 1=enabled, 2=blocks (Header.Data), flags 0x80|0x40|0x30
 	DataSize     uint32  // 4Bytes, image data size (Header.Data)
 	DataCheckSum uint32  // 4Bytes, CRC32(RawPHeader.Data[RawPHeader.DataSize])
 	Data         []byte  // ?Bytes, image data (RawPHeader.DataSize)
+
+	Packing Packing   // layout of packed depths, see rawp_pack.go
+	YUV     YUVLayout // layout of YUV frames, see yuv.go
+
+	// header extensions, see rawp_ext.go
+	Origin     image.Point // image Bounds().Min
+	CFA        CFA         // raw sensor data, for 1 channel
+	ColorSpace ColorSpace  // how the channels are to be read
+	Ext        []byte      // raw extensions data
 }
 
 func (p *rawpHeader) String() string {
@@ -73,10 +94,22 @@ rawp.rawpHeader{
 }
 
 func rawpDataType(depth, dataType byte) reflect.Kind {
+	if rawpIsPackedDepth(depth) {
+		if dataType != rawpDataType_UInt {
+			return reflect.Invalid
+		}
+		return rawpPackedKind(int(depth))
+	}
 	switch depth {
 	case 8:
 		return reflect.Uint8
 	case 16:
+		switch dataType {
+		case rawpDataType_Float:
+			return Float16
+		case rawpDataType_BFloat:
+			return BFloat16
+		}
 		return reflect.Uint16
 	case 32:
 		switch dataType {
@@ -91,6 +124,12 @@ func rawpDataType(depth, dataType byte) reflect.Kind {
 			return reflect.Uint64
 		case rawpDataType_Float:
 			return reflect.Float64
+		case rawpDataType_Complex:
+			return reflect.Complex64
+		}
+	case 128:
+		if dataType == rawpDataType_Complex {
+			return reflect.Complex128
 		}
 	}
 	return (reflect.Invalid)
@@ -101,52 +140,69 @@ func rawpIsValidChannels(channels byte) bool {
 }
 
 func rawpIsValidDepth(depth byte) bool {
-	return depth > 0 && (depth%8) == 0
+	return depth > 0 && (depth%8) == 0 || rawpIsPackedDepth(depth)
 }
 
 func rawpIsValidDataType(t byte) bool {
-	return t == rawpDataType_UInt || t == rawpDataType_Int || t == rawpDataType_Float
+	return t == rawpDataType_UInt || t == rawpDataType_Int || t == rawpDataType_Float ||
+		t == rawpDataType_BFloat || t == rawpDataType_Complex
 }
 
 func rawpIsValidHeader(hdr *rawpHeader) error {
 	if string(hdr.Sig[:]) != rawpSig {
-		return fmt.Errorf("rawp: bad Sig, %v", hdr.Sig)
+		return &FormatError{Field: "Sig", Got: string(hdr.Sig[:]), Want: rawpSig, Err: ErrFormat}
 	}
 	if hdr.Magic != rawpMagic {
-		return fmt.Errorf("rawp: bad Magic, %x", hdr.Magic)
+		return &FormatError{Field: "Magic", Got: hdr.Magic, Want: uint32(rawpMagic), Err: ErrFormat}
 	}
 
-	if hdr.Width <= 0 || hdr.Height <= 0 {
-		return fmt.Errorf("rawp: bad size, width = %v, height = %v", hdr.Width, hdr.Height)
+	if hdr.Width <= 0 {
+		return errFormat("Width", hdr.Width)
+	}
+	if hdr.Height <= 0 {
+		return errFormat("Height", hdr.Height)
 	}
 	if !rawpIsValidChannels(hdr.Channels) {
-		return fmt.Errorf("rawp: bad Channels, %v", hdr.Channels)
+		return errFormat("Channels", hdr.Channels)
 	}
 	if !rawpIsValidDepth(hdr.Depth) {
-		return fmt.Errorf("rawp: bad Depth, %v", hdr.Depth)
+		return errFormat("Depth", hdr.Depth)
 	}
 	if !rawpIsValidDataType(hdr.DataType) {
-		return fmt.Errorf("rawp: bad DataType, %v", hdr.DataType)
+		return errFormat("DataType", hdr.DataType)
 	}
 
-	if hdr.UseSnappy != 0 && hdr.UseSnappy != 1 {
-		return fmt.Errorf("rawp: bad UseSnappy, %v", hdr.UseSnappy)
+	if v := hdr.UseSnappy; v != rawpUseSnappy_Disabled && v != rawpUseSnappy_Enabled && v != rawpUseSnappy_Blocks {
+		return errUnsupported("UseSnappy", hdr.UseSnappy)
 	}
 	if hdr.DataSize <= 0 {
-		return fmt.Errorf("rawp: bad DataSize, %v", hdr.DataSize)
+		return errFormat("DataSize", hdr.DataSize)
 	}
 
 	// check type more ...
-	if hdr.Depth == 8 || hdr.Depth == 16 {
-		if hdr.DataType == rawpDataType_Float {
-			return fmt.Errorf("rawp: bad Depth, %v", hdr.Depth)
-		}
+	if hdr.Depth == 8 && hdr.DataType == rawpDataType_Float {
+		return errUnsupported("Depth", hdr.Depth)
+	}
+	if hdr.Depth != 16 && hdr.DataType == rawpDataType_BFloat {
+		return errUnsupported("Depth", hdr.Depth)
+	}
+	if hdr.Depth != 64 && hdr.Depth != 128 && hdr.DataType == rawpDataType_Complex {
+		return errUnsupported("Depth", hdr.Depth)
+	}
+	if rawpIsPackedDepth(hdr.Depth) && hdr.DataType != rawpDataType_UInt {
+		return errUnsupported("DataType", fmt.Sprintf("depth = %v, type = %v", hdr.Depth, hdr.DataType))
+	}
+	if hdr.Packing != PackingMSB && (hdr.Packing != PackingMIPI || (hdr.Depth != 10 && hdr.Depth != 12)) {
+		return errUnsupported("Packing", fmt.Sprintf("%v, %d bits", hdr.Packing, hdr.Depth))
+	}
+	if hdr.YUV != YUVNone && (hdr.Channels != 3 || hdr.Depth != 8 || hdr.DataType != rawpDataType_UInt) {
+		return errUnsupported("YUV", fmt.Sprintf("%v, %d channels, depth = %v, type = %v", hdr.YUV, hdr.Channels, hdr.Depth, hdr.DataType))
 	}
 
 	// check data size more ...
-	if hdr.UseSnappy == 0 {
-		if x := int(hdr.Width) * int(hdr.Height) * int(hdr.Channels) * int(hdr.Depth) / 8; x < int(hdr.DataSize) {
-			return fmt.Errorf("rawp: bad DataSize, %v", hdr.DataSize)
+	if hdr.UseSnappy == rawpUseSnappy_Disabled {
+		if x := rawpImageDataSize(hdr); x != int(hdr.DataSize) {
+			return &FormatError{Field: "DataSize", Got: hdr.DataSize, Want: x, Err: ErrFormat}
 		}
 	}
 
@@ -155,38 +211,42 @@ func rawpIsValidHeader(hdr *rawpHeader) error {
 
 func rawpColorModel(hdr *rawpHeader) (color.Model, error) {
 	if v := hdr.Channels; v != 1 && v != 3 && v != 4 {
-		return nil, fmt.Errorf("rawp: unsupport color model, hdr = %v", hdr)
+		return nil, errUnsupported("Channels", hdr.Channels)
+	}
+	if hdr.YUV != YUVNone {
+		return color.YCbCrModel, nil
 	}
 	dataType := rawpDataType(hdr.Depth, hdr.DataType)
 	if reflect.Kind(dataType) == reflect.Invalid {
-		return nil, fmt.Errorf("rawp: unsupport color model, hdr = %v", hdr)
+		return nil, errUnsupported("DataType", fmt.Sprintf("depth = %v, type = %v", hdr.Depth, hdr.DataType))
 	}
 	return ColorModel(int(hdr.Channels), dataType), nil
 }
 
-func rawpMakeHeader(width, height, channels int, dataType reflect.Kind, useSnappy bool) (hdr *rawpHeader, err error) {
-	if width <= 0 || width > math.MaxUint16 {
-		err = fmt.Errorf("rawp: image size overflow: width = %v, height = %v", width, height)
+func rawpInitHeader(hdr *rawpHeader, width, height, channels int, dataType reflect.Kind, useSnappy bool) (err error) {
+	if width <= 0 || height <= 0 {
+		err = errFormat("Size", fmt.Sprintf("%vx%v", width, height))
 		return
 	}
-	if height <= 0 || height > math.MaxUint16 {
-		err = fmt.Errorf("rawp: image size overflow: width = %v, height = %v", width, height)
+	if width > math.MaxUint16 || height > math.MaxUint16 {
+		err = &FormatError{Field: "Size", Got: fmt.Sprintf("%vx%v", width, height), Err: ErrTooLarge}
 		return
 	}
 	if v := channels; v != 1 && v != 3 && v != 4 {
-		err = fmt.Errorf("rawp: invalid channels: %v", channels)
+		err = errUnsupported("Channels", channels)
 		return
 	}
 
-	hdr = &rawpHeader{
+	*hdr = rawpHeader{
 		Sig:      [4]byte{'R', 'A', 'W', 'P'},
 		Magic:    rawpMagic,
 		Width:    uint16(width),
 		Height:   uint16(height),
 		Channels: byte(channels),
+		Ext:      hdr.Ext[:0],
 	}
 	if useSnappy {
-		hdr.UseSnappy = 1
+		hdr.UseSnappy = rawpUseSnappy_Enabled
 	}
 
 	switch dataType {
@@ -206,6 +266,14 @@ func rawpMakeHeader(width, height, channels int, dataType reflect.Kind, useSnapp
 		hdr.Depth = 8 * 8
 		hdr.DataType = rawpDataType_UInt
 		return
+	case Float16:
+		hdr.Depth = 2 * 8
+		hdr.DataType = rawpDataType_Float
+		return
+	case BFloat16:
+		hdr.Depth = 2 * 8
+		hdr.DataType = rawpDataType_BFloat
+		return
 	case reflect.Float32:
 		hdr.Depth = 4 * 8
 		hdr.DataType = rawpDataType_Float
@@ -214,45 +282,207 @@ func rawpMakeHeader(width, height, channels int, dataType reflect.Kind, useSnapp
 		hdr.Depth = 8 * 8
 		hdr.DataType = rawpDataType_Float
 		return
+	case reflect.Complex64:
+		hdr.Depth = 8 * 8
+		hdr.DataType = rawpDataType_Complex
+		return
+	case reflect.Complex128:
+		hdr.Depth = 16 * 8
+		hdr.DataType = rawpDataType_Complex
+		return
 	}
 
-	return nil, fmt.Errorf("rawp: unsupport DataType, %V", dataType)
+	return errUnsupported("DataType", KindString(dataType))
 }
 
-func rawpDecodeHeader(data []byte) (hdr *rawpHeader, err error) {
-	if len(data) < rawpHeaderSize {
-		err = fmt.Errorf("rawp: bad header.")
-		return
+// rawpImageDataSize returns the size of the decoded image data of hdr,
+// still packed for packed depths and YUV frames.
+func rawpImageDataSize(hdr *rawpHeader) int {
+	if hdr.YUV != YUVNone {
+		return yuvDataSize(hdr.YUV, int(hdr.Width), int(hdr.Height))
 	}
+	return int(hdr.Height) * rawpRowSize(hdr)
+}
 
-	// reader header
-	hdr = new(rawpHeader)
-	copy(((*[1 << 30]byte)(unsafe.Pointer(hdr)))[:rawpHeaderSize], data)
-	hdr.Data = data[rawpHeaderSize:]
+// rawpMaxDataSize returns the largest DataSize of an image with size bytes
+// of decoded data. Blocks hold at least 1 byte, each adds 4 bytes to the
+// block table and at most 32 bytes of snappy overhead.
+func rawpMaxDataSize(size int, useSnappy byte) int64 {
+	max := size
+	switch useSnappy {
+	case rawpUseSnappy_Enabled:
+		max = snappy.MaxEncodedLen(size)
+	case rawpUseSnappy_Blocks:
+		if max = snappy.MaxEncodedLen(size); max >= 0 {
+			max += rawpBlockTableHeaderSize + 36*size
+		}
+	}
+	if max < 0 {
+		return math.MaxUint32
+	}
+	return int64(max)
+}
 
-	// Check CRC32
-	if v := crc32.ChecksumIEEE(hdr.Data); v != hdr.DataCheckSum {
-		return nil, fmt.Errorf("rawp: bad DataCheckSum, expect = %x, got = %x", hdr.DataCheckSum, v)
+// rawpReadHeader reads the header of a RawP image from r into hdr and
+// checks it against the limits of opt, which may be nil.
+func rawpReadHeader(r io.Reader, hdr *rawpHeader, opt *DecodeOptions) error {
+	b := ((*[rawpHeaderSize]byte)(unsafe.Pointer(hdr)))[:]
+	if n, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &FormatError{Field: "Header", Got: n, Want: rawpHeaderSize, Err: ErrTruncated}
+		}
+		return err
 	}
+	hdr.Data = nil
+	hdr.Origin = image.Point{}
+	hdr.CFA = CFA{}
+	hdr.ColorSpace = ColorSpaceUnknown
 
-	// check data size
-	if len(hdr.Data) != int(hdr.DataSize) {
-		return nil, fmt.Errorf("rawp: snappyDecode, bad DataSize: %v != %v", len(hdr.Data), hdr.DataSize)
+	hasExt := hdr.UseSnappy&rawpFlag_Extensions != 0
+	hdr.Packing = PackingMSB
+	if hdr.UseSnappy&rawpFlag_MIPI != 0 {
+		hdr.Packing = PackingMIPI
 	}
+	hdr.YUV = YUVLayout(hdr.UseSnappy & rawpFlag_YUV >> rawpFlag_YUVShift)
+	hdr.UseSnappy &^= rawpFlag_Extensions | rawpFlag_MIPI | rawpFlag_YUV
+	if err := rawpCheckHeader(hdr, opt); err != nil {
+		return err
+	}
+	if hasExt {
+		return rawpReadExt(r, hdr)
+	}
+	return nil
+}
 
-	// uncompress
-	if hdr.UseSnappy != 0 {
-		pix, err := snappy.Decode(nil, hdr.Data)
+// rawpCheckHeader checks hdr and the limits of opt before the image data
+// is read or allocated.
+func rawpCheckHeader(hdr *rawpHeader, opt *DecodeOptions) error {
+	if err := rawpIsValidHeader(hdr); err != nil {
+		return err
+	}
+	if rawpDataType(hdr.Depth, hdr.DataType) == reflect.Invalid {
+		return errUnsupported("DataType", fmt.Sprintf("depth = %v, type = %v", hdr.Depth, hdr.DataType))
+	}
+
+	size := rawpImageDataSize(hdr)
+	if opt != nil {
+		if n := int(hdr.Width) * int(hdr.Height); opt.MaxPixels > 0 && n > opt.MaxPixels {
+			return &FormatError{Field: "Pixels", Got: n, Want: opt.MaxPixels, Err: ErrTooLarge}
+		}
+		// packed samples take more room once decoded
+		n := int(hdr.Width) * int(hdr.Height) * int(hdr.Channels) * SizeofKind(rawpDataType(hdr.Depth, hdr.DataType))
+		if opt.MaxBytes > 0 && n > opt.MaxBytes {
+			return &FormatError{Field: "Bytes", Got: n, Want: opt.MaxBytes, Err: ErrTooLarge}
+		}
+		if opt.MaxBytes > 0 && int64(hdr.DataSize) > int64(opt.MaxBytes) {
+			return &FormatError{Field: "DataSize", Got: hdr.DataSize, Want: opt.MaxBytes, Err: ErrTooLarge}
+		}
+	}
+	if max := rawpMaxDataSize(size, hdr.UseSnappy); int64(hdr.DataSize) > max {
+		return &FormatError{Field: "DataSize", Got: hdr.DataSize, Want: max, Err: ErrFormat}
+	}
+	return nil
+}
+
+// rawpReadData reads the hdr.DataSize bytes of image data from r, into
+// buf if it has enough capacity.
+func rawpReadData(r io.Reader, hdr *rawpHeader, buf []byte) ([]byte, error) {
+	data, err := readChunks(r, buf, int(hdr.DataSize))
+	if err == io.ErrUnexpectedEOF {
+		return nil, &FormatError{Field: "DataSize", Got: len(data), Want: hdr.DataSize, Err: ErrTruncated}
+	}
+	return data, err
+}
+
+// readChunks reads size bytes from r, into buf if it has enough capacity.
+// The data is read in chunks, so a header lying about the size can not
+// make it allocate much more than the input. If r ends early, it returns
+// the data read and io.ErrUnexpectedEOF.
+func readChunks(r io.Reader, buf []byte, size int) ([]byte, error) {
+	data := buf[:0]
+	for len(data) < size {
+		n := size - len(data)
+		if n > rawpMaxReadAhead {
+			n = rawpMaxReadAhead
+		}
+		if cap(data)-len(data) < n {
+			data = append(data, make([]byte, n)...)[:len(data)]
+		}
+		m, err := io.ReadFull(r, data[len(data):][:n])
+		data = data[:len(data)+m]
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			return nil, fmt.Errorf("rawp: snappyDecode, err = %v", err)
+			return data, err
 		}
-		hdr.Data = pix
 	}
+	return data, nil
+}
 
-	// check header
-	if err = rawpIsValidHeader(hdr); err != nil {
-		return
+const maxInt = int(^uint(0) >> 1)
+
+// maxDeflateRatio is the max ratio of deflate, to bound the decoded size
+// by the input size.
+const maxDeflateRatio = 1032
+
+// readError returns ErrTruncated for an EOF while reading field.
+func readError(field string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &FormatError{Field: field, Err: ErrTruncated}
+	}
+	return err
+}
+
+// rawpDecodeData checks the CRC of the image data and decodes it, into
+// buf if it has enough capacity. Uncompressed pix is data itself.
+// The result has exactly rawpImageDataSize(hdr) bytes.
+func rawpDecodeData(hdr *rawpHeader, data, buf []byte) (pix []byte, err error) {
+	if len(data) != int(hdr.DataSize) {
+		return nil, &FormatError{Field: "DataSize", Got: len(data), Want: hdr.DataSize, Err: ErrTruncated}
+	}
+
+	// Check CRC32
+	if v := crc32.ChecksumIEEE(data); v != hdr.DataCheckSum {
+		return nil, &FormatError{
+			Field: "DataCheckSum",
+			Got:   fmt.Sprintf("%x", v),
+			Want:  fmt.Sprintf("%x", hdr.DataCheckSum),
+			Err:   ErrChecksum,
+		}
 	}
 
-	return
+	// uncompress
+	size := rawpImageDataSize(hdr)
+	switch hdr.UseSnappy {
+	case rawpUseSnappy_Disabled:
+		pix = data
+	case rawpUseSnappy_Enabled:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, rawpSnappyError("Data", err)
+		}
+		if n != size {
+			return nil, &FormatError{Field: "Data", Got: n, Want: size, Err: ErrFormat}
+		}
+		if pix, err = snappy.Decode(buf[:cap(buf)], data); err != nil {
+			return nil, rawpSnappyError("Data", err)
+		}
+	case rawpUseSnappy_Blocks:
+		if pix, err = rawpDecodeBlocks(data, buf, size); err != nil {
+			return nil, err
+		}
+	}
+	if len(pix) != size {
+		return nil, &FormatError{Field: "Data", Got: len(pix), Want: size, Err: ErrFormat}
+	}
+	return pix, nil
+}
+
+// rawpSnappyError converts a snappy error of field to a *FormatError.
+func rawpSnappyError(field string, err error) error {
+	if err == snappy.ErrTooLarge {
+		return &FormatError{Field: field, Got: err, Err: ErrTooLarge}
+	}
+	return &FormatError{Field: field, Got: err, Err: ErrFormat}
 }
@@ -0,0 +1,163 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// DefaultBlockSize is a good Options.BlockSize for multi-core machines.
+const DefaultBlockSize = 1 << 20
+
+// Snappy block data (Little Endian), used when Header.UseSnappy == 2:
+//
+//	type RawPBlocks struct {
+//		BlockCount uint32               // 4Bytes, number of blocks
+//		BlockSize  uint32               // 4Bytes, uncompressed size of every block but the last
+//		Sizes      [BlockCount]uint32   // 4Bytes each, compressed size of each block
+//		Blocks     [BlockCount][?]byte  // snappy compressed blocks
+//	}
+const rawpBlockTableHeaderSize = 8
+
+// parallelFor calls fn(0), ..., fn(n-1) on up to GOMAXPROCS goroutines.
+func parallelFor(n int, fn func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	next := make(chan int, n)
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	for k := 0; k < workers; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+var blockBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// rawpEncodeBlocks compresses size bytes of image data as independent
+// snappy blocks of blockSize bytes and returns the block table followed by
+// the blocks. read returns the len(buf) bytes of image data at off, it may
+// store them in buf.
+func rawpEncodeBlocks(size, blockSize int, read func(buf []byte, off int) []byte) []byte {
+	n := (size + blockSize - 1) / blockSize
+	blocks := make([][]byte, n)
+	parallelFor(n, func(i int) {
+		end := (i + 1) * blockSize
+		if end > size {
+			end = size
+		}
+		buf := blockBufferPool.Get().(*[]byte)
+		if cap(*buf) < end-i*blockSize {
+			*buf = make([]byte, blockSize)
+		}
+		blocks[i] = snappy.Encode(nil, read((*buf)[:end-i*blockSize], i*blockSize))
+		blockBufferPool.Put(buf)
+	})
+
+	total := rawpBlockTableHeaderSize + 4*n
+	for _, b := range blocks {
+		total += len(b)
+	}
+	data := make([]byte, rawpBlockTableHeaderSize+4*n, total)
+	binary.LittleEndian.PutUint32(data[0:], uint32(n))
+	binary.LittleEndian.PutUint32(data[4:], uint32(blockSize))
+	for i, b := range blocks {
+		binary.LittleEndian.PutUint32(data[rawpBlockTableHeaderSize+4*i:], uint32(len(b)))
+		data = append(data, b...)
+	}
+	return data
+}
+
+// rawpDecodeBlocks decodes the output of rawpEncodeBlocks, into buf if
+// it has enough capacity. The decoded data must have size bytes.
+func rawpDecodeBlocks(data, buf []byte, size int) (pix []byte, err error) {
+	if len(data) < rawpBlockTableHeaderSize {
+		return nil, &FormatError{Field: "BlockTable", Got: len(data), Want: rawpBlockTableHeaderSize, Err: ErrTruncated}
+	}
+	n := int(binary.LittleEndian.Uint32(data[0:]))
+	blockSize := int(binary.LittleEndian.Uint32(data[4:]))
+	if n <= 0 || blockSize <= 0 || n > (len(data)-rawpBlockTableHeaderSize)/4 {
+		return nil, errFormat("BlockTable", fmt.Sprintf("count = %v, size = %v", n, blockSize))
+	}
+
+	// locate blocks and check the decoded sizes before decoding any of them
+	blocks := make([][]byte, n)
+	off := rawpBlockTableHeaderSize + 4*n
+	total := 0
+	for i := range blocks {
+		bsize := int(binary.LittleEndian.Uint32(data[rawpBlockTableHeaderSize+4*i:]))
+		if bsize > len(data)-off {
+			return nil, &FormatError{Field: fmt.Sprintf("Block[%d].Size", i), Got: bsize, Want: len(data) - off, Err: ErrTruncated}
+		}
+		blocks[i] = data[off:][:bsize]
+		off += bsize
+
+		dlen, err := snappy.DecodedLen(blocks[i])
+		if err != nil {
+			return nil, rawpSnappyError(fmt.Sprintf("Block[%d]", i), err)
+		}
+		if (i < n-1 && dlen != blockSize) || (i == n-1 && (dlen <= 0 || dlen > blockSize)) {
+			return nil, &FormatError{Field: fmt.Sprintf("Block[%d].DecodedSize", i), Got: dlen, Want: blockSize, Err: ErrFormat}
+		}
+		if total += dlen; total > size {
+			return nil, &FormatError{Field: "Data", Got: total, Want: size, Err: ErrFormat}
+		}
+	}
+	if off != len(data) {
+		return nil, &FormatError{Field: "BlockData", Got: len(data), Want: off, Err: ErrFormat}
+	}
+	if total != size {
+		return nil, &FormatError{Field: "Data", Got: total, Want: size, Err: ErrFormat}
+	}
+
+	if pix = buf[:cap(buf)]; len(pix) >= total {
+		pix = pix[:total]
+	} else {
+		pix = make([]byte, total)
+	}
+	errs := make([]error, n)
+	parallelFor(n, func(i int) {
+		dst := pix[i*blockSize:]
+		if len(dst) > blockSize {
+			dst = dst[:blockSize]
+		}
+		if _, err := snappy.Decode(dst, blocks[i]); err != nil {
+			errs[i] = rawpSnappyError(fmt.Sprintf("Block[%d]", i), err)
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pix, nil
+}
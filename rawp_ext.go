@@ -0,0 +1,180 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"math"
+)
+
+// Header extensions (Little Endian), follow the header when
+// Header.UseSnappy&0x80 != 0:
+//
+//	type RawPExtensions struct {
+//		Size     uint32              // 4Bytes, size of Entries
+//		CheckSum uint32              // 4Bytes, CRC32(Entries)
+//		Entries  [?]struct {
+//			Tag  [4]byte             // 4Bytes, like "ORIG"
+//			Size uint32              // 4Bytes, size of Data
+//			Data [Size]byte
+//		}
+//	}
+//
+// Unknown entries are skipped.
+const (
+	rawpFlag_Extensions = 0x80
+
+	rawpExtHeaderSize      = 8
+	rawpExtEntryHeaderSize = 8
+	rawpMaxExtSize         = 64 << 10
+)
+
+// extension tags
+const (
+	rawpExtTag_Origin = "ORIG" // MinX, MinY int32
+	rawpExtTag_CFA    = "CFAP" // Pattern uint32, BlackLevel, WhiteLevel float64
+	rawpExtTag_Color  = "CSPC" // ColorSpace uint32
+)
+
+// rawpAppendExt appends the header extensions of hdr to buf, nothing if
+// hdr needs none.
+func rawpAppendExt(buf []byte, hdr *rawpHeader) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, rawpExtHeaderSize)...)
+	if hdr.Origin != (image.Point{}) {
+		buf = rawpAppendExtEntry(buf, rawpExtTag_Origin, 8)
+		buf = appendUint32(buf, uint32(int32(hdr.Origin.X)))
+		buf = appendUint32(buf, uint32(int32(hdr.Origin.Y)))
+	}
+	if hdr.CFA.Pattern != CFANone {
+		buf = rawpAppendExtEntry(buf, rawpExtTag_CFA, 20)
+		buf = appendUint32(buf, uint32(hdr.CFA.Pattern))
+		buf = appendUint64(buf, math.Float64bits(hdr.CFA.BlackLevel))
+		buf = appendUint64(buf, math.Float64bits(hdr.CFA.WhiteLevel))
+	}
+	if hdr.ColorSpace != ColorSpaceUnknown {
+		buf = rawpAppendExtEntry(buf, rawpExtTag_Color, 4)
+		buf = appendUint32(buf, uint32(hdr.ColorSpace))
+	}
+
+	entries := buf[start+rawpExtHeaderSize:]
+	if len(entries) == 0 {
+		return buf[:start]
+	}
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(entries)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(entries))
+	return buf
+}
+
+func rawpAppendExtEntry(buf []byte, tag string, size int) []byte {
+	buf = append(buf, tag...)
+	return appendUint32(buf, uint32(size))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v)), uint32(v>>32))
+}
+
+// rawpCheckOrigin checks that the bounds of an image at origin fit in
+// int32, like the origin itself.
+func rawpCheckOrigin(origin image.Point, width, height int) error {
+	if origin.X < math.MinInt32 || origin.Y < math.MinInt32 ||
+		int64(origin.X)+int64(width) > math.MaxInt32 ||
+		int64(origin.Y)+int64(height) > math.MaxInt32 {
+		return errUnsupported("Origin", origin)
+	}
+	return nil
+}
+
+// rawpReadExt reads the header extensions from r into hdr, hdr.Ext holds
+// the raw data.
+func rawpReadExt(r io.Reader, hdr *rawpHeader) error {
+	hdr.Ext = growBytes(hdr.Ext, rawpExtHeaderSize)
+	if n, err := io.ReadFull(r, hdr.Ext); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &FormatError{Field: "Extensions", Got: n, Want: rawpExtHeaderSize, Err: ErrTruncated}
+		}
+		return err
+	}
+	size := binary.LittleEndian.Uint32(hdr.Ext[0:])
+	checkSum := binary.LittleEndian.Uint32(hdr.Ext[4:])
+	if size > rawpMaxExtSize {
+		return &FormatError{Field: "Extensions.Size", Got: size, Want: rawpMaxExtSize, Err: ErrFormat}
+	}
+
+	hdr.Ext = growBytes(hdr.Ext, int(size))
+	if n, err := io.ReadFull(r, hdr.Ext); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return &FormatError{Field: "Extensions.Size", Got: n, Want: size, Err: ErrTruncated}
+		}
+		return err
+	}
+	if v := crc32.ChecksumIEEE(hdr.Ext); v != checkSum {
+		return &FormatError{
+			Field: "Extensions.CheckSum",
+			Got:   fmt.Sprintf("%x", v),
+			Want:  fmt.Sprintf("%x", checkSum),
+			Err:   ErrChecksum,
+		}
+	}
+
+	for data := hdr.Ext; len(data) > 0; {
+		if len(data) < rawpExtEntryHeaderSize {
+			return &FormatError{Field: "Extensions", Got: len(data), Want: rawpExtEntryHeaderSize, Err: ErrTruncated}
+		}
+		tag := data[:4]
+		n := binary.LittleEndian.Uint32(data[4:])
+		if data = data[rawpExtEntryHeaderSize:]; uint32(len(data)) < n {
+			return &FormatError{Field: "Extensions." + string(tag), Got: len(data), Want: n, Err: ErrTruncated}
+		}
+		v := data[:n]
+		data = data[n:]
+
+		switch string(tag) {
+		case rawpExtTag_Origin:
+			if len(v) != 8 {
+				return &FormatError{Field: "Extensions." + rawpExtTag_Origin, Got: len(v), Want: 8, Err: ErrFormat}
+			}
+			hdr.Origin = image.Pt(
+				int(int32(binary.LittleEndian.Uint32(v[0:]))),
+				int(int32(binary.LittleEndian.Uint32(v[4:]))),
+			)
+			if err := rawpCheckOrigin(hdr.Origin, int(hdr.Width), int(hdr.Height)); err != nil {
+				return &FormatError{Field: "Extensions." + rawpExtTag_Origin, Got: hdr.Origin, Err: ErrFormat}
+			}
+			if err := rawpCheckYUVOrigin(hdr.Origin, hdr.YUV); err != nil {
+				return &FormatError{Field: "Extensions." + rawpExtTag_Origin, Got: hdr.Origin, Err: ErrFormat}
+			}
+		case rawpExtTag_CFA:
+			if len(v) != 20 {
+				return &FormatError{Field: "Extensions." + rawpExtTag_CFA, Got: len(v), Want: 20, Err: ErrFormat}
+			}
+			hdr.CFA = CFA{
+				Pattern:    CFAPattern(binary.LittleEndian.Uint32(v[0:])),
+				BlackLevel: math.Float64frombits(binary.LittleEndian.Uint64(v[4:])),
+				WhiteLevel: math.Float64frombits(binary.LittleEndian.Uint64(v[12:])),
+			}
+			if !hdr.CFA.valid() || hdr.Channels != 1 {
+				return &FormatError{Field: "Extensions." + rawpExtTag_CFA, Got: hdr.CFA, Err: ErrFormat}
+			}
+		case rawpExtTag_Color:
+			if len(v) != 4 {
+				return &FormatError{Field: "Extensions." + rawpExtTag_Color, Got: len(v), Want: 4, Err: ErrFormat}
+			}
+			if hdr.ColorSpace = ColorSpace(binary.LittleEndian.Uint32(v)); !hdr.ColorSpace.valid() {
+				return &FormatError{Field: "Extensions." + rawpExtTag_Color, Got: hdr.ColorSpace, Err: ErrFormat}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Packed depths (Header.Depth 1, 2, 4, 10 or 12, DataType 1=Uint) store
+// the samples of each row without padding bits between them. Rows start
+// on a byte boundary. They decode to Uint8 (Depth 1, 2, 4) or Uint16
+// (Depth 10, 12) images, with MemPImage.XDepth holding the packed depth.
+//
+// By default (PackingMSB) the samples of a row are written MSB first, as
+// in PBM and TIFF, and the last byte of the row is padded with zero bits:
+//
+//	Depth 4:  [s0 s1] [s2 s3] ...
+//	Depth 12: [s0 11..4] [s0 3..0, s1 11..8] [s1 7..0] ...
+//
+// With Header.UseSnappy&0x40 != 0 (PackingMIPI, Depth 10 and 12 only)
+// rows use the MIPI CSI-2 RAW10/RAW12 layout, padded to whole groups with
+// zero samples:
+//
+//	RAW10: [s0 9..2] [s1 9..2] [s2 9..2] [s3 9..2] [s3 1..0, s2 1..0, s1 1..0, s0 1..0]
+//	RAW12: [s0 11..4] [s1 11..4] [s1 3..0, s0 3..0]
+const rawpFlag_MIPI = 0x40
+
+// Packing is the bit layout of the samples of packed depths.
+type Packing int
+
+const (
+	PackingMSB  Packing = iota // samples MSB first, rows padded to bytes
+	PackingMIPI                // MIPI RAW10/RAW12, Depth 10 and 12 only
+)
+
+func (p Packing) String() string {
+	switch p {
+	case PackingMSB:
+		return "msb"
+	case PackingMIPI:
+		return "mipi"
+	}
+	return fmt.Sprintf("Packing(%d)", int(p))
+}
+
+// rawpIsPackedDepth reports whether samples of depth bits are packed.
+func rawpIsPackedDepth(depth byte) bool {
+	return depth == 1 || depth == 2 || depth == 4 || depth == 10 || depth == 12
+}
+
+// rawpPackedKind returns the kind of the decoded samples of depth bits.
+func rawpPackedKind(depth int) reflect.Kind {
+	switch depth {
+	case 1, 2, 4:
+		return reflect.Uint8
+	case 10, 12:
+		return reflect.Uint16
+	}
+	return reflect.Invalid
+}
+
+// rawpSetDepth sets the packed depth of hdr for samples of kind.
+// A depth of 0, or the full size of kind, is not packed. PackingMIPI
+// needs a packed depth of 10 or 12.
+func rawpSetDepth(hdr *rawpHeader, depth int, packing Packing, kind reflect.Kind) error {
+	if packing != PackingMSB && (packing != PackingMIPI || (depth != 10 && depth != 12)) {
+		return errUnsupported("Packing", fmt.Sprintf("%v, %d bits", packing, depth))
+	}
+	if depth == 0 || depth == SizeofKind(kind)*8 {
+		return nil
+	}
+	if rawpPackedKind(depth) != kind {
+		return errUnsupported("Depth", fmt.Sprintf("%d bits %s", depth, KindString(kind)))
+	}
+	hdr.Depth = byte(depth)
+	hdr.Packing = packing
+	return nil
+}
+
+// rawpRowSize returns the size of a row of the image data of hdr.
+func rawpRowSize(hdr *rawpHeader) int {
+	n := int(hdr.Width) * int(hdr.Channels)
+	if hdr.Packing == PackingMIPI {
+		g := rawpMIPIGroup(int(hdr.Depth))
+		return (n + g - 1) / g * (g + 1)
+	}
+	return (n*int(hdr.Depth) + 7) / 8
+}
+
+// rawpMIPIGroup returns the number of samples of depth bits which share
+// the byte of low bits in the MIPI layout, 4 for RAW10 and 2 for RAW12.
+func rawpMIPIGroup(depth int) int {
+	return 8 / (depth - 8)
+}
+
+// rawpPackRow packs the samples of src, n of them, into dst. The samples
+// must fit in depth bits, see checkDepth.
+func rawpPackRow(dst []byte, src PixSlice, n, depth int, packing Packing) {
+	mask := uint32(1)<<uint(depth) - 1
+	sample := func(i int) uint32 {
+		if depth < 8 {
+			return uint32(src[i]) & mask
+		}
+		return uint32(src.Uint16s()[i]) & mask
+	}
+
+	if packing == PackingMIPI {
+		g, lo := rawpMIPIGroup(depth), uint(depth-8)
+		for i, o := 0, 0; i < n; i, o = i+g, o+g+1 {
+			var low byte
+			for k := 0; k < g; k++ {
+				var v uint32
+				if i+k < n {
+					v = sample(i + k)
+				}
+				dst[o+k] = byte(v >> lo)
+				low |= byte(v&(1<<lo-1)) << (uint(k) * lo)
+			}
+			dst[o+g] = low
+		}
+		return
+	}
+
+	var acc uint32
+	bits, j := 0, 0
+	for i := 0; i < n; i++ {
+		acc = acc<<uint(depth) | sample(i)
+		for bits += depth; bits >= 8; j++ {
+			bits -= 8
+			dst[j] = byte(acc >> uint(bits))
+		}
+	}
+	if bits > 0 {
+		dst[j] = byte(acc << uint(8-bits))
+	}
+}
+
+// rawpUnpackRow unpacks n samples of depth bits from src into dst.
+func rawpUnpackRow(dst PixSlice, src []byte, n, depth int, packing Packing) {
+	var v []uint16
+	if depth > 8 {
+		v = dst.Uint16s()
+	}
+
+	if packing == PackingMIPI {
+		g, lo := rawpMIPIGroup(depth), uint(depth-8)
+		for i, o := 0, 0; i < n; i, o = i+g, o+g+1 {
+			low := src[o+g]
+			for k := 0; k < g && i+k < n; k++ {
+				v[i+k] = uint16(src[o+k])<<lo | uint16(low>>(uint(k)*lo))&(1<<lo-1)
+			}
+		}
+		return
+	}
+
+	mask := uint32(1)<<uint(depth) - 1
+	var acc uint32
+	bits, j := 0, 0
+	for i := 0; i < n; i++ {
+		for ; bits < depth; bits += 8 {
+			acc = acc<<8 | uint32(src[j])
+			j++
+		}
+		bits -= depth
+		if s := acc >> uint(bits) & mask; v != nil {
+			v[i] = uint16(s)
+		} else {
+			dst[i] = byte(s)
+		}
+	}
+}
+
+// checkDepth reports a sample of p which does not fit in depth bits.
+func (p *MemPImage) checkDepth(depth int) error {
+	max := uint32(1)<<uint(depth) - 1
+	n := p.XRect.Dx() * p.XChannels
+	for y := p.XRect.Min.Y; y < p.XRect.Max.Y; y++ {
+		row := p.rowPix(y)
+		var row16 []uint16
+		if depth > 8 {
+			row16 = row.Uint16s()
+		}
+		for i := 0; i < n; i++ {
+			v := uint32(row[i])
+			if row16 != nil {
+				v = uint32(row16[i])
+			}
+			if v > max {
+				return &FormatError{Field: "Depth", Got: v, Want: max, Err: ErrUnsupported}
+			}
+		}
+	}
+	return nil
+}
+
+// packPix packs the samples of p into buf, rawpImageDataSize(hdr) bytes.
+func (p *MemPImage) packPix(buf []byte, hdr *rawpHeader) []byte {
+	rowSize := rawpRowSize(hdr)
+	n := int(hdr.Width) * int(hdr.Channels)
+	for y := p.XRect.Min.Y; y < p.XRect.Max.Y; y++ {
+		row := buf[(y-p.XRect.Min.Y)*rowSize:][:rowSize]
+		rawpPackRow(row, p.rowPix(y), n, int(hdr.Depth), hdr.Packing)
+	}
+	return buf
+}
+
+// rawpUnpack unpacks the image data of hdr into pix, with rows of stride
+// bytes.
+func rawpUnpack(hdr *rawpHeader, pix []byte, stride int, data []byte) {
+	rowSize := rawpRowSize(hdr)
+	n := int(hdr.Width) * int(hdr.Channels)
+	for y := 0; y < int(hdr.Height); y++ {
+		rawpUnpackRow(pix[y*stride:], data[y*rowSize:][:rowSize], n, int(hdr.Depth), hdr.Packing)
+	}
+}
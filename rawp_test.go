@@ -6,13 +6,18 @@ package rawp
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/jpeg"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"reflect"
 	"testing"
+	"unsafe"
 )
 
 func TestEncodeAndDecode(t *testing.T) {
@@ -60,6 +65,23 @@ func TestEncodeAndDecode(t *testing.T) {
 	tCompareImage(t, m0, m2, "m0 == m2")
 }
 
+func TestEncodeAndDecode_blocks(t *testing.T) {
+	var buf bytes.Buffer
+	m0 := tLoadImage("./testdata/lena.jpg")
+
+	for _, blockSize := range []int{1 << 10, 1000, 1 << 30} {
+		buf.Reset()
+		if err := Encode(&buf, m0, &Options{UseSnappy: true, BlockSize: blockSize}); err != nil {
+			t.Fatal(err)
+		}
+		m1, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tCompareImage(t, m0, m1, fmt.Sprintf("blockSize = %d", blockSize))
+	}
+}
+
 func tCompareImage(t testing.TB, m0, m1 image.Image, msgPrefix string) {
 	// compare image size
 	if b0, b1 := m0.Bounds(), m1.Bounds(); b0 != b1 {
@@ -106,6 +128,61 @@ func BenchmarkEncode_snappy(b *testing.B) {
 	}
 }
 
+func BenchmarkEncode_snappy_blocks(b *testing.B) {
+	m := tLoadLargeImage("./testdata/lena.jpg")
+	b.SetBytes(int64(len(m.XPix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(ioutil.Discard, m, &Options{UseSnappy: true, BlockSize: DefaultBlockSize})
+	}
+}
+
+func BenchmarkEncode_snappy_large(b *testing.B) {
+	m := tLoadLargeImage("./testdata/lena.jpg")
+	b.SetBytes(int64(len(m.XPix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(ioutil.Discard, m, &Options{UseSnappy: true})
+	}
+}
+
+func BenchmarkDecode_snappy_blocks(b *testing.B) {
+	benchmarkDecodeLarge(b, &Options{UseSnappy: true, BlockSize: DefaultBlockSize})
+}
+
+func BenchmarkDecode_snappy_large(b *testing.B) {
+	benchmarkDecodeLarge(b, &Options{UseSnappy: true})
+}
+
+func benchmarkDecodeLarge(b *testing.B, opt *Options) {
+	m := tLoadLargeImage("./testdata/lena.jpg")
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, opt); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(m.XPix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeImage(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// tLoadLargeImage tiles the image 4x4 to get a frame worth splitting.
+func tLoadLargeImage(filename string) *MemPImage {
+	m := NewMemPImageFrom(tLoadImage(filename))
+	b := m.Bounds()
+	p := NewMemPImage(image.Rect(0, 0, b.Dx()*4, b.Dy()*4), m.XChannels, m.XDataType)
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			Draw(p, b.Add(image.Pt(b.Dx()*x, b.Dy()*y)), m, b.Min, Src)
+		}
+	}
+	return p
+}
+
 func tLoadImage(filename string) image.Image {
 	f, err := os.Open(filename)
 	if err != nil {
@@ -119,3 +196,684 @@ func tLoadImage(filename string) image.Image {
 	}
 	return m
 }
+
+func TestDecodeInto(t *testing.T) {
+	m0 := NewMemPImageFrom(tLoadImage("./testdata/lena.jpg"))
+	for _, opt := range []*Options{
+		nil,
+		{UseSnappy: true},
+		{UseSnappy: true, BlockSize: 1 << 16},
+	} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m0, opt); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		var m1 MemPImage
+		if err := DecodeInto(bytes.NewReader(data), &m1); err != nil {
+			t.Fatal(err)
+		}
+		tCompareImage(t, m0, &m1, fmt.Sprintf("%+v", opt))
+
+		// decode again, reusing m1.XPix
+		pix := &m1.XPix[0]
+		if err := DecodeInto(bytes.NewReader(data), &m1); err != nil {
+			t.Fatal(err)
+		}
+		if &m1.XPix[0] != pix {
+			t.Fatalf("%+v: XPix not reused", opt)
+		}
+		tCompareImage(t, m0, &m1, fmt.Sprintf("%+v", opt))
+	}
+}
+
+func TestEncoderAndDecodeInto_allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items in race builds")
+	}
+	m0 := NewMemPImageFrom(tLoadImage("./testdata/lena.jpg"))
+	for _, opt := range []*Options{nil, {UseSnappy: true}} {
+		var buf bytes.Buffer
+		var m1 MemPImage
+		e := NewEncoder(opt)
+
+		allocs := testing.AllocsPerRun(10, func() {
+			buf.Reset()
+			if err := e.Encode(&buf, m0); err != nil {
+				t.Fatal(err)
+			}
+			if err := DecodeInto(&buf, &m1); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("%+v: allocs = %v", opt, allocs)
+		}
+	}
+}
+
+func BenchmarkEncoder(b *testing.B) {
+	m := NewMemPImageFrom(tLoadImage("./testdata/lena.jpg"))
+	e := NewEncoder(&Options{UseSnappy: true})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(m.XPix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.Encode(ioutil.Discard, m)
+	}
+}
+
+func BenchmarkEncode_pool(b *testing.B) {
+	m := NewMemPImageFrom(tLoadImage("./testdata/lena.jpg"))
+	opt := &Options{UseSnappy: true, UsePool: true}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(m.XPix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Encode(ioutil.Discard, m, opt)
+	}
+}
+
+func BenchmarkDecodeInto(b *testing.B) {
+	var buf bytes.Buffer
+	m := NewMemPImageFrom(tLoadImage("./testdata/lena.jpg"))
+	if err := Encode(&buf, m, &Options{UseSnappy: true}); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	r := bytes.NewReader(data)
+
+	var dst MemPImage
+	b.ReportAllocs()
+	b.SetBytes(int64(len(m.XPix)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		if err := DecodeInto(r, &dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecode_errors(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMemPImage(image.Rect(0, 0, 8, 8), 1, reflect.Uint8)
+	if err := Encode(&buf, m, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	badSum := append([]byte(nil), data...)
+	badSum[len(badSum)-1] ^= 0xFF
+	badSig := append([]byte(nil), data...)
+	badSig[0] = 'X'
+	zeroWidth := append([]byte(nil), data...)
+	zeroWidth[8], zeroWidth[9] = 0, 0
+
+	tests := []struct {
+		data   []byte
+		expect error
+		field  string
+	}{
+		{data[:10], ErrTruncated, "Header"},
+		{data[:len(data)-1], ErrTruncated, "DataSize"},
+		{badSum, ErrChecksum, "DataCheckSum"},
+		{badSig, ErrFormat, "Sig"},
+		{zeroWidth, ErrFormat, "Width"},
+	}
+	for i, v := range tests {
+		_, err := Decode(bytes.NewReader(v.data))
+		if !errors.Is(err, v.expect) {
+			t.Fatalf("%d: expect = %v, got = %v", i, v.expect, err)
+		}
+		var e *FormatError
+		if !errors.As(err, &e) || e.Field != v.field {
+			t.Fatalf("%d: expect field %q, got = %v", i, v.field, err)
+		}
+	}
+
+	if err := Encode(&buf, NewMemPImage(image.Rect(0, 0, 2, 2), 2, reflect.Uint8), nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("2 channels: expect = %v, got = %v", ErrUnsupported, err)
+	}
+	if err := Encode(&buf, NewMemPImage(image.Rect(0, 0, 0, 2), 1, reflect.Uint8), nil); !errors.Is(err, ErrFormat) {
+		t.Fatalf("width 0: expect = %v, got = %v", ErrFormat, err)
+	}
+	if err := Encode(&buf, NewMemPImage(image.Rect(0, 0, 1<<16, 1), 1, reflect.Uint8), nil); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("width 1<<16: expect = %v, got = %v", ErrTooLarge, err)
+	}
+}
+
+func TestDecode_limits(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMemPImage(image.Rect(0, 0, 16, 8), 3, reflect.Uint16)
+	if err := Encode(&buf, m, &Options{UseSnappy: true}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	tests := []struct {
+		opt    *DecodeOptions
+		expect error
+	}{
+		{nil, nil},
+		{&DecodeOptions{MaxPixels: 16 * 8, MaxBytes: 16 * 8 * 6}, nil},
+		{&DecodeOptions{MaxPixels: 16*8 - 1}, ErrTooLarge},
+		{&DecodeOptions{MaxBytes: 16*8*6 - 1}, ErrTooLarge},
+	}
+	for i, v := range tests {
+		_, err := DecodeImageWithOptions(bytes.NewReader(data), v.opt)
+		if !errors.Is(err, v.expect) && err != v.expect {
+			t.Fatalf("%d: expect = %v, got = %v", i, v.expect, err)
+		}
+	}
+
+	// a header claiming a huge image must fail before the data is allocated
+	var hdr rawpHeader
+	if err := rawpInitHeader(&hdr, 0xFFFF, 0xFFFF, 4, reflect.Float64, true); err != nil {
+		t.Fatal(err)
+	}
+	hdr.DataSize = 0xFFFFFFFF
+	huge := append([]byte(nil), ((*[rawpHeaderSize]byte)(unsafe.Pointer(&hdr)))[:]...)
+	if _, err := DecodeImageWithOptions(bytes.NewReader(huge), &DecodeOptions{MaxPixels: 1 << 20}); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("huge: expect = %v, got = %v", ErrTooLarge, err)
+	}
+	if _, err := DecodeImage(bytes.NewReader(huge)); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("huge: expect = %v, got = %v", ErrTruncated, err)
+	}
+	hdr.UseSnappy = rawpUseSnappy_Disabled
+	huge = append(huge[:0], ((*[rawpHeaderSize]byte)(unsafe.Pointer(&hdr)))[:]...)
+	if _, err := DecodeImage(bytes.NewReader(huge)); !errors.Is(err, ErrFormat) {
+		t.Fatalf("huge raw: expect = %v, got = %v", ErrFormat, err)
+	}
+}
+
+func TestDecode_trailingData(t *testing.T) {
+	var buf bytes.Buffer
+	m0 := NewMemPImage(image.Rect(0, 0, 4, 4), 1, reflect.Uint8)
+	m1 := NewMemPImage(image.Rect(0, 0, 2, 3), 3, reflect.Float32)
+	for _, m := range []*MemPImage{m0, m1} {
+		if err := Encode(&buf, m, &Options{UseSnappy: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []*MemPImage{m0, m1} {
+		m, err := DecodeImage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tCompareImage(t, want, m, "stream")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unread data: %v bytes", buf.Len())
+	}
+}
+
+// tWriteCounter records the size of every Write.
+type tWriteCounter struct {
+	bytes.Buffer
+	sizes []int
+}
+
+func (w *tWriteCounter) Write(p []byte) (int, error) {
+	w.sizes = append(w.sizes, len(p))
+	return w.Buffer.Write(p)
+}
+
+// dataWrites returns the number of writes after the first off bytes.
+func (w *tWriteCounter) dataWrites(off int) (n int) {
+	for _, size := range w.sizes {
+		if off <= 0 {
+			n++
+		}
+		off -= size
+	}
+	return
+}
+
+func TestEncodeSubImage(t *testing.T) {
+	m0 := NewMemPImageFrom(tLoadImage("./testdata/lena.jpg"))
+	r := image.Rect(13, 7, 13+101, 7+57)
+	sub := m0.SubImage(r).(*MemPImage)
+	if sub.XMemPMagic != MemPMagic || sub.Bounds() != r {
+		t.Fatalf("bad SubImage: magic = %q, bounds = %v", sub.XMemPMagic, sub.Bounds())
+	}
+	if n := (r.Dy()-1)*sub.XStride + r.Dx()*SizeofPixel(sub.XChannels, sub.XDataType); len(sub.XPix) != n || cap(sub.XPix) != n {
+		t.Fatalf("bad SubImage pix: len = %d, cap = %d, expect = %d", len(sub.XPix), cap(sub.XPix), n)
+	}
+
+	// the reference is a fresh compact image with the same pixels
+	compact := NewMemPImage(r, sub.XChannels, sub.XDataType)
+	if n := r.Dx() * SizeofPixel(sub.XChannels, sub.XDataType); compact.XStride != n {
+		t.Fatalf("bad compact stride: %d, expect = %d", compact.XStride, n)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(compact.rowPix(y), sub.rowPix(y))
+	}
+
+	for _, opt := range []*Options{nil, {UseSnappy: true}, {UseSnappy: true, BlockSize: 1000}} {
+		var buf0 bytes.Buffer
+		buf1 := &tWriteCounter{}
+		if err := Encode(&buf0, sub, opt); err != nil {
+			t.Fatal(err)
+		}
+		if err := Encode(buf1, compact, opt); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf0.Bytes(), buf1.Bytes()) {
+			t.Fatalf("%+v: SubImage and compact image are encoded differently", opt)
+		}
+
+		// the data of compact images is written with a single Write
+		h, err := DecodeHeader(bytes.NewReader(buf1.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := buf1.dataWrites(buf1.Len() - h.DataSize); n != 1 {
+			t.Fatalf("%+v: data is written in %d writes, expect = 1", opt, n)
+		}
+
+		m1, err := DecodeImage(&buf0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m1.Bounds() != r {
+			t.Fatalf("%+v: bounds = %v, expect = %v", opt, m1.Bounds(), r)
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			if !bytes.Equal(m1.rowPix(y), sub.rowPix(y)) {
+				t.Fatalf("%+v: row %d mismatch", opt, y)
+			}
+		}
+	}
+
+	// large images which are not compact are written in chunks
+	large := tLoadLargeImage("./testdata/lena.jpg")
+	sub = large.SubImage(large.Bounds().Inset(1)).(*MemPImage)
+	e := NewEncoder(nil)
+	if err := e.Encode(ioutil.Discard, sub); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sub.XPix); cap(e.pix) >= n {
+		t.Fatalf("uncompressed rows are buffered: %d bytes", cap(e.pix))
+	}
+}
+
+func TestEncodeAndDecode_origin(t *testing.T) {
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 3, 2),
+		image.Rect(100, 200, 103, 202),
+		image.Rect(-7, -1<<20, -4, -1<<20+2),
+	} {
+		m0 := NewMemPImage(r, 3, reflect.Uint16)
+		for i := range m0.XPix {
+			m0.XPix[i] = byte(i)
+		}
+		var buf bytes.Buffer
+		if err := Encode(&buf, m0, &Options{UseSnappy: true}); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		if b, err := DecodeBounds(bytes.NewReader(data)); err != nil || b != r {
+			t.Fatalf("DecodeBounds: expect = %v, got = %v, %v", r, b, err)
+		}
+		if cfg, err := DecodeConfig(bytes.NewReader(data)); err != nil || cfg.Width != r.Dx() || cfg.Height != r.Dy() {
+			t.Fatalf("DecodeConfig: got = %+v, %v", cfg, err)
+		}
+		m1, err := DecodeImage(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m1.Bounds() != r || !bytes.Equal(m1.XPix, m0.XPix) {
+			t.Fatalf("DecodeImage: bounds = %v, expect = %v", m1.Bounds(), r)
+		}
+		m2, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tCompareImage(t, m0, m2, r.String())
+	}
+
+	// files without origin are at (0, 0)
+	var buf bytes.Buffer
+	if err := Encode(&buf, NewMemPImage(image.Rect(0, 0, 2, 2), 1, reflect.Uint8), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := buf.Len(); n != rawpHeaderSize+4 {
+		t.Fatalf("zero origin: size = %v, expect = %v", n, rawpHeaderSize+4)
+	}
+
+	x := math.MaxInt32 - 2
+	if err := Encode(&buf, NewMemPImage(image.Rect(x, 0, x+3, 1), 1, reflect.Uint8), nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("origin overflow: expect = %v, got = %v", ErrUnsupported, err)
+	}
+}
+
+func TestDecodeInto_rowAlign(t *testing.T) {
+	m0 := NewMemPImageFrom(tLoadImage("./testdata/lena.jpg"))
+	m0 = m0.SubImage(image.Rect(0, 0, 101, 33)).(*MemPImage)
+	for _, opt := range []*Options{nil, {UseSnappy: true}, {UseSnappy: true, BlockSize: 1000}} {
+		var buf bytes.Buffer
+		if err := Encode(&buf, m0, opt); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		for _, align := range []int{1, 4, 16, 64} {
+			var m1 MemPImage
+			dopt := &DecodeOptions{RowAlign: align}
+			for i := 0; i < 2; i++ { // the second time reuses m1.XPix
+				if err := DecodeIntoWithOptions(bytes.NewReader(data), &m1, dopt); err != nil {
+					t.Fatal(err)
+				}
+				if m1.XStride%align != 0 || uintptr(unsafe.Pointer(&m1.XPix[0]))%uintptr(align) != 0 {
+					t.Fatalf("%+v, align = %d: stride = %d, not aligned", opt, align, m1.XStride)
+				}
+				tCompareImage(t, m0, &m1, fmt.Sprintf("%+v, align = %d", opt, align))
+			}
+
+			// aligned images encode like tight ones
+			var buf1 bytes.Buffer
+			if err := Encode(&buf1, &m1, opt); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf1.Bytes(), data) {
+				t.Fatalf("%+v, align = %d: encoded data mismatch", opt, align)
+			}
+		}
+	}
+
+	if _, err := DecodeImageWithOptions(bytes.NewReader(nil), &DecodeOptions{RowAlign: 3}); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("RowAlign = 3: expect = %v, got = %v", ErrUnsupported, err)
+	}
+}
+
+func TestEncodeAndDecode_half(t *testing.T) {
+	for _, v := range []struct {
+		kind     reflect.Kind
+		dataType int
+	}{
+		{Float16, rawpDataType_Float},
+		{BFloat16, rawpDataType_BFloat},
+	} {
+		m0 := NewMemPImage(image.Rect(0, 0, 5, 3), 3, v.kind)
+		for i := 0; i < 5*3*3; i++ {
+			m0.XPix.SetValue(i, v.kind, float64(i)/4-3)
+		}
+		for _, opt := range []*Options{nil, {UseSnappy: true}} {
+			var buf bytes.Buffer
+			if err := Encode(&buf, m0, opt); err != nil {
+				t.Fatal(err)
+			}
+			h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Depth != 16 || h.DataType != v.dataType || h.Kind != v.kind {
+				t.Fatalf("%s: Depth = %d, DataType = %d, Kind = %v", KindString(v.kind), h.Depth, h.DataType, h.Kind)
+			}
+			m1, err := DecodeImage(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m1.XDataType != v.kind || !bytes.Equal(m1.XPix, m0.XPix) {
+				t.Fatalf("%s: kind = %v, pixels differ", KindString(v.kind), m1.XDataType)
+			}
+			if x := m1.XPix.Value(5, v.kind); x != -1.75 {
+				t.Fatalf("%s: Value(5) = %v", KindString(v.kind), x)
+			}
+		}
+	}
+
+	// float needs 16 bits or more, bfloat exactly 16
+	var hdr rawpHeader
+	if err := rawpInitHeader(&hdr, 1, 1, 1, BFloat16, false); err != nil {
+		t.Fatal(err)
+	}
+	hdr.DataSize = 2
+	if err := rawpIsValidHeader(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct{ depth, dataType byte }{{32, rawpDataType_BFloat}, {8, rawpDataType_BFloat}, {8, rawpDataType_Float}} {
+		hdr.Depth, hdr.DataType, hdr.DataSize = v.depth, v.dataType, uint32(v.depth/8)
+		if err := rawpIsValidHeader(&hdr); !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("Depth %d, DataType %d: expect = %v, got = %v", v.depth, v.dataType, ErrUnsupported, err)
+		}
+	}
+}
+
+func TestEncodeAndDecode_complex(t *testing.T) {
+	for _, v := range []struct {
+		kind  reflect.Kind
+		depth int
+	}{
+		{reflect.Complex64, 64},
+		{reflect.Complex128, 128},
+	} {
+		m0 := NewMemPImage(image.Rect(0, 0, 5, 3), 1, v.kind)
+		for i := 0; i < 5*3; i++ {
+			z := complex(float64(i)*3, -float64(i)*4)
+			if v.kind == reflect.Complex64 {
+				m0.XPix.Complex64s()[i] = complex64(z)
+			} else {
+				m0.XPix.Complex128s()[i] = z
+			}
+		}
+		for _, opt := range []*Options{nil, {UseSnappy: true}} {
+			var buf bytes.Buffer
+			if err := Encode(&buf, m0, opt); err != nil {
+				t.Fatal(err)
+			}
+			h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Depth != v.depth || h.DataType != rawpDataType_Complex || h.Kind != v.kind {
+				t.Fatalf("%v: Depth = %d, DataType = %d, Kind = %v", v.kind, h.Depth, h.DataType, h.Kind)
+			}
+			m1, err := DecodeImage(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m1.XDataType != v.kind || !bytes.Equal(m1.XPix, m0.XPix) {
+				t.Fatalf("%v: kind = %v, pixels differ", v.kind, m1.XDataType)
+			}
+			// the magnitude of 6-8i is 10
+			if r, _, _, _ := m1.At(2, 0).RGBA(); r != 10 {
+				t.Fatalf("%v: At(2, 0) = %v", v.kind, m1.At(2, 0))
+			}
+		}
+	}
+
+	// complex needs 64 or 128 bits
+	var hdr rawpHeader
+	if err := rawpInitHeader(&hdr, 1, 1, 1, reflect.Complex128, false); err != nil {
+		t.Fatal(err)
+	}
+	hdr.DataSize = 16
+	if err := rawpIsValidHeader(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, depth := range []byte{8, 16, 32} {
+		hdr.Depth, hdr.DataSize = depth, uint32(depth/8)
+		if err := rawpIsValidHeader(&hdr); !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("Depth %d: expect = %v, got = %v", depth, ErrUnsupported, err)
+		}
+	}
+}
+
+func TestMemPColor_complex(t *testing.T) {
+	c := MemPColor{Channels: 3, DataType: reflect.Complex64, Pix: make(PixSlice, 3*8)}
+	copy(c.Pix.Complex64s(), []complex64{3 + 4i, -1e6, complex(float32(math.NaN()), 0)})
+	if r, g, b, a := c.RGBA(); r != 5 || g != 0xFFFF || b != 0 || a != 0xFFFF {
+		t.Fatalf("RGBA = %d, %d, %d, %d", r, g, b, a)
+	}
+}
+
+func TestEncodeAndDecode_packed(t *testing.T) {
+	for _, depth := range []int{1, 2, 4, 10, 12} {
+		packings := []Packing{PackingMSB}
+		if depth > 8 {
+			packings = append(packings, PackingMIPI)
+		}
+		kind := reflect.Uint8
+		if depth > 8 {
+			kind = reflect.Uint16
+		}
+		for _, packing := range packings {
+			for _, channels := range []int{1, 3} {
+				m0 := NewMemPImage(image.Rect(0, 0, 7, 6), channels, kind)
+				for i := 0; i < 7*6*channels; i++ {
+					m0.XPix.SetValue(i, kind, float64(i*37%(1<<uint(depth))))
+				}
+				sub := m0.SubImage(image.Rect(1, 1, 6, 5)).(*MemPImage)
+				sub.XDepth, sub.XPacking = depth, packing
+
+				for _, opt := range []*Options{nil, {UseSnappy: true}, {UseSnappy: true, BlockSize: 3}} {
+					name := fmt.Sprintf("%d bits %v, %d channels, %+v", depth, packing, channels, opt)
+					var buf bytes.Buffer
+					if err := Encode(&buf, sub, opt); err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+					h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+					if err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+					if h.Depth != depth || h.Packing != packing || h.Kind != kind {
+						t.Fatalf("%s: Depth = %d, Packing = %v, Kind = %v", name, h.Depth, h.Packing, h.Kind)
+					}
+					if size := (5*channels*depth + 7) / 8 * 4; opt == nil && packing == PackingMSB && h.DataSize != size {
+						t.Fatalf("%s: DataSize = %d, want %d", name, h.DataSize, size)
+					}
+					for _, dopt := range []*DecodeOptions{nil, {RowAlign: 16}} {
+						m1, err := DecodeImageWithOptions(bytes.NewReader(buf.Bytes()), dopt)
+						if err != nil {
+							t.Fatalf("%s: %v", name, err)
+						}
+						if m1.XDepth != depth || m1.XPacking != packing {
+							t.Fatalf("%s: XDepth = %d, XPacking = %v", name, m1.XDepth, m1.XPacking)
+						}
+						tCheckPixels(t, m1, sub)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncode_packedLayout(t *testing.T) {
+	tests := []struct {
+		depth   int
+		packing Packing
+		samples []int
+		expect  string
+	}{
+		{1, PackingMSB, []int{1, 0, 1, 1, 0, 0, 0, 0, 1}, "\xB0\x80"},
+		{2, PackingMSB, []int{3, 2, 1}, "\xE4"},
+		{4, PackingMSB, []int{0xA, 0xF, 0x1}, "\xAF\x10"},
+		{12, PackingMSB, []int{0xABC, 0x123, 0x456}, "\xAB\xC1\x23\x45\x60"},
+		{10, PackingMSB, []int{0x3FF, 0x001}, "\xFF\xC0\x10"},
+		{12, PackingMIPI, []int{0xABC, 0x123, 0x456}, "\xAB\x12\x3C\x45\x00\x06"},
+		{10, PackingMIPI, []int{0x3FF, 0x001, 0x2AA}, "\xFF\x00\xAA\x00\x27"},
+	}
+	for _, v := range tests {
+		kind := reflect.Uint8
+		if v.depth > 8 {
+			kind = reflect.Uint16
+		}
+		m := NewMemPImage(image.Rect(0, 0, len(v.samples), 1), 1, kind)
+		for i, x := range v.samples {
+			m.XPix.SetValue(i, kind, float64(x))
+		}
+		m.XDepth, m.XPacking = v.depth, v.packing
+
+		var buf bytes.Buffer
+		if err := Encode(&buf, m, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf.Bytes()[rawpHeaderSize:]); got != v.expect {
+			t.Fatalf("%d bits %v: expect = %q, got = %q", v.depth, v.packing, v.expect, got)
+		}
+		if flag := buf.Bytes()[15]&rawpFlag_MIPI != 0; flag != (v.packing == PackingMIPI) {
+			t.Fatalf("%d bits %v: MIPI flag = %v", v.depth, v.packing, flag)
+		}
+	}
+}
+
+func TestEncodeAndDecode_packedErrors(t *testing.T) {
+	for _, v := range []struct {
+		kind    reflect.Kind
+		depth   int
+		packing Packing
+	}{
+		{reflect.Uint8, 12, PackingMSB},
+		{reflect.Uint16, 4, PackingMSB},
+		{reflect.Float32, 12, PackingMSB},
+		{reflect.Uint8, 4, PackingMIPI},
+		{reflect.Uint16, 12, Packing(5)},
+		{reflect.Uint16, 0, PackingMIPI},
+		{reflect.Uint16, 16, PackingMIPI},
+		{reflect.Uint8, 2, PackingMIPI},
+		{reflect.Uint16, 0, Packing(5)},
+	} {
+		m := NewMemPImage(image.Rect(0, 0, 2, 2), 1, v.kind)
+		m.XDepth, m.XPacking = v.depth, v.packing
+		if err := Encode(new(bytes.Buffer), m, nil); !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("%v %d bits %v: expect = %v, got = %v", v.kind, v.depth, v.packing, ErrUnsupported, err)
+		}
+	}
+
+	// samples must fit in the depth
+	for _, packing := range []Packing{PackingMSB, PackingMIPI} {
+		m := NewMemPImage(image.Rect(0, 0, 2, 2), 1, reflect.Uint16)
+		m.XDepth, m.XPacking = 12, packing
+		m.XPix.Uint16s()[3] = 4096
+		var fe *FormatError
+		if err := Encode(new(bytes.Buffer), m, nil); !errors.Is(err, ErrUnsupported) || !errors.As(err, &fe) || fe.Field != "Depth" {
+			t.Fatalf("12 bits %v, sample 4096: expect = %v, got = %v", packing, ErrUnsupported, err)
+		}
+		m.XPix.Uint16s()[3] = 4095
+		if err := Encode(new(bytes.Buffer), m, nil); err != nil {
+			t.Fatalf("12 bits %v, sample 4095: %v", packing, err)
+		}
+	}
+	m := NewMemPImage(image.Rect(0, 0, 3, 1), 1, reflect.Uint8)
+	m.XDepth, m.XPix[2] = 2, 4
+	if err := Encode(new(bytes.Buffer), m, nil); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("2 bits, sample 4: expect = %v, got = %v", ErrUnsupported, err)
+	}
+
+	// the full depth of the kind is not packed
+	m = NewMemPImage(image.Rect(0, 0, 2, 2), 1, reflect.Uint16)
+	m.XDepth = 16
+	if err := Encode(new(bytes.Buffer), m, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var hdr rawpHeader
+	if err := rawpInitHeader(&hdr, 3, 1, 1, reflect.Uint16, false); err != nil {
+		t.Fatal(err)
+	}
+	hdr.Depth, hdr.DataSize = 12, 5
+	if err := rawpIsValidHeader(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		depth, dataType byte
+		packing         Packing
+		dataSize        uint32
+		expect          error
+	}{
+		{12, rawpDataType_Float, PackingMSB, 5, ErrUnsupported},
+		{4, rawpDataType_UInt, PackingMIPI, 2, ErrUnsupported},
+		{12, rawpDataType_UInt, PackingMSB, 6, ErrFormat},
+		{12, rawpDataType_UInt, PackingMIPI, 5, ErrFormat},
+		{3, rawpDataType_UInt, PackingMSB, 2, ErrFormat},
+	} {
+		hdr.Depth, hdr.DataType, hdr.Packing, hdr.DataSize = v.depth, v.dataType, v.packing, v.dataSize
+		if err := rawpIsValidHeader(&hdr); !errors.Is(err, v.expect) {
+			t.Fatalf("%+v: expect = %v, got = %v", v, v.expect, err)
+		}
+	}
+}
@@ -7,9 +7,9 @@ package rawp
 import (
 	"image"
 	"io"
-	"io/ioutil"
 	"os"
 	"reflect"
+	"sync"
 )
 
 func LoadConfig(name string) (config image.Config, err error) {
@@ -39,19 +39,26 @@ func LoadImage(name string) (m *MemPImage, err error) {
 	return DecodeImage(f)
 }
 
+// DecodeOptions are the decoding parameters. The limits are checked before
+// the image data is allocated, images over a limit fail with ErrTooLarge.
+type DecodeOptions struct {
+	MaxPixels int // max Width*Height, 0 for no limit
+	MaxBytes  int // max size of the image data, 0 for no limit
+
+	// RowAlign, if greater than 1, aligns the rows and the first pixel of
+	// decoded images like NewMemPImageAligned. It must be a power of two.
+	RowAlign int
+}
+
 // DecodeConfig returns the color model and dimensions of a RawP image without
 // decoding the entire image.
 func DecodeConfig(r io.Reader) (config image.Config, err error) {
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
-		return
-	}
-	hdr, err := rawpDecodeHeader(data)
-	if err != nil {
+	var hdr rawpHeader
+	if err = rawpReadHeader(r, &hdr, nil); err != nil {
 		return
 	}
 
-	model, err := rawpColorModel(hdr)
+	model, err := rawpColorModel(&hdr)
 	if err != nil {
 		return
 	}
@@ -64,25 +71,84 @@ func DecodeConfig(r io.Reader) (config image.Config, err error) {
 	return
 }
 
+// DecodeBounds returns the bounds of a RawP image without decoding the
+// entire image. Unlike image.Config, they hold the origin of the image.
+func DecodeBounds(r io.Reader) (bounds image.Rectangle, err error) {
+	var hdr rawpHeader
+	if err = rawpReadHeader(r, &hdr, nil); err != nil {
+		return
+	}
+	bounds = image.Rectangle{hdr.Origin, hdr.Origin.Add(image.Pt(int(hdr.Width), int(hdr.Height)))}
+	return
+}
+
+// Header holds the header fields of a RawP image, see the package doc.
+type Header struct {
+	Sig          string
+	Magic        uint32
+	Width        int
+	Height       int
+	Channels     int
+	Depth        int
+	DataType     int // 1=Uint, 2=Int, 3=Float, 4=BFloat, 5=Complex
+	UseSnappy    int // 0=disabled, 1=enabled, 2=blocks
+	DataSize     int
+	DataCheckSum uint32
+
+	Packing    Packing    // layout of packed depths (1, 2, 4, 10, 12)
+	YUV        YUVLayout  // layout of YUV frames
+	CFA        CFA        // raw sensor data, from the header extensions
+	ColorSpace ColorSpace // from the header extensions
+
+	MinX, MinY int          // origin, from the header extensions
+	Kind       reflect.Kind // Go kind of the samples
+}
+
+// DecodeHeader reads and checks the header of a RawP image from r.
+// The image data is not read.
+func DecodeHeader(r io.Reader) (h *Header, err error) {
+	var hdr rawpHeader
+	if err = rawpReadHeader(r, &hdr, nil); err != nil {
+		return
+	}
+	h = &Header{
+		Sig:          string(hdr.Sig[:]),
+		Magic:        hdr.Magic,
+		Width:        int(hdr.Width),
+		Height:       int(hdr.Height),
+		Channels:     int(hdr.Channels),
+		Depth:        int(hdr.Depth),
+		DataType:     int(hdr.DataType),
+		UseSnappy:    int(hdr.UseSnappy),
+		DataSize:     int(hdr.DataSize),
+		DataCheckSum: hdr.DataCheckSum,
+		Packing:      hdr.Packing,
+		YUV:          hdr.YUV,
+		CFA:          hdr.CFA,
+		ColorSpace:   hdr.ColorSpace,
+		MinX:         hdr.Origin.X,
+		MinY:         hdr.Origin.Y,
+		Kind:         rawpDataType(hdr.Depth, hdr.DataType),
+	}
+	return
+}
+
 // Decode reads a RawP image from r and returns it as an image.Image.
 // The type of Image returned depends on the contents of the RawP.
 func Decode(r io.Reader) (m image.Image, err error) {
-	data, err := ioutil.ReadAll(r)
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions is like Decode, with the options opt. YUV frames are
+// returned as *image.YCbCr.
+func DecodeWithOptions(r io.Reader, opt *DecodeOptions) (m image.Image, err error) {
+	p, yuv := new(MemPImage), new(YUVImage)
+	isYUV, err := rawpDecodeInto(r, p, yuv, opt)
 	if err != nil {
 		return
 	}
-	hdr, err := rawpDecodeHeader(data)
-	if err != nil {
-		return
-	}
-
-	p := &MemPImage{
-		XMemPMagic: MemPMagic,
-		XRect:      image.Rect(0, 0, int(hdr.Width), int(hdr.Height)),
-		XStride:    int(hdr.Width) * int(hdr.Channels) * SizeofKind(rawpDataType(hdr.Depth, hdr.DataType)),
-		XChannels:  int(hdr.Channels),
-		XDataType:  rawpDataType(hdr.Depth, hdr.DataType),
-		XPix:       hdr.Data,
+	if isYUV {
+		return yuv.StdImage(), nil
 	}
 
 	if p.XChannels == 1 && p.XDataType == reflect.Uint8 {
@@ -127,22 +193,149 @@ func Decode(r io.Reader) (m image.Image, err error) {
 // DecodeImage reads a RawP image from r and returns it as an Image.
 // The type of Image returned depends on the contents of the RawP.
 func DecodeImage(r io.Reader) (m *MemPImage, err error) {
-	data, err := ioutil.ReadAll(r)
-	if err != nil {
+	return DecodeImageWithOptions(r, nil)
+}
+
+// DecodeImageWithOptions is like DecodeImage, with the options opt.
+func DecodeImageWithOptions(r io.Reader, opt *DecodeOptions) (m *MemPImage, err error) {
+	m = new(MemPImage)
+	if err = DecodeIntoWithOptions(r, m, opt); err != nil {
+		return nil, err
+	}
+	return
+}
+
+type decoderState struct {
+	hdr rawpHeader
+	buf []byte // compressed image data
+	pix []byte // image data before row alignment
+}
+
+var decoderStatePool = sync.Pool{
+	New: func() interface{} {
+		return new(decoderState)
+	},
+}
+
+// DecodeInto reads a RawP image from r into dst.
+//
+// All fields of dst are overwritten. dst.XPix is reused (and its old
+// content lost) if it has enough capacity, so decoding a stream of same
+// sized frames into the same dst does not allocate.
+func DecodeInto(r io.Reader, dst *MemPImage) (err error) {
+	return DecodeIntoWithOptions(r, dst, nil)
+}
+
+// DecodeIntoWithOptions is like DecodeInto, with the options opt. YUV
+// frames are converted to 3 channel Uint8 RGB.
+//
+// Only the header and hdr.DataSize bytes of image data are read from r,
+// so images can be decoded one after another from the same stream.
+func DecodeIntoWithOptions(r io.Reader, dst *MemPImage, opt *DecodeOptions) (err error) {
+	_, err = rawpDecodeInto(r, dst, nil, opt)
+	return
+}
+
+// rawpDecodeInto reads a RawP image from r into dst, or into yuv if it is
+// a YUV frame and yuv is not nil. With a nil dst, other images fail.
+func rawpDecodeInto(r io.Reader, dst *MemPImage, yuv *YUVImage, opt *DecodeOptions) (isYUV bool, err error) {
+	d := decoderStatePool.Get().(*decoderState)
+	defer decoderStatePool.Put(d)
+
+	align := 0
+	if opt != nil {
+		if align = opt.RowAlign; align > 1 && !isPowerOfTwo(align) {
+			return false, errUnsupported("RowAlign", align)
+		}
+	}
+
+	hdr := &d.hdr
+	if err = rawpReadHeader(r, hdr, opt); err != nil {
 		return
 	}
-	hdr, err := rawpDecodeHeader(data)
+	if isYUV = hdr.YUV != YUVNone && yuv != nil; !isYUV && dst == nil {
+		return false, errUnsupported("YUV", hdr.YUV)
+	}
+	dataType := rawpDataType(hdr.Depth, hdr.DataType)
+	rowSize := int(hdr.Width) * int(hdr.Channels) * SizeofKind(dataType)
+
+	// decode into buf, which is dst.XPix if the rows need no padding
+	packed := rawpIsPackedDepth(hdr.Depth) || hdr.YUV != YUVNone
+	stride, buf := rowSize, []byte(nil)
+	switch {
+	case isYUV:
+		// the planes are returned, not a pooled buffer
+	case packed:
+		if align > 1 {
+			stride = alignedStride(rowSize, SizeofKind(dataType), align)
+		}
+		buf = d.pix
+	case align > 1:
+		if stride = alignedStride(rowSize, SizeofKind(dataType), align); stride == rowSize {
+			buf = alignedBytes(dst.XPix, rawpImageDataSize(hdr), align)
+		} else {
+			buf = d.pix
+		}
+	default:
+		buf = dst.XPix
+	}
+
+	var data, pix []byte
+	if hdr.UseSnappy == rawpUseSnappy_Disabled {
+		// read in place, rawpReadHeader checked DataSize == size
+		data, err = rawpReadData(r, hdr, buf)
+	} else {
+		if data, err = rawpReadData(r, hdr, d.buf); err == nil {
+			d.buf = data
+		}
+	}
 	if err != nil {
 		return
 	}
+	if pix, err = rawpDecodeData(hdr, data, buf); err != nil {
+		return
+	}
+	if isYUV {
+		*yuv = *rawpYUVImage(hdr, pix)
+		return
+	}
+
+	switch {
+	case packed:
+		d.pix = pix
+		out := growBytes(dst.XPix, int(hdr.Height)*stride)
+		if align > 1 {
+			out = alignedBytes(dst.XPix, int(hdr.Height)*stride, align)
+		}
+		if hdr.YUV != YUVNone {
+			rawpYUVImage(hdr, pix).rgbPix(out, stride)
+		} else {
+			rawpUnpack(hdr, out, stride, pix)
+		}
+		pix = out
+	case stride != rowSize:
+		d.pix = pix
+		out := alignedBytes(dst.XPix, int(hdr.Height)*stride, align)
+		for y := 0; y < int(hdr.Height); y++ {
+			copy(out[y*stride:][:rowSize], pix[y*rowSize:])
+		}
+		pix = out
+	}
 
-	m = &MemPImage{
+	*dst = MemPImage{
 		XMemPMagic: MemPMagic,
-		XRect:      image.Rect(0, 0, int(hdr.Width), int(hdr.Height)),
-		XStride:    int(hdr.Width) * int(hdr.Channels) * SizeofKind(rawpDataType(hdr.Depth, hdr.DataType)),
+		XRect:      image.Rectangle{hdr.Origin, hdr.Origin.Add(image.Pt(int(hdr.Width), int(hdr.Height)))},
+		XStride:    stride,
 		XChannels:  int(hdr.Channels),
-		XDataType:  rawpDataType(hdr.Depth, hdr.DataType),
-		XPix:       hdr.Data,
+		XDataType:  dataType,
+		XPix:       pix,
+		XCFA:       hdr.CFA,
+
+		XColorSpace: hdr.ColorSpace,
+	}
+	if rawpIsPackedDepth(hdr.Depth) {
+		dst.XDepth = int(hdr.Depth)
+		dst.XPacking = hdr.Packing
 	}
 	return
 }
@@ -0,0 +1,442 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Sequence files (Little Endian) record RawP frames with timestamps:
+//
+//	type RawPSequence struct {
+//		Sig    [4]byte // 4Bytes, RAWS
+//		Magic  uint32  // 4Bytes, 0x3680341F, CRC32("RAWS")
+//		Frames [?]struct {
+//			Tag   [4]byte    // 4Bytes, FRME
+//			Time  int64      // 8Bytes, nanoseconds since the Unix epoch
+//			Size  uint32     // 4Bytes, size of Image
+//			Image [Size]byte // RawP image
+//		}
+//		Index struct { // written by SequenceWriter.Close
+//			Tag     [4]byte // 4Bytes, SIDX
+//			Count   uint32  // 4Bytes, number of frames
+//			Entries [Count]struct {
+//				Offset int64 // 8Bytes, offset of the frame
+//				Time   int64 // 8Bytes, time of the frame
+//			}
+//			CheckSum uint32  // 4Bytes, CRC32(Count, Entries)
+//			Size     uint32  // 4Bytes, size of Index
+//			End      [4]byte // 4Bytes, SEND
+//		}
+//	}
+//
+// Each frame is appended with a single write. Without a valid index, as
+// after a crash, the reader finds the frames by scanning them and drops a
+// truncated last frame.
+const (
+	rawpSeqSig   = "RAWS"
+	rawpSeqMagic = 0x3680341F // CRC32("RAWS")
+
+	rawpSeqTag_Frame = "FRME"
+	rawpSeqTag_Index = "SIDX"
+	rawpSeqTag_End   = "SEND"
+
+	rawpSeqHeaderSize      = 8
+	rawpSeqFrameHeaderSize = 16
+	rawpSeqIndexEntrySize  = 16
+	rawpSeqIndexSize       = 20 // without the entries
+	rawpSeqMaxFrameSize    = 1<<32 - 1
+)
+
+// rawpSeqEntry is a frame of a sequence file.
+type rawpSeqEntry struct {
+	Offset int64 // offset of the frame header
+	Size   int64 // size of the RawP image
+	Time   int64
+}
+
+// SequenceWriter appends RawP frames with timestamps to a sequence file.
+//
+// A SequenceWriter must not be used by multiple goroutines at the same time.
+type SequenceWriter struct {
+	w      io.Writer
+	closer io.Closer
+	enc    *Encoder
+	buf    bytes.Buffer
+	off    int64
+	index  []rawpSeqEntry
+	err    error
+}
+
+// CreateSequence creates the sequence file name, frames are encoded with
+// the options opt (nil for default). Close writes the index and closes
+// the file.
+func CreateSequence(name string, opt *Options) (s *SequenceWriter, err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if s, err = NewSequenceWriter(f, opt); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.closer = f
+	return s, nil
+}
+
+// NewSequenceWriter writes the header of a sequence file to w and returns
+// a writer for its frames, encoded with the options opt (nil for default).
+func NewSequenceWriter(w io.Writer, opt *Options) (*SequenceWriter, error) {
+	var hdr [rawpSeqHeaderSize]byte
+	copy(hdr[:], rawpSeqSig)
+	binary.LittleEndian.PutUint32(hdr[4:], rawpSeqMagic)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &SequenceWriter{
+		w:   w,
+		enc: NewEncoder(opt),
+		off: rawpSeqHeaderSize,
+	}, nil
+}
+
+// WriteFrame appends the image m with the time t. Times must not
+// decrease from frame to frame.
+func (s *SequenceWriter) WriteFrame(m image.Image, t time.Time) error {
+	if s.err != nil {
+		return s.err
+	}
+	ns := t.UnixNano()
+	if n := len(s.index); n > 0 && ns < s.index[n-1].Time {
+		return errUnsupported("Time", t)
+	}
+
+	var hdr [rawpSeqFrameHeaderSize]byte
+	s.buf.Reset()
+	s.buf.Write(hdr[:])
+	if err := s.enc.Encode(&s.buf, m); err != nil {
+		return err
+	}
+	data := s.buf.Bytes()
+	size := len(data) - rawpSeqFrameHeaderSize
+	if size > rawpSeqMaxFrameSize {
+		return &FormatError{Field: "Frame", Got: size, Want: rawpSeqMaxFrameSize, Err: ErrTooLarge}
+	}
+	copy(data, rawpSeqTag_Frame)
+	binary.LittleEndian.PutUint64(data[4:], uint64(ns))
+	binary.LittleEndian.PutUint32(data[12:], uint32(size))
+
+	if _, err := s.w.Write(data); err != nil {
+		s.err = err
+		return err
+	}
+	s.index = append(s.index, rawpSeqEntry{Offset: s.off, Size: int64(size), Time: ns})
+	s.off += int64(len(data))
+	return nil
+}
+
+// Len returns the number of frames written.
+func (s *SequenceWriter) Len() int {
+	return len(s.index)
+}
+
+// Close writes the index, and closes the file of CreateSequence. After a
+// failed write, the index is not written, and Close returns the error of
+// the first failed write.
+func (s *SequenceWriter) Close() (err error) {
+	if err = s.err; err == nil {
+		if _, err = s.w.Write(rawpAppendSeqIndex(nil, s.index)); err != nil {
+			s.err = err
+		} else {
+			s.err = fmt.Errorf("rawp: sequence writer is closed")
+		}
+	}
+	if s.closer != nil {
+		if err1 := s.closer.Close(); err == nil {
+			err = err1
+		}
+		s.closer = nil
+	}
+	return
+}
+
+// rawpAppendSeqIndex appends the index of the frames to buf.
+func rawpAppendSeqIndex(buf []byte, index []rawpSeqEntry) []byte {
+	start := len(buf)
+	buf = append(buf, rawpSeqTag_Index...)
+	buf = appendUint32(buf, uint32(len(index)))
+	for _, e := range index {
+		buf = appendUint64(buf, uint64(e.Offset))
+		buf = appendUint64(buf, uint64(e.Time))
+	}
+	buf = appendUint32(buf, crc32.ChecksumIEEE(buf[start+4:]))
+	buf = appendUint32(buf, uint32(len(buf)-start+8))
+	return append(buf, rawpSeqTag_End...)
+}
+
+// SequenceReader reads the frames of a sequence file, in order from the
+// current frame, or by random access.
+//
+// A SequenceReader must not be used by multiple goroutines at the same time.
+type SequenceReader struct {
+	// Options are the options to decode the frames, nil for default.
+	Options *DecodeOptions
+
+	r         io.ReaderAt
+	closer    io.Closer
+	index     []rawpSeqEntry
+	pos       int
+	recovered bool
+}
+
+// OpenSequence opens the sequence file name. Close closes it.
+func OpenSequence(name string) (s *SequenceReader, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		s, err = NewSequenceReader(f, fi.Size())
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.closer = f
+	return s, nil
+}
+
+// NewSequenceReader returns a reader of the sequence file r, of size
+// bytes. The frames are listed by the index, or by scanning the file if
+// it has no valid index.
+func NewSequenceReader(r io.ReaderAt, size int64) (*SequenceReader, error) {
+	var hdr [rawpSeqHeaderSize]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		if err == io.EOF {
+			return nil, &FormatError{Field: "Sig", Got: size, Want: rawpSeqHeaderSize, Err: ErrTruncated}
+		}
+		return nil, err
+	}
+	if string(hdr[:4]) != rawpSeqSig {
+		return nil, &FormatError{Field: "Sig", Got: string(hdr[:4]), Want: rawpSeqSig, Err: ErrFormat}
+	}
+	if v := binary.LittleEndian.Uint32(hdr[4:]); v != rawpSeqMagic {
+		return nil, &FormatError{Field: "Magic", Got: v, Want: uint32(rawpSeqMagic), Err: ErrFormat}
+	}
+
+	s := &SequenceReader{r: r}
+	index, err := rawpReadSeqIndex(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		if index, err = rawpScanSeq(r, size); err != nil {
+			return nil, err
+		}
+		s.recovered = true
+	}
+	s.index = index
+	return s, nil
+}
+
+// rawpReadSeqIndex reads the index at the end of the sequence file r. It
+// returns nil, and no error, if the file has no valid index.
+func rawpReadSeqIndex(r io.ReaderAt, size int64) ([]rawpSeqEntry, error) {
+	var end [8]byte
+	if size < rawpSeqHeaderSize+rawpSeqIndexSize {
+		return nil, nil
+	}
+	if _, err := r.ReadAt(end[:], size-8); err != nil {
+		return nil, err
+	}
+	n := int64(binary.LittleEndian.Uint32(end[:]))
+	if string(end[4:]) != rawpSeqTag_End || n < rawpSeqIndexSize || n > size-rawpSeqHeaderSize || (n-rawpSeqIndexSize)%rawpSeqIndexEntrySize != 0 {
+		return nil, nil
+	}
+	start := size - n
+	data := make([]byte, n)
+	if _, err := r.ReadAt(data, start); err != nil {
+		return nil, err
+	}
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	entries := data[8 : n-12]
+	if string(data[:4]) != rawpSeqTag_Index || count != len(entries)/rawpSeqIndexEntrySize {
+		return nil, nil
+	}
+	if crc32.ChecksumIEEE(data[4:n-12]) != binary.LittleEndian.Uint32(data[n-12:]) {
+		return nil, nil
+	}
+
+	index := make([]rawpSeqEntry, count)
+	for i := range index {
+		v := entries[i*rawpSeqIndexEntrySize:]
+		index[i].Offset = int64(binary.LittleEndian.Uint64(v[0:]))
+		index[i].Time = int64(binary.LittleEndian.Uint64(v[8:]))
+	}
+	// the frames fill the file up to the index, in order
+	for i := range index {
+		next := start
+		if i+1 < count {
+			next = index[i+1].Offset
+		}
+		if i == 0 && index[i].Offset != rawpSeqHeaderSize {
+			return nil, nil
+		}
+		if i > 0 && index[i].Time < index[i-1].Time {
+			return nil, nil
+		}
+		if index[i].Size = next - index[i].Offset - rawpSeqFrameHeaderSize; index[i].Size <= 0 {
+			return nil, nil
+		}
+	}
+	if count == 0 && start != rawpSeqHeaderSize {
+		return nil, nil
+	}
+	return index, nil
+}
+
+// rawpScanSeq lists the frames of the sequence file r from their headers,
+// up to the index, or up to the first truncated or bad frame.
+func rawpScanSeq(r io.ReaderAt, size int64) ([]rawpSeqEntry, error) {
+	var index []rawpSeqEntry
+	var hdr [rawpSeqFrameHeaderSize]byte
+	for off := int64(rawpSeqHeaderSize); off+rawpSeqFrameHeaderSize <= size; {
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return nil, err
+		}
+		e := rawpSeqEntry{
+			Offset: off,
+			Size:   int64(binary.LittleEndian.Uint32(hdr[12:])),
+			Time:   int64(binary.LittleEndian.Uint64(hdr[4:])),
+		}
+		if string(hdr[:4]) != rawpSeqTag_Frame || e.Size == 0 || off+rawpSeqFrameHeaderSize+e.Size > size {
+			break
+		}
+		if n := len(index); n > 0 && e.Time < index[n-1].Time {
+			break
+		}
+		index = append(index, e)
+		off += rawpSeqFrameHeaderSize + e.Size
+	}
+	return index, nil
+}
+
+// Len returns the number of frames.
+func (s *SequenceReader) Len() int {
+	return len(s.index)
+}
+
+// Recovered reports whether the file had no valid index, so the frames
+// were found by scanning it.
+func (s *SequenceReader) Recovered() bool {
+	return s.recovered
+}
+
+// Time returns the time of frame i.
+func (s *SequenceReader) Time(i int) time.Time {
+	return time.Unix(0, s.index[i].Time)
+}
+
+// Frame returns the RawP image of frame i, to be read with DecodeHeader,
+// DecodeYUV and the like, and its time.
+func (s *SequenceReader) Frame(i int) (r *io.SectionReader, t time.Time) {
+	e := s.index[i]
+	return io.NewSectionReader(s.r, e.Offset+rawpSeqFrameHeaderSize, e.Size), time.Unix(0, e.Time)
+}
+
+// Pos returns the current frame, Len() after the last frame.
+func (s *SequenceReader) Pos() int {
+	return s.pos
+}
+
+// Seek makes frame the current frame, 0 <= frame <= Len().
+func (s *SequenceReader) Seek(frame int) error {
+	if frame < 0 || frame > len(s.index) {
+		return fmt.Errorf("rawp: frame %d out of range [0, %d]", frame, len(s.index))
+	}
+	s.pos = frame
+	return nil
+}
+
+// SeekTime makes the frame shown at time t the current frame, which is
+// the last frame at or before t, or the first frame if all are after t.
+// It returns the frame.
+func (s *SequenceReader) SeekTime(t time.Time) (frame int, err error) {
+	if len(s.index) == 0 {
+		return 0, io.EOF
+	}
+	ns := t.UnixNano()
+	frame = sort.Search(len(s.index), func(i int) bool {
+		return s.index[i].Time > ns
+	}) - 1
+	if frame < 0 {
+		frame = 0
+	}
+	s.pos = frame
+	return frame, nil
+}
+
+// Next decodes the current frame and moves to the next one. At the end
+// it returns io.EOF.
+func (s *SequenceReader) Next() (m *MemPImage, t time.Time, err error) {
+	m = new(MemPImage)
+	if t, err = s.NextInto(m); err != nil {
+		return nil, t, err
+	}
+	return
+}
+
+// NextInto is like Next, decoding into dst like DecodeInto.
+func (s *SequenceReader) NextInto(dst *MemPImage) (t time.Time, err error) {
+	if s.pos >= len(s.index) {
+		return t, io.EOF
+	}
+	if err = s.checkFrame(s.pos); err != nil {
+		return
+	}
+	r, t := s.Frame(s.pos)
+	if err = DecodeIntoWithOptions(r, dst, s.Options); err != nil {
+		return
+	}
+	s.pos++
+	return
+}
+
+// checkFrame checks the frame header of frame i against the index.
+func (s *SequenceReader) checkFrame(i int) error {
+	var hdr [rawpSeqFrameHeaderSize]byte
+	e := s.index[i]
+	if _, err := s.r.ReadAt(hdr[:], e.Offset); err != nil {
+		if err == io.EOF {
+			return &FormatError{Field: "Frame", Got: i, Err: ErrTruncated}
+		}
+		return err
+	}
+	if string(hdr[:4]) != rawpSeqTag_Frame ||
+		int64(binary.LittleEndian.Uint32(hdr[12:])) != e.Size ||
+		int64(binary.LittleEndian.Uint64(hdr[4:])) != e.Time {
+		return errFormat("Frame", i)
+	}
+	return nil
+}
+
+// Close closes the file of OpenSequence.
+func (s *SequenceReader) Close() error {
+	if s.closer != nil {
+		c := s.closer
+		s.closer = nil
+		return c.Close()
+	}
+	return nil
+}
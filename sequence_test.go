@@ -0,0 +1,286 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var tSeqTime0 = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// tWriteSeq writes n frames, 40ms apart, and returns the file data.
+func tWriteSeq(t *testing.T, n int, opt *Options) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	s, err := NewSequenceWriter(&buf, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := s.WriteFrame(tSeqFrame(i), tSeqTime0.Add(time.Duration(i)*40*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Len() != n {
+		t.Fatalf("Len = %d, want %d", s.Len(), n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tSeqFrame(i int) *MemPImage {
+	m := NewMemPImage(image.Rect(0, 0, 6+i%3, 4), 1, reflect.Uint16)
+	for j := range m.XPix.Uint16s() {
+		m.XPix.Uint16s()[j] = uint16(i*1000 + j)
+	}
+	return m
+}
+
+// tCheckSeq reads all frames of s from the current one, which must be
+// frame first.
+func tCheckSeq(t *testing.T, s *SequenceReader, first, n int) {
+	t.Helper()
+	for i := first; i < n; i++ {
+		m, ts, err := s.Next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if want := tSeqTime0.Add(time.Duration(i) * 40 * time.Millisecond); !ts.Equal(want) {
+			t.Fatalf("frame %d: time = %v, want %v", i, ts, want)
+		}
+		tCheckPixels(t, m, tSeqFrame(i))
+	}
+	if _, _, err := s.Next(); err != io.EOF {
+		t.Fatalf("Next at the end: expect = %v, got = %v", io.EOF, err)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	for _, opt := range []*Options{nil, {UseSnappy: true}} {
+		data := tWriteSeq(t, 10, opt)
+		s, err := NewSequenceReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Len() != 10 || s.Recovered() {
+			t.Fatalf("Len = %d, Recovered = %v", s.Len(), s.Recovered())
+		}
+		tCheckSeq(t, s, 0, 10)
+
+		if err := s.Seek(7); err != nil {
+			t.Fatal(err)
+		}
+		tCheckSeq(t, s, 7, 10)
+		if err := s.Seek(11); err == nil {
+			t.Fatal("Seek(11): expect an error")
+		}
+
+		for _, v := range []struct {
+			d     time.Duration
+			frame int
+		}{
+			{-time.Second, 0},
+			{0, 0},
+			{39 * time.Millisecond, 0},
+			{120 * time.Millisecond, 3},
+			{130 * time.Millisecond, 3},
+			{time.Hour, 9},
+		} {
+			frame, err := s.SeekTime(tSeqTime0.Add(v.d))
+			if err != nil || frame != v.frame || s.Pos() != v.frame {
+				t.Fatalf("SeekTime(%v) = %d, %v, want %d", v.d, frame, err, v.frame)
+			}
+		}
+		tCheckSeq(t, s, 9, 10)
+
+		r, ts := s.Frame(4)
+		h, err := DecodeHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Width != 7 || !ts.Equal(s.Time(4)) {
+			t.Fatalf("Frame(4): width = %d, time = %v", h.Width, ts)
+		}
+	}
+}
+
+func TestSequence_recover(t *testing.T) {
+	data := tWriteSeq(t, 5, &Options{UseSnappy: true})
+	s, err := NewSequenceReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := s.Frame(4)
+	end := int(r.Size()) + 16 + int(s.index[4].Offset)
+
+	for _, v := range []struct {
+		name string
+		data []byte
+		n    int
+	}{
+		{"no index", data[:end], 5},
+		{"truncated index", data[:len(data)-3], 5},
+		{"truncated frame", data[:end-1], 4},
+		{"truncated frame header", data[:int(s.index[4].Offset)+5], 4},
+		{"header only", data[:rawpSeqHeaderSize], 0},
+		{"bad index", tSeqCorrupt(data, len(data)-20), 5},
+		{"bad frame tag", tSeqCorrupt(data[:end], int(s.index[2].Offset)), 2},
+	} {
+		s, err := NewSequenceReader(bytes.NewReader(v.data), int64(len(v.data)))
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if s.Len() != v.n || !s.Recovered() {
+			t.Fatalf("%s: Len = %d, Recovered = %v, want %d", v.name, s.Len(), s.Recovered(), v.n)
+		}
+		tCheckSeq(t, s, 0, v.n)
+	}
+
+	// an empty sequence has an index
+	data = tWriteSeq(t, 0, nil)
+	if s, err = NewSequenceReader(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 0 || s.Recovered() {
+		t.Fatalf("empty: Len = %d, Recovered = %v", s.Len(), s.Recovered())
+	}
+	if _, err := s.SeekTime(tSeqTime0); err != io.EOF {
+		t.Fatalf("SeekTime: expect = %v, got = %v", io.EOF, err)
+	}
+}
+
+// tSeqCorrupt returns a copy of data with the byte at i changed.
+func tSeqCorrupt(data []byte, i int) []byte {
+	data = append([]byte(nil), data...)
+	data[i] ^= 0xff
+	return data
+}
+
+func TestSequence_errors(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := NewSequenceWriter(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFrame(tSeqFrame(0), tSeqTime0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFrame(tSeqFrame(1), tSeqTime0.Add(-time.Millisecond)); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("decreasing time: expect = %v, got = %v", ErrUnsupported, err)
+	}
+	if err := s.WriteFrame(NewMemPImage(image.Rect(0, 0, 0, 0), 1, reflect.Uint8), tSeqTime0); !errors.Is(err, ErrFormat) {
+		t.Fatalf("empty image: expect = %v, got = %v", ErrFormat, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFrame(tSeqFrame(1), tSeqTime0); err == nil {
+		t.Fatal("WriteFrame after Close: expect an error")
+	}
+
+	data := buf.Bytes()
+	if sr, err := NewSequenceReader(bytes.NewReader(data), int64(len(data))); err != nil || sr.Len() != 1 {
+		t.Fatalf("Len = %v, %v", sr, err)
+	}
+	for _, v := range [][]byte{data[:3], tSeqCorrupt(data, 0), tSeqCorrupt(data, 5)} {
+		if _, err := NewSequenceReader(bytes.NewReader(v), int64(len(v))); !errors.Is(err, ErrFormat) && !errors.Is(err, ErrTruncated) {
+			t.Fatalf("expect = %v, got = %v", ErrFormat, err)
+		}
+	}
+
+	// a corrupted frame fails to decode, and stays the current frame
+	data = tSeqCorrupt(data, len(data)-rawpSeqIndexSize-rawpSeqIndexEntrySize-4)
+	sr, err := NewSequenceReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sr.Next(); !errors.Is(err, ErrChecksum) || sr.Pos() != 0 {
+		t.Fatalf("Next: expect = %v, got = %v at %d", ErrChecksum, err, sr.Pos())
+	}
+}
+
+// tFailWriter fails the writes after the first n bytes.
+type tFailWriter struct {
+	n   int
+	err error
+}
+
+func (w *tFailWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		w.n = 0
+		return 0, w.err
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestSequence_writeError(t *testing.T) {
+	errWrite := errors.New("write error")
+	data := tWriteSeq(t, 1, nil)
+	w := &tFailWriter{n: len(data) - rawpSeqIndexSize - rawpSeqIndexEntrySize, err: errWrite}
+	s, err := NewSequenceWriter(w, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFrame(tSeqFrame(0), tSeqTime0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteFrame(tSeqFrame(1), tSeqTime0); err != errWrite {
+		t.Fatalf("WriteFrame: expect = %v, got = %v", errWrite, err)
+	}
+
+	// the index is not written after a failed write
+	w.n = 1 << 20
+	if err := s.WriteFrame(tSeqFrame(2), tSeqTime0); err != errWrite {
+		t.Fatalf("WriteFrame after an error: expect = %v, got = %v", errWrite, err)
+	}
+	if err := s.Close(); err != errWrite {
+		t.Fatalf("Close: expect = %v, got = %v", errWrite, err)
+	}
+	if w.n != 1<<20 {
+		t.Fatalf("Close wrote %d bytes", 1<<20-w.n)
+	}
+}
+
+func TestSequence_file(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "frames.raws")
+	s, err := CreateSequence(name, &Options{UseSnappy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.WriteFrame(tSeqFrame(i), tSeqTime0.Add(time.Duration(i)*40*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sr, err := OpenSequence(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sr.Close()
+	if sr.Len() != 3 || sr.Recovered() {
+		t.Fatalf("Len = %d, Recovered = %v", sr.Len(), sr.Recovered())
+	}
+	var m MemPImage
+	for i := 0; i < 3; i++ {
+		if _, err := sr.NextInto(&m); err != nil {
+			t.Fatal(err)
+		}
+		tCheckPixels(t, &m, tSeqFrame(i))
+	}
+}
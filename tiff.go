@@ -0,0 +1,503 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+)
+
+// Baseline TIFF, see the TIFF 6.0 specification. Only the first image
+// (IFD) of a file is read, stored in strips with chunky (interleaved)
+// samples, uncompressed or deflate compressed.
+const (
+	tiffTag_ImageWidth                = 256
+	tiffTag_ImageLength               = 257
+	tiffTag_BitsPerSample             = 258
+	tiffTag_Compression               = 259
+	tiffTag_PhotometricInterpretation = 262
+	tiffTag_StripOffsets              = 273
+	tiffTag_SamplesPerPixel           = 277
+	tiffTag_RowsPerStrip              = 278
+	tiffTag_StripByteCounts           = 279
+	tiffTag_PlanarConfiguration       = 284
+	tiffTag_Predictor                 = 317
+	tiffTag_TileWidth                 = 322
+	tiffTag_ExtraSamples              = 338
+	tiffTag_SampleFormat              = 339
+
+	tiffType_Byte  = 1
+	tiffType_Short = 3
+	tiffType_Long  = 4
+
+	tiffCompression_None       = 1
+	tiffCompression_Deflate    = 8
+	tiffCompression_OldDeflate = 32946
+
+	tiffSampleFormat_Uint  = 1
+	tiffSampleFormat_Int   = 2
+	tiffSampleFormat_Float = 3
+
+	tiffStripSize = 64 << 10
+)
+
+// TIFFOptions are the encoding parameters of TIFF.
+type TIFFOptions struct {
+	UseDeflate bool
+
+	// RowsPerStrip, if positive, is the number of rows of each strip.
+	// The default is strips of about 64KB.
+	RowsPerStrip int
+}
+
+// LoadTIFF reads the TIFF image in the file name.
+func LoadTIFF(name string) (m *MemPImage, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeTIFF(f)
+}
+
+// SaveTIFF writes m to the file name as TIFF with opt (nil for defaults).
+func SaveTIFF(name string, m *MemPImage, opt *TIFFOptions) (err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if err = EncodeTIFF(w, m, opt); err != nil {
+		return
+	}
+	return w.Flush()
+}
+
+// tiffSampleFormat returns the SampleFormat of kind, or 0.
+func tiffSampleFormat(kind reflect.Kind) int {
+	switch kind {
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return tiffSampleFormat_Uint
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return tiffSampleFormat_Int
+	case Float16, reflect.Float32, reflect.Float64:
+		return tiffSampleFormat_Float
+	}
+	return 0
+}
+
+// tiffKind returns the kind of a SampleFormat and BitsPerSample, or
+// reflect.Invalid.
+func tiffKind(format, bits int) reflect.Kind {
+	switch {
+	case format == tiffSampleFormat_Uint && bits == 8:
+		return reflect.Uint8
+	case format == tiffSampleFormat_Uint && bits == 16:
+		return reflect.Uint16
+	case format == tiffSampleFormat_Uint && bits == 32:
+		return reflect.Uint32
+	case format == tiffSampleFormat_Int && bits == 8:
+		return reflect.Int8
+	case format == tiffSampleFormat_Int && bits == 16:
+		return reflect.Int16
+	case format == tiffSampleFormat_Int && bits == 32:
+		return reflect.Int32
+	case format == tiffSampleFormat_Float && bits == 16:
+		return Float16
+	case format == tiffSampleFormat_Float && bits == 32:
+		return reflect.Float32
+	case format == tiffSampleFormat_Float && bits == 64:
+		return reflect.Float64
+	}
+	return reflect.Invalid
+}
+
+type tiffField struct {
+	Tag    uint16
+	Type   uint16
+	Values []uint32
+}
+
+// EncodeTIFF writes m to w as a TIFF image, in native byte order.
+// m must have 1, 3 or 4 channels, 4 for RGB and alpha, of 8, 16 or 32 bit
+// integers or of floats.
+func EncodeTIFF(w io.Writer, m *MemPImage, opt *TIFFOptions) (err error) {
+	if err = m.Validate(); err != nil {
+		return
+	}
+	format := tiffSampleFormat(m.XDataType)
+	if format == 0 {
+		return errUnsupported("XDataType", KindString(m.XDataType))
+	}
+	if v := m.XChannels; v != 1 && v != 3 && v != 4 {
+		return errUnsupported("XChannels", m.XChannels)
+	}
+	if opt == nil {
+		opt = new(TIFFOptions)
+	}
+	width, height := m.XRect.Dx(), m.XRect.Dy()
+	if width <= 0 || height <= 0 {
+		return errUnsupported("Size", fmt.Sprintf("%vx%v", width, height))
+	}
+
+	rowSize := width * SizeofPixel(m.XChannels, m.XDataType)
+	rowsPerStrip := opt.RowsPerStrip
+	if rowsPerStrip <= 0 {
+		if rowsPerStrip = tiffStripSize / rowSize; rowsPerStrip < 1 {
+			rowsPerStrip = 1
+		}
+	}
+	if rowsPerStrip > height {
+		rowsPerStrip = height
+	}
+	numStrips := (height + rowsPerStrip - 1) / rowsPerStrip
+
+	// deflate strips are compressed first, for their sizes
+	var strips [][]byte
+	counts := make([]uint32, numStrips)
+	offsets := make([]uint32, numStrips)
+	offset := int64(8)
+	for i := range counts {
+		rows := height - i*rowsPerStrip
+		if rows > rowsPerStrip {
+			rows = rowsPerStrip
+		}
+		size := int64(rows) * int64(rowSize)
+		if opt.UseDeflate {
+			var buf bytes.Buffer
+			zw := zlib.NewWriter(&buf)
+			for y := 0; y < rows; y++ {
+				zw.Write(m.rowPix(m.XRect.Min.Y + i*rowsPerStrip + y))
+			}
+			if err = zw.Close(); err != nil {
+				return
+			}
+			strips = append(strips, buf.Bytes())
+			size = int64(buf.Len())
+		}
+		if offset+size > math.MaxUint32 {
+			return &FormatError{Field: "tiff.StripOffsets", Got: offset + size, Want: uint32(math.MaxUint32), Err: ErrTooLarge}
+		}
+		offsets[i], counts[i] = uint32(offset), uint32(size)
+		offset += size
+	}
+	pad := offset & 1 // the IFD starts on a word boundary
+	ifdOffset := offset + pad
+
+	compression := uint32(tiffCompression_None)
+	if opt.UseDeflate {
+		compression = tiffCompression_Deflate
+	}
+	photometric := uint32(1) // BlackIsZero
+	if m.XChannels > 1 {
+		photometric = 2 // RGB
+	}
+	bits := make([]uint32, m.XChannels)
+	formats := make([]uint32, m.XChannels)
+	for i := range bits {
+		bits[i] = uint32(SizeofKind(m.XDataType) * 8)
+		formats[i] = uint32(format)
+	}
+	fields := []tiffField{
+		{tiffTag_ImageWidth, tiffType_Long, []uint32{uint32(width)}},
+		{tiffTag_ImageLength, tiffType_Long, []uint32{uint32(height)}},
+		{tiffTag_BitsPerSample, tiffType_Short, bits},
+		{tiffTag_Compression, tiffType_Short, []uint32{compression}},
+		{tiffTag_PhotometricInterpretation, tiffType_Short, []uint32{photometric}},
+		{tiffTag_StripOffsets, tiffType_Long, offsets},
+		{tiffTag_SamplesPerPixel, tiffType_Short, []uint32{uint32(m.XChannels)}},
+		{tiffTag_RowsPerStrip, tiffType_Long, []uint32{uint32(rowsPerStrip)}},
+		{tiffTag_StripByteCounts, tiffType_Long, counts},
+		{tiffTag_PlanarConfiguration, tiffType_Short, []uint32{1}},
+	}
+	if m.XChannels == 4 {
+		fields = append(fields, tiffField{tiffTag_ExtraSamples, tiffType_Short, []uint32{2}}) // unassociated alpha
+	}
+	fields = append(fields, tiffField{tiffTag_SampleFormat, tiffType_Short, formats})
+
+	order, header := tiffByteOrder()
+	hdr := append([]byte(header), 0, 0, 0, 0)
+	order.PutUint32(hdr[4:], uint32(ifdOffset))
+	if _, err = w.Write(hdr); err != nil {
+		return
+	}
+	if opt.UseDeflate {
+		for _, strip := range strips {
+			if _, err = w.Write(strip); err != nil {
+				return
+			}
+		}
+	} else {
+		for y := m.XRect.Min.Y; y < m.XRect.Max.Y; y++ {
+			if _, err = w.Write(m.rowPix(y)); err != nil {
+				return
+			}
+		}
+	}
+	ifd := make([]byte, pad, pad+1024)
+	ifd = tiffAppendIFD(ifd, order, uint32(ifdOffset), fields)
+	_, err = w.Write(ifd)
+	return
+}
+
+// tiffByteOrder returns the native byte order, and the TIFF header for it
+// without the IFD offset.
+func tiffByteOrder() (binary.ByteOrder, string) {
+	if isLittleEndian {
+		return binary.LittleEndian, "II\x2A\x00"
+	}
+	return binary.BigEndian, "MM\x00\x2A"
+}
+
+// tiffAppendIFD appends the IFD of fields, sorted by tag, at offset to buf.
+// The values over 4 bytes follow the IFD.
+func tiffAppendIFD(buf []byte, order binary.ByteOrder, offset uint32, fields []tiffField) []byte {
+	start := len(buf)
+	extra := offset + 2 + 12*uint32(len(fields)) + 4
+	var values []byte
+
+	buf = append(buf, 0, 0)
+	order.PutUint16(buf[start:], uint16(len(fields)))
+	for _, f := range fields {
+		var v []byte
+		for _, x := range f.Values {
+			if f.Type == tiffType_Short {
+				v = append(v, 0, 0)
+				order.PutUint16(v[len(v)-2:], uint16(x))
+			} else {
+				v = append(v, 0, 0, 0, 0)
+				order.PutUint32(v[len(v)-4:], x)
+			}
+		}
+
+		var e [12]byte
+		order.PutUint16(e[0:], f.Tag)
+		order.PutUint16(e[2:], f.Type)
+		order.PutUint32(e[4:], uint32(len(f.Values)))
+		if len(v) <= 4 {
+			copy(e[8:], v)
+		} else {
+			order.PutUint32(e[8:], extra+uint32(len(values)))
+			values = append(values, v...)
+		}
+		buf = append(buf, e[:]...)
+	}
+	buf = append(buf, 0, 0, 0, 0) // no next IFD
+	return append(buf, values...)
+}
+
+// DecodeTIFF reads the first image of a TIFF file from r. The samples are
+// returned in native byte order.
+func DecodeTIFF(r io.Reader) (m *MemPImage, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case len(data) < 8:
+		return nil, &FormatError{Field: "tiff.Header", Got: len(data), Want: 8, Err: ErrTruncated}
+	case string(data[:4]) == "II\x2A\x00":
+		order = binary.LittleEndian
+	case string(data[:4]) == "MM\x00\x2A":
+		order = binary.BigEndian
+	default:
+		return nil, errFormat("tiff.Header", fmt.Sprintf("%q", data[:4]))
+	}
+	fields, err := tiffReadIFD(data, order, order.Uint32(data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	// field returns the single value of tag, or def if it is missing
+	field := func(tag uint16, def int) (int, error) {
+		v, ok := fields[tag]
+		if ok && len(v) == 0 {
+			return 0, errFormat(fmt.Sprintf("tiff.Tag(%d)", tag), "no values")
+		}
+		if !ok {
+			if def < 0 {
+				return 0, errFormat(fmt.Sprintf("tiff.Tag(%d)", tag), "missing")
+			}
+			return def, nil
+		}
+		for _, x := range v[1:] {
+			if x != v[0] {
+				return 0, errUnsupported(fmt.Sprintf("tiff.Tag(%d)", tag), v)
+			}
+		}
+		return int(v[0]), nil
+	}
+
+	if _, ok := fields[tiffTag_TileWidth]; ok {
+		return nil, errUnsupported("tiff.TileWidth", "tiles")
+	}
+	var width, height, channels, bits, format, compression, photometric, planar, predictor, rowsPerStrip int
+	for _, f := range []struct {
+		p   *int
+		tag uint16
+		def int
+	}{
+		{&width, tiffTag_ImageWidth, -1},
+		{&height, tiffTag_ImageLength, -1},
+		{&channels, tiffTag_SamplesPerPixel, 1},
+		{&bits, tiffTag_BitsPerSample, 1},
+		{&format, tiffTag_SampleFormat, tiffSampleFormat_Uint},
+		{&compression, tiffTag_Compression, tiffCompression_None},
+		{&photometric, tiffTag_PhotometricInterpretation, -1},
+		{&planar, tiffTag_PlanarConfiguration, 1},
+		{&predictor, tiffTag_Predictor, 1},
+		{&rowsPerStrip, tiffTag_RowsPerStrip, maxInt},
+	} {
+		if *f.p, err = field(f.tag, f.def); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case width <= 0 || height <= 0 || rowsPerStrip <= 0:
+		return nil, errFormat("tiff.Size", fmt.Sprintf("%vx%v, %v rows per strip", width, height, rowsPerStrip))
+	case channels <= 0:
+		return nil, errFormat("tiff.SamplesPerPixel", channels)
+	case photometric != 1 && photometric != 2:
+		return nil, errUnsupported("tiff.PhotometricInterpretation", photometric)
+	case planar != 1:
+		return nil, errUnsupported("tiff.PlanarConfiguration", planar)
+	case predictor != 1:
+		return nil, errUnsupported("tiff.Predictor", predictor)
+	case compression != tiffCompression_None && compression != tiffCompression_Deflate && compression != tiffCompression_OldDeflate:
+		return nil, errUnsupported("tiff.Compression", compression)
+	}
+	kind := tiffKind(format, bits)
+	if kind == reflect.Invalid {
+		return nil, errUnsupported("tiff.SampleFormat", fmt.Sprintf("format = %v, bits = %v", format, bits))
+	}
+
+	rowSize := SizeofKind(kind)
+	for _, n := range []int{width, channels} {
+		if rowSize > maxInt/n {
+			return nil, &FormatError{Field: "tiff.Size", Got: fmt.Sprintf("%vx%vx%v", width, height, channels), Err: ErrTooLarge}
+		}
+		rowSize *= n
+	}
+	if rowSize > maxInt/height || rowSize*height/maxDeflateRatio > len(data) {
+		return nil, &FormatError{Field: "tiff.Size", Got: fmt.Sprintf("%vx%vx%v", width, height, channels), Err: ErrTooLarge}
+	}
+	if rowsPerStrip > height {
+		rowsPerStrip = height
+	}
+	numStrips := (height + rowsPerStrip - 1) / rowsPerStrip
+	offsets, counts := fields[tiffTag_StripOffsets], fields[tiffTag_StripByteCounts]
+	if len(offsets) != numStrips || len(counts) != numStrips {
+		return nil, &FormatError{Field: "tiff.StripOffsets", Got: len(offsets), Want: numStrips, Err: ErrFormat}
+	}
+
+	pix := make([]byte, rowSize*height)
+	for i := range offsets {
+		off, n := int64(offsets[i]), int64(counts[i])
+		if off+n > int64(len(data)) {
+			return nil, &FormatError{Field: "tiff.StripByteCounts", Got: off + n, Want: len(data), Err: ErrTruncated}
+		}
+		strip := data[off : off+n]
+		dst := pix[i*rowsPerStrip*rowSize:]
+		if len(dst) > rowsPerStrip*rowSize {
+			dst = dst[:rowsPerStrip*rowSize]
+		}
+
+		if compression == tiffCompression_None {
+			if len(strip) < len(dst) {
+				return nil, &FormatError{Field: "tiff.StripByteCounts", Got: len(strip), Want: len(dst), Err: ErrTruncated}
+			}
+			copy(dst, strip)
+			continue
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(strip))
+		if err != nil {
+			return nil, &FormatError{Field: "tiff.Strip", Got: err.Error(), Err: ErrFormat}
+		}
+		if _, err = io.ReadFull(zr, dst); err != nil {
+			return nil, &FormatError{Field: "tiff.Strip", Got: err.Error(), Err: ErrFormat}
+		}
+	}
+
+	m = &MemPImage{
+		XMemPMagic: MemPMagic,
+		XRect:      image.Rect(0, 0, width, height),
+		XStride:    rowSize,
+		XChannels:  channels,
+		XDataType:  kind,
+		XPix:       pix,
+	}
+	if native, _ := tiffByteOrder(); order != native {
+		m.XPix.SwapEndian(kind)
+	}
+	return m, nil
+}
+
+// tiffReadIFD reads the integer fields of the IFD at offset in data.
+// Fields of the other types are skipped.
+func tiffReadIFD(data []byte, order binary.ByteOrder, offset uint32) (fields map[uint16][]uint32, err error) {
+	if int64(offset)+2 > int64(len(data)) {
+		return nil, &FormatError{Field: "tiff.IFD", Got: offset, Want: len(data), Err: ErrTruncated}
+	}
+	n := int(order.Uint16(data[offset:]))
+	ifd := data[offset+2:]
+	if len(ifd) < 12*n {
+		return nil, &FormatError{Field: "tiff.IFD", Got: len(ifd), Want: 12 * n, Err: ErrTruncated}
+	}
+
+	fields = make(map[uint16][]uint32)
+	for i := 0; i < n; i++ {
+		e := ifd[12*i:][:12]
+		tag, typ, count := order.Uint16(e[0:]), order.Uint16(e[2:]), int64(order.Uint32(e[4:]))
+		var size int64
+		switch typ {
+		case tiffType_Byte:
+			size = 1
+		case tiffType_Short:
+			size = 2
+		case tiffType_Long:
+			size = 4
+		default:
+			continue
+		}
+		v := e[8:12]
+		if size*count > 4 {
+			off := int64(order.Uint32(e[8:]))
+			if off+size*count > int64(len(data)) {
+				return nil, &FormatError{Field: fmt.Sprintf("tiff.Tag(%d)", tag), Got: off + size*count, Want: len(data), Err: ErrTruncated}
+			}
+			v = data[off : off+size*count]
+		}
+		values := make([]uint32, count)
+		for j := range values {
+			switch typ {
+			case tiffType_Byte:
+				values[j] = uint32(v[j])
+			case tiffType_Short:
+				values[j] = uint32(order.Uint16(v[2*j:]))
+			default:
+				values[j] = order.Uint32(v[4*j:])
+			}
+		}
+		fields[tag] = values
+	}
+	return fields, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeAndDecodeTIFF(t *testing.T) {
+	for _, kind := range []reflect.Kind{reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Int16, reflect.Float32, reflect.Float64} {
+		for _, channels := range []int{1, 3, 4} {
+			m0 := NewMemPImage(image.Rect(0, 0, 9, 11), channels, kind)
+			for i := range m0.XPix {
+				m0.XPix[i] = byte(i * 13 / 7)
+			}
+			sub := m0.SubImage(image.Rect(1, 2, 8, 11)).(*MemPImage)
+
+			for _, opt := range []*TIFFOptions{nil, {UseDeflate: true}, {UseDeflate: true, RowsPerStrip: 2}} {
+				var buf bytes.Buffer
+				if err := EncodeTIFF(&buf, sub, opt); err != nil {
+					t.Fatalf("%v, %d channels, %+v: %v", kind, channels, opt, err)
+				}
+				m1, err := DecodeTIFF(&buf)
+				if err != nil {
+					t.Fatalf("%v, %d channels, %+v: %v", kind, channels, opt, err)
+				}
+				tCheckPixels(t, m1, sub)
+
+				// through RawP, for the kinds it supports
+				buf.Reset()
+				if err := Encode(&buf, m1, &Options{UseSnappy: true}); err != nil {
+					if errors.Is(err, ErrUnsupported) {
+						continue
+					}
+					t.Fatal(err)
+				}
+				m2, err := DecodeImage(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tCheckPixels(t, m2, sub)
+			}
+		}
+	}
+}
+
+func TestDecodeTIFF_bigEndian(t *testing.T) {
+	// a 2x1 big endian uint16 gray image
+	fields := []tiffField{
+		{tiffTag_ImageWidth, tiffType_Short, []uint32{2}},
+		{tiffTag_ImageLength, tiffType_Short, []uint32{1}},
+		{tiffTag_BitsPerSample, tiffType_Short, []uint32{16}},
+		{tiffTag_PhotometricInterpretation, tiffType_Short, []uint32{1}},
+		{tiffTag_StripOffsets, tiffType_Long, []uint32{8}},
+		{tiffTag_StripByteCounts, tiffType_Long, []uint32{4}},
+	}
+	data := []byte("MM\x00\x2A\x00\x00\x00\x0C\x01\x02\x03\x04")
+	data = tiffAppendIFD(data, binary.BigEndian, 12, fields)
+
+	m, err := DecodeTIFF(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := m.XPix.Uint16s(); m.XDataType != reflect.Uint16 || v[0] != 0x0102 || v[1] != 0x0304 {
+		t.Fatalf("kind = %v, samples = %x", m.XDataType, v)
+	}
+
+	for i, v := range []struct {
+		field  tiffField
+		expect error
+	}{
+		{tiffField{tiffTag_StripByteCounts, tiffType_Long, []uint32{3}}, ErrTruncated},
+		{tiffField{tiffTag_StripOffsets, tiffType_Long, []uint32{1 << 20}}, ErrTruncated},
+		{tiffField{tiffTag_BitsPerSample, tiffType_Short, []uint32{12}}, ErrUnsupported},
+		{tiffField{tiffTag_PhotometricInterpretation, tiffType_Short, []uint32{3}}, ErrUnsupported},
+		{tiffField{tiffTag_ImageWidth, tiffType_Long, []uint32{1 << 30}}, ErrTooLarge},
+	} {
+		fields := append([]tiffField(nil), fields...)
+		for j := range fields {
+			if fields[j].Tag == v.field.Tag {
+				fields[j] = v.field
+			}
+		}
+		data := tiffAppendIFD(data[:12:12], binary.BigEndian, 12, fields)
+		if _, err := DecodeTIFF(bytes.NewReader(data)); !errors.Is(err, v.expect) {
+			t.Fatalf("%d: expect = %v, got = %v", i, v.expect, err)
+		}
+	}
+	if _, err := DecodeTIFF(bytes.NewReader(data[:10])); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expect = %v, got = %v", ErrTruncated, err)
+	}
+}
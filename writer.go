@@ -9,6 +9,8 @@ import (
 	"image"
 	"io"
 	"os"
+	"reflect"
+	"sync"
 	"unsafe"
 
 	"github.com/golang/snappy"
@@ -17,6 +19,51 @@ import (
 // Options are the encoding parameters.
 type Options struct {
 	UseSnappy bool
+
+	// BlockSize, if positive and UseSnappy is set, splits the image data
+	// into independently compressed blocks of BlockSize bytes, which are
+	// encoded and decoded in parallel. See DefaultBlockSize.
+	BlockSize int
+
+	// UsePool makes Encode borrow its scratch buffers from a sync.Pool
+	// instead of allocating them for every call.
+	UsePool bool
+
+	// YUV writes *image.YCbCr images as YUV frames (4:2:0 as YUVI420, 4:2:2
+	// as YUVI422) instead of RGBA images. Other ratios and odd origins are
+	// ErrUnsupported.
+	YUV bool
+}
+
+// Encoder encodes RawP images and keeps its scratch buffers between calls,
+// so encoding a stream of same sized frames does not allocate.
+//
+// An Encoder must not be used by multiple goroutines at the same time.
+type Encoder struct {
+	Options
+
+	hdr rawpHeader
+	pix []byte // packed rows
+	buf []byte // snappy output
+}
+
+// rawpWriteChunkSize is the size of the writes of uncompressed images
+// which are not compact.
+const rawpWriteChunkSize = 64 << 10
+
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return new(Encoder)
+	},
+}
+
+// NewEncoder returns an Encoder with the options opt (nil for default).
+func NewEncoder(opt *Options) *Encoder {
+	e := new(Encoder)
+	if opt != nil {
+		e.Options = *opt
+	}
+	return e
 }
 
 func Save(name string, m image.Image, opt *Options) (err error) {
@@ -30,39 +77,114 @@ func Save(name string, m image.Image, opt *Options) (err error) {
 
 // Encode writes the image m to w in RawP format.
 func Encode(w io.Writer, m image.Image, opt *Options) (err error) {
+	if opt != nil && opt.UsePool {
+		e := encoderPool.Get().(*Encoder)
+		e.Options = *opt
+		err = e.Encode(w, m)
+		e.hdr.Data = nil
+		encoderPool.Put(e)
+		return
+	}
+	return NewEncoder(opt).Encode(w, m)
+}
+
+// Encode writes the image m to w in RawP format. A *YUVImage is written
+// as a YUV frame, with its planes as they are, and so is an *image.YCbCr
+// with Options.YUV.
+func (e *Encoder) Encode(w io.Writer, m image.Image) (err error) {
+	switch m := m.(type) {
+	case *YUVImage:
+		return e.encodeYUV(w, m)
+	case *image.YCbCr:
+		if e.YUV {
+			layout := yuvLayoutOf(m)
+			if layout == YUVNone {
+				return errUnsupported("SubsampleRatio", m.SubsampleRatio)
+			}
+			p, err := NewYUVImageFrom(m, layout)
+			if err != nil {
+				return err
+			}
+			return e.encodeYUV(w, p)
+		}
+	}
 	p, ok := AsMemPImage(m)
 	if !ok {
 		p = NewMemPImageFrom(m)
 	}
-
-	var useSnappy bool
-	if opt != nil {
-		useSnappy = opt.UseSnappy
+	if err = p.Validate(); err != nil {
+		return
 	}
 
-	hdr, err := rawpMakeHeader(p.Bounds().Dx(), p.Bounds().Dy(), p.XChannels, p.XDataType, useSnappy)
+	hdr := &e.hdr
+	err = rawpInitHeader(hdr, p.Bounds().Dx(), p.Bounds().Dy(), p.XChannels, p.XDataType, e.UseSnappy)
 	if err != nil {
 		return
 	}
+	if err = rawpSetDepth(hdr, p.XDepth, p.XPacking, p.XDataType); err != nil {
+		return
+	}
+	if err = rawpCheckOrigin(p.XRect.Min, p.XRect.Dx(), p.XRect.Dy()); err != nil {
+		return
+	}
+	hdr.Origin = p.XRect.Min
+	if p.XCFA != (CFA{}) {
+		if !p.XCFA.valid() || p.XChannels != 1 {
+			return errUnsupported("CFA", p.XCFA)
+		}
+		hdr.CFA = p.XCFA
+	}
+	if p.XColorSpace != ColorSpaceUnknown {
+		if !p.XColorSpace.valid() {
+			return errUnsupported("ColorSpace", p.XColorSpace)
+		}
+		hdr.ColorSpace = p.XColorSpace
+	}
 
-	stride := p.XRect.Dx() * p.XChannels * SizeofKind(p.XDataType)
-	pix := make([]byte, stride*p.XRect.Dy())
+	rowSize := p.XRect.Dx() * SizeofPixel(p.XChannels, p.XDataType)
+	size := rowSize * p.XRect.Dy()
 
-	off := 0
-	for y := p.XRect.Min.Y; y < p.XRect.Max.Y; y++ {
-		copy(pix[off:][:stride], p.XPix[p.PixOffset(p.XRect.Min.X, y):])
-		off += stride
+	// compact images are written (or compressed) in one call
+	var pix []byte
+	if p.XStride == rowSize || p.XRect.Dy() == 1 {
+		pix = p.XPix[p.PixOffset(p.XRect.Min.X, p.XRect.Min.Y):][:size]
 	}
+	if rawpIsPackedDepth(hdr.Depth) {
+		if err = p.checkDepth(int(hdr.Depth)); err != nil {
+			return
+		}
+		size = rawpImageDataSize(hdr)
+		e.pix = p.packPix(growBytes(e.pix, size), hdr)
+		pix = e.pix
+	}
+	return e.encodeData(w, p, pix, size)
+}
 
-	if useSnappy {
-		pix = snappy.Encode(nil, pix)
+// encodeData compresses and writes the size bytes of image data of p,
+// which are pix for compact images, with the header e.hdr.
+func (e *Encoder) encodeData(w io.Writer, p *MemPImage, pix []byte, size int) (err error) {
+	hdr := &e.hdr
+	switch {
+	case !e.UseSnappy && pix == nil:
+		return e.encodeRows(w, p)
+	case e.UseSnappy && e.BlockSize > 0 && size > e.BlockSize:
+		pix = e.encodeBlocks(p, pix, size)
+		hdr.UseSnappy = rawpUseSnappy_Blocks
+	case e.UseSnappy:
+		if pix == nil {
+			// snappy needs all the data in one slice
+			e.pix = p.readPix(growBytes(e.pix, size), 0)
+			pix = e.pix
+		}
+		e.buf = growBytes(e.buf, snappy.MaxEncodedLen(size))
+		pix = snappy.Encode(e.buf, pix)
 	}
 
 	hdr.DataSize = uint32(len(pix))
 	hdr.DataCheckSum = crc32.ChecksumIEEE(pix)
 	hdr.Data = pix
 
-	if _, err = w.Write(((*[1 << 30]byte)(unsafe.Pointer(hdr)))[:rawpHeaderSize]); err != nil {
+	if err = rawpWriteHeader(w, hdr); err != nil {
 		return
 	}
 	if _, err = w.Write(hdr.Data); err != nil {
@@ -70,3 +192,108 @@ func Encode(w io.Writer, m image.Image, opt *Options) (err error) {
 	}
 	return
 }
+
+// encodeYUV writes the YUV frame m to w.
+func (e *Encoder) encodeYUV(w io.Writer, m *YUVImage) (err error) {
+	if err = m.Validate(); err != nil {
+		return
+	}
+	hdr := &e.hdr
+	if err = rawpInitHeader(hdr, m.Rect.Dx(), m.Rect.Dy(), 3, reflect.Uint8, e.UseSnappy); err != nil {
+		return
+	}
+	if err = rawpCheckOrigin(m.Rect.Min, m.Rect.Dx(), m.Rect.Dy()); err != nil {
+		return
+	}
+	if err = rawpCheckYUVOrigin(m.Rect.Min, m.Layout); err != nil {
+		return
+	}
+	hdr.Origin = m.Rect.Min
+	hdr.YUV = m.Layout
+
+	size := rawpImageDataSize(hdr)
+	e.pix = m.readPix(growBytes(e.pix, size))
+	return e.encodeData(w, nil, e.pix, size)
+}
+
+// encodeBlocks compresses the image data of p as snappy blocks. pix is
+// the image data of compact images, nil for the others.
+func (e *Encoder) encodeBlocks(p *MemPImage, pix []byte, size int) []byte {
+	return rawpEncodeBlocks(size, e.BlockSize, func(buf []byte, off int) []byte {
+		if pix != nil {
+			return pix[off:][:len(buf)]
+		}
+		return p.readPix(buf, off)
+	})
+}
+
+// encodeRows writes the uncompressed rows of p to w, in chunks of about
+// rawpWriteChunkSize bytes.
+func (e *Encoder) encodeRows(w io.Writer, p *MemPImage) (err error) {
+	hdr := &e.hdr
+	rowSize := p.XRect.Dx() * SizeofPixel(p.XChannels, p.XDataType)
+
+	var crc uint32
+	for y := p.XRect.Min.Y; y < p.XRect.Max.Y; y++ {
+		crc = crc32.Update(crc, crc32.IEEETable, p.rowPix(y))
+	}
+	hdr.DataSize = uint32(rowSize * p.XRect.Dy())
+	hdr.DataCheckSum = crc
+	hdr.Data = nil
+	if err = rawpWriteHeader(w, hdr); err != nil {
+		return
+	}
+
+	rows := rawpWriteChunkSize / rowSize
+	if rows < 1 {
+		rows = 1
+	}
+	if rows > p.XRect.Dy() {
+		rows = p.XRect.Dy()
+	}
+	e.pix = growBytes(e.pix, rows*rowSize)
+	for y := p.XRect.Min.Y; y < p.XRect.Max.Y; y += rows {
+		n := rows
+		if y+n > p.XRect.Max.Y {
+			n = p.XRect.Max.Y - y
+		}
+		chunk := e.pix[:n*rowSize]
+		for i := 0; i < n; i++ {
+			copy(chunk[i*rowSize:], p.rowPix(y+i))
+		}
+		if _, err = w.Write(chunk); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// growBytes returns buf resized to n bytes, reallocated if needed.
+func growBytes(buf []byte, n int) []byte {
+	if cap(buf) < n {
+		return make([]byte, n)
+	}
+	return buf[:n]
+}
+
+// rawpWriteHeader writes hdr and its extensions to w.
+func rawpWriteHeader(w io.Writer, hdr *rawpHeader) (err error) {
+	var flags byte
+	if hdr.Ext = rawpAppendExt(hdr.Ext[:0], hdr); len(hdr.Ext) > 0 {
+		flags = rawpFlag_Extensions
+	}
+	if hdr.Packing == PackingMIPI {
+		flags |= rawpFlag_MIPI
+	}
+	flags |= byte(hdr.YUV) << rawpFlag_YUVShift
+	hdr.UseSnappy |= flags
+	_, err = w.Write(((*[1 << 30]byte)(unsafe.Pointer(hdr)))[:rawpHeaderSize])
+	hdr.UseSnappy &^= flags
+	if err != nil {
+		return
+	}
+	if len(hdr.Ext) > 0 {
+		_, err = w.Write(hdr.Ext)
+	}
+	return
+}
@@ -0,0 +1,357 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+)
+
+// YUV frames (Header.UseSnappy&0x30 != 0, Channels 3, Depth 8, DataType
+// 1=Uint) hold the Y plane, then the chroma planes, each without row
+// padding. (UseSnappy>>4)&3 is the YUVLayout. Chroma planes have
+// (Width+1)/2 columns, and (Height+1)/2 rows for 4:2:0 or Height rows
+// for 4:2:2:
+//
+//	I420: Y, Cb, Cr
+//	NV12: Y, interleaved CbCr
+//	I422: Y, Cb, Cr
+//
+// The origin of YUV frames is even in the subsampled directions.
+const (
+	rawpFlag_YUV      = 0x30
+	rawpFlag_YUVShift = 4
+)
+
+// YUVLayout is the chroma subsampling and plane layout of a YUVImage.
+type YUVLayout int
+
+const (
+	YUVNone YUVLayout = iota // not a YUV frame
+	YUVI420                  // 4:2:0, Cb and Cr planes
+	YUVNV12                  // 4:2:0, one interleaved CbCr plane
+	YUVI422                  // 4:2:2, Cb and Cr planes
+)
+
+func (l YUVLayout) String() string {
+	switch l {
+	case YUVNone:
+		return "None"
+	case YUVI420:
+		return "I420"
+	case YUVNV12:
+		return "NV12"
+	case YUVI422:
+		return "I422"
+	}
+	return fmt.Sprintf("YUVLayout(%d)", int(l))
+}
+
+// subsampleRatio returns the image.YCbCr ratio of l.
+func (l YUVLayout) subsampleRatio() image.YCbCrSubsampleRatio {
+	if l == YUVI422 {
+		return image.YCbCrSubsampleRatio422
+	}
+	return image.YCbCrSubsampleRatio420
+}
+
+// yuvLayoutOf returns the planar layout which shares the planes of m, or
+// YUVNone.
+func yuvLayoutOf(m *image.YCbCr) YUVLayout {
+	switch m.SubsampleRatio {
+	case image.YCbCrSubsampleRatio420:
+		return YUVI420
+	case image.YCbCrSubsampleRatio422:
+		return YUVI422
+	}
+	return YUVNone
+}
+
+// YUVImage is a planar Y'CbCr frame, like image.YCbCr with the planes of
+// video capture devices. Chroma samples are addressed like in image.YCbCr.
+//
+// For YUVNV12, Cb holds the interleaved Cb and Cr samples and Cr is nil.
+type YUVImage struct {
+	Y, Cb, Cr []uint8
+	YStride   int
+	CStride   int
+	Layout    YUVLayout
+	Rect      image.Rectangle
+}
+
+// NewYUVImage returns a new YUVImage with the given bounds and layout.
+func NewYUVImage(r image.Rectangle, layout YUVLayout) *YUVImage {
+	w, h, cw, ch := yuvPlaneSizes(r, layout)
+	if w <= 0 || h <= 0 {
+		return &YUVImage{Layout: layout, Rect: r}
+	}
+	pix := make([]uint8, w*h+2*cw*ch)
+	i0, i1 := w*h, w*h+cw*ch
+	if layout == YUVNV12 {
+		return &YUVImage{
+			Y:       pix[:i0:i0],
+			Cb:      pix[i0:],
+			YStride: w,
+			CStride: 2 * cw,
+			Layout:  layout,
+			Rect:    r,
+		}
+	}
+	return &YUVImage{
+		Y:       pix[:i0:i0],
+		Cb:      pix[i0:i1:i1],
+		Cr:      pix[i1:],
+		YStride: w,
+		CStride: cw,
+		Layout:  layout,
+		Rect:    r,
+	}
+}
+
+// yuvPlaneSizes returns the size of the Y plane and of one chroma plane
+// (in samples, not CbCr pairs) of a frame with bounds r, as image.NewYCbCr.
+func yuvPlaneSizes(r image.Rectangle, layout YUVLayout) (w, h, cw, ch int) {
+	w, h = r.Dx(), r.Dy()
+	cw = (r.Max.X+1)/2 - r.Min.X/2
+	ch = (r.Max.Y+1)/2 - r.Min.Y/2
+	if layout == YUVI422 {
+		ch = h
+	}
+	return
+}
+
+// NewYUVImageFrom returns m as a YUVImage with the given layout. The
+// planes of m are shared for YUVI420 (from 4:2:0) and YUVI422 (from
+// 4:2:2), and interleaved into a new plane for YUVNV12 (from 4:2:0).
+func NewYUVImageFrom(m *image.YCbCr, layout YUVLayout) (*YUVImage, error) {
+	if layout < YUVI420 || layout > YUVI422 {
+		return nil, errUnsupported("Layout", layout)
+	}
+	if m.SubsampleRatio != layout.subsampleRatio() {
+		return nil, errUnsupported("SubsampleRatio", m.SubsampleRatio)
+	}
+	if layout != YUVNV12 {
+		return &YUVImage{
+			Y:       m.Y,
+			Cb:      m.Cb,
+			Cr:      m.Cr,
+			YStride: m.YStride,
+			CStride: m.CStride,
+			Layout:  layout,
+			Rect:    m.Rect,
+		}, nil
+	}
+
+	p := NewYUVImage(m.Rect, layout)
+	_, _, cw, ch := yuvPlaneSizes(m.Rect, layout)
+	for y := 0; y < ch; y++ {
+		row := p.Cb[y*p.CStride:][:2*cw]
+		cb, cr := m.Cb[y*m.CStride:][:cw], m.Cr[y*m.CStride:][:cw]
+		for x := 0; x < cw; x++ {
+			row[2*x], row[2*x+1] = cb[x], cr[x]
+		}
+	}
+	for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+		copy(p.Y[p.YOffset(m.Rect.Min.X, y):][:m.Rect.Dx()], m.Y[m.YOffset(m.Rect.Min.X, y):])
+	}
+	return p, nil
+}
+
+// StdImage returns p as an image.YCbCr, which shares the planes of p
+// unless it is YUVNV12.
+func (p *YUVImage) StdImage() *image.YCbCr {
+	if p.Layout != YUVNV12 {
+		return &image.YCbCr{
+			Y:              p.Y,
+			Cb:             p.Cb,
+			Cr:             p.Cr,
+			YStride:        p.YStride,
+			CStride:        p.CStride,
+			SubsampleRatio: p.Layout.subsampleRatio(),
+			Rect:           p.Rect,
+		}
+	}
+
+	m := image.NewYCbCr(p.Rect, image.YCbCrSubsampleRatio420)
+	_, _, cw, ch := yuvPlaneSizes(p.Rect, p.Layout)
+	for y := 0; y < ch; y++ {
+		row := p.Cb[y*p.CStride:][:2*cw]
+		cb, cr := m.Cb[y*m.CStride:][:cw], m.Cr[y*m.CStride:][:cw]
+		for x := 0; x < cw; x++ {
+			cb[x], cr[x] = row[2*x], row[2*x+1]
+		}
+	}
+	for y := p.Rect.Min.Y; y < p.Rect.Max.Y; y++ {
+		copy(m.Y[m.YOffset(p.Rect.Min.X, y):][:p.Rect.Dx()], p.Y[p.YOffset(p.Rect.Min.X, y):])
+	}
+	return m
+}
+
+func (p *YUVImage) ColorModel() color.Model {
+	return color.YCbCrModel
+}
+
+func (p *YUVImage) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+func (p *YUVImage) At(x, y int) color.Color {
+	return p.YCbCrAt(x, y)
+}
+
+func (p *YUVImage) YCbCrAt(x, y int) color.YCbCr {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.YCbCr{}
+	}
+	i, j := p.YOffset(x, y), p.COffset(x, y)
+	if p.Layout == YUVNV12 {
+		return color.YCbCr{Y: p.Y[i], Cb: p.Cb[j], Cr: p.Cb[j+1]}
+	}
+	return color.YCbCr{Y: p.Y[i], Cb: p.Cb[j], Cr: p.Cr[j]}
+}
+
+// YOffset returns the index of the Y sample of the pixel (x, y).
+func (p *YUVImage) YOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.YStride + (x - p.Rect.Min.X)
+}
+
+// COffset returns the index of the chroma samples of the pixel (x, y),
+// the Cb sample of the CbCr pair for YUVNV12.
+func (p *YUVImage) COffset(x, y int) int {
+	cx := x/2 - p.Rect.Min.X/2
+	if p.Layout == YUVNV12 {
+		cx *= 2
+	}
+	if p.Layout == YUVI422 {
+		return (y-p.Rect.Min.Y)*p.CStride + cx
+	}
+	return (y/2-p.Rect.Min.Y/2)*p.CStride + cx
+}
+
+// Validate reports whether the fields of p describe a usable frame.
+func (p *YUVImage) Validate() error {
+	if p == nil {
+		return errFormat("YUVImage", nil)
+	}
+	if p.Layout < YUVI420 || p.Layout > YUVI422 {
+		return errUnsupported("Layout", p.Layout)
+	}
+	w, h, cw, ch := yuvPlaneSizes(p.Rect, p.Layout)
+	if w <= 0 || h <= 0 {
+		return nil
+	}
+	if p.Layout == YUVNV12 {
+		cw *= 2
+	}
+	if p.YStride < w {
+		return &FormatError{Field: "YStride", Got: p.YStride, Want: w, Err: ErrFormat}
+	}
+	if p.CStride < cw {
+		return &FormatError{Field: "CStride", Got: p.CStride, Want: cw, Err: ErrFormat}
+	}
+	if n := (h-1)*p.YStride + w; len(p.Y) < n {
+		return &FormatError{Field: "Y", Got: len(p.Y), Want: n, Err: ErrTruncated}
+	}
+	n := (ch-1)*p.CStride + cw
+	if len(p.Cb) < n {
+		return &FormatError{Field: "Cb", Got: len(p.Cb), Want: n, Err: ErrTruncated}
+	}
+	if p.Layout != YUVNV12 && len(p.Cr) < n {
+		return &FormatError{Field: "Cr", Got: len(p.Cr), Want: n, Err: ErrTruncated}
+	}
+	return nil
+}
+
+// rawpCheckYUVOrigin checks that the origin of a frame is even in the
+// subsampled directions, so the chroma planes are those of yuvDataSize.
+func rawpCheckYUVOrigin(origin image.Point, layout YUVLayout) error {
+	if layout == YUVNone {
+		return nil
+	}
+	if origin.X%2 != 0 || (layout != YUVI422 && origin.Y%2 != 0) {
+		return errUnsupported("Origin", origin)
+	}
+	return nil
+}
+
+// yuvDataSize returns the size of the planes of a width x height frame
+// with an even origin.
+func yuvDataSize(layout YUVLayout, width, height int) int {
+	_, _, cw, ch := yuvPlaneSizes(image.Rect(0, 0, width, height), layout)
+	return width*height + 2*cw*ch
+}
+
+// readPix copies the planes of p into buf, without row padding.
+func (p *YUVImage) readPix(buf []byte) []byte {
+	w, _, cw, ch := yuvPlaneSizes(p.Rect, p.Layout)
+	planes := [][]uint8{p.Cb, p.Cr}
+	if p.Layout == YUVNV12 {
+		cw, planes = 2*cw, planes[:1]
+	}
+	off := 0
+	for y := p.Rect.Min.Y; y < p.Rect.Max.Y; y++ {
+		off += copy(buf[off:][:w], p.Y[p.YOffset(p.Rect.Min.X, y):])
+	}
+	for _, plane := range planes {
+		for y := 0; y < ch; y++ {
+			off += copy(buf[off:][:cw], plane[y*p.CStride:])
+		}
+	}
+	return buf[:off]
+}
+
+// rgbPix converts p to RGB, into pix with rows of stride bytes.
+func (p *YUVImage) rgbPix(pix []byte, stride int) {
+	for y := p.Rect.Min.Y; y < p.Rect.Max.Y; y++ {
+		row := pix[(y-p.Rect.Min.Y)*stride:][:3*p.Rect.Dx()]
+		for x := p.Rect.Min.X; x < p.Rect.Max.X; x++ {
+			c := p.YCbCrAt(x, y)
+			i := 3 * (x - p.Rect.Min.X)
+			row[i], row[i+1], row[i+2] = color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+		}
+	}
+}
+
+// rawpYUVImage returns the frame of hdr over its decoded data pix.
+func rawpYUVImage(hdr *rawpHeader, pix []byte) *YUVImage {
+	r := image.Rectangle{hdr.Origin, hdr.Origin.Add(image.Pt(int(hdr.Width), int(hdr.Height)))}
+	w, h, cw, ch := yuvPlaneSizes(r, hdr.YUV)
+	i0, i1 := w*h, w*h+cw*ch
+	p := &YUVImage{
+		Y:       pix[:i0:i0],
+		YStride: w,
+		CStride: cw,
+		Layout:  hdr.YUV,
+		Rect:    r,
+	}
+	if hdr.YUV == YUVNV12 {
+		p.Cb, p.CStride = pix[i0:], 2*cw
+	} else {
+		p.Cb, p.Cr = pix[i0:i1:i1], pix[i1:]
+	}
+	return p
+}
+
+func LoadYUV(name string) (m *YUVImage, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeYUV(f)
+}
+
+// DecodeYUV reads a RawP YUV frame from r, with its planes as stored.
+// Other RawP images fail with ErrUnsupported.
+func DecodeYUV(r io.Reader) (m *YUVImage, err error) {
+	m = new(YUVImage)
+	if _, err = rawpDecodeInto(r, nil, m, nil); err != nil {
+		return nil, err
+	}
+	return
+}
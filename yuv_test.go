@@ -0,0 +1,224 @@
+// Copyright 2015 <chaishushan{AT}gmail.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rawp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+// tNewYUVImage returns a frame with bounds r filled with a pattern.
+func tNewYUVImage(r image.Rectangle, layout YUVLayout) *YUVImage {
+	m := NewYUVImage(r, layout)
+	for i := range m.Y {
+		m.Y[i] = uint8(i*7 + 16)
+	}
+	for i := range m.Cb {
+		m.Cb[i] = uint8(i*13 + 1)
+	}
+	for i := range m.Cr {
+		m.Cr[i] = uint8(i*5 + 200)
+	}
+	return m
+}
+
+func tCheckYUV(t *testing.T, m, want *YUVImage) {
+	t.Helper()
+	if m.Layout != want.Layout || m.Rect != want.Rect {
+		t.Fatalf("got %v %v, want %v %v", m.Layout, m.Rect, want.Layout, want.Rect)
+	}
+	for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+		for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+			if v, w := m.YCbCrAt(x, y), want.YCbCrAt(x, y); v != w {
+				t.Fatalf("%v: pixel (%d, %d) = %v, want %v", want.Layout, x, y, v, w)
+			}
+		}
+	}
+}
+
+func TestEncodeAndDecode_YUV(t *testing.T) {
+	for _, layout := range []YUVLayout{YUVI420, YUVNV12, YUVI422} {
+		for _, r := range []image.Rectangle{image.Rect(0, 0, 8, 6), image.Rect(-4, 2, 9, 9)} {
+			m0 := tNewYUVImage(r, layout)
+			for _, opt := range []*Options{nil, {UseSnappy: true}, {UseSnappy: true, BlockSize: 16}} {
+				var buf bytes.Buffer
+				if err := Encode(&buf, m0, opt); err != nil {
+					t.Fatalf("%v %v: %v", layout, r, err)
+				}
+				data := buf.Bytes()
+
+				h, err := DecodeHeader(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if h.YUV != layout || h.Channels != 3 || h.Kind != reflect.Uint8 {
+					t.Fatalf("%v: header = %+v", layout, h)
+				}
+
+				m1, err := DecodeYUV(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("%v %v: %v", layout, r, err)
+				}
+				if err := m1.Validate(); err != nil {
+					t.Fatal(err)
+				}
+				tCheckYUV(t, m1, m0)
+
+				m2, err := Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				std, ok := m2.(*image.YCbCr)
+				if !ok || std.SubsampleRatio != layout.subsampleRatio() || std.Rect != r {
+					t.Fatalf("%v: Decode = %T", layout, m2)
+				}
+				for y := r.Min.Y; y < r.Max.Y; y++ {
+					for x := r.Min.X; x < r.Max.X; x++ {
+						if v, w := std.YCbCrAt(x, y), m0.YCbCrAt(x, y); v != w {
+							t.Fatalf("%v: Decode pixel (%d, %d) = %v, want %v", layout, x, y, v, w)
+						}
+					}
+				}
+
+				m3, err := DecodeImage(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m3.XChannels != 3 || m3.XDataType != reflect.Uint8 || m3.Bounds() != r {
+					t.Fatalf("%v: DecodeImage = %d channels, %v, %v", layout, m3.XChannels, m3.XDataType, m3.Bounds())
+				}
+				for y := r.Min.Y; y < r.Max.Y; y++ {
+					for x := r.Min.X; x < r.Max.X; x++ {
+						c := m0.YCbCrAt(x, y)
+						r, g, b := color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+						if v := m3.PixelAt(x, y); v[0] != r || v[1] != g || v[2] != b {
+							t.Fatalf("%v: DecodeImage pixel (%d, %d) = %v, want %v", layout, x, y, v, []byte{r, g, b})
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestYUVImage_std(t *testing.T) {
+	for _, layout := range []YUVLayout{YUVI420, YUVNV12, YUVI422} {
+		m0 := tNewYUVImage(image.Rect(2, -2, 11, 7), layout)
+		std := m0.StdImage()
+		if std.Rect != m0.Rect || std.SubsampleRatio != layout.subsampleRatio() {
+			t.Fatalf("%v: StdImage = %v %v", layout, std.Rect, std.SubsampleRatio)
+		}
+		m1, err := NewYUVImageFrom(std, layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tCheckYUV(t, m1, m0)
+	}
+
+	std := image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio444)
+	if _, err := NewYUVImageFrom(std, YUVI420); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("444: expect = %v, got = %v", ErrUnsupported, err)
+	}
+	std.SubsampleRatio = image.YCbCrSubsampleRatio422
+	if _, err := NewYUVImageFrom(std, YUVNV12); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("422 as NV12: expect = %v, got = %v", ErrUnsupported, err)
+	}
+}
+
+func TestEncodeAndDecode_YUVErrors(t *testing.T) {
+	// chroma planes need an even origin
+	for _, m := range []*YUVImage{
+		tNewYUVImage(image.Rect(1, 0, 5, 4), YUVI422),
+		tNewYUVImage(image.Rect(0, 1, 4, 5), YUVI420),
+	} {
+		if err := Encode(new(bytes.Buffer), m, nil); !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("%v %v: expect = %v, got = %v", m.Layout, m.Rect, ErrUnsupported, err)
+		}
+	}
+	if err := Encode(new(bytes.Buffer), tNewYUVImage(image.Rect(0, 1, 4, 5), YUVI422), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m := tNewYUVImage(image.Rect(0, 0, 4, 4), YUVI420)
+	m.Cr = m.Cr[:1]
+	if err := Encode(new(bytes.Buffer), m, nil); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("Cr: expect = %v, got = %v", ErrTruncated, err)
+	}
+
+	// DecodeYUV only reads YUV frames
+	var buf bytes.Buffer
+	if err := Encode(&buf, NewMemPImage(image.Rect(0, 0, 4, 4), 3, reflect.Uint8), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeYUV(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("DecodeYUV: expect = %v, got = %v", ErrUnsupported, err)
+	}
+
+	// YUV frames are 3 channel Uint8
+	buf.Reset()
+	if err := Encode(&buf, NewMemPImage(image.Rect(0, 0, 4, 4), 1, reflect.Uint8), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[15] |= byte(YUVI420) << rawpFlag_YUVShift
+	if _, err := DecodeHeader(bytes.NewReader(data)); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("DecodeHeader: expect = %v, got = %v", ErrUnsupported, err)
+	}
+}
+
+func TestEncode_YCbCr(t *testing.T) {
+	for _, v := range []struct {
+		layout YUVLayout
+		r      image.Rectangle
+	}{
+		{YUVI420, image.Rect(0, 0, 8, 6)},
+		{YUVI420, image.Rect(-4, 2, 9, 9)},
+		{YUVI422, image.Rect(2, -3, 11, 7)},
+	} {
+		std := tNewYUVImage(v.r, v.layout).StdImage()
+
+		// RGBA by default
+		var buf bytes.Buffer
+		if err := Encode(&buf, std, nil); err != nil {
+			t.Fatalf("%v %v: %v", v.layout, v.r, err)
+		}
+		h, err := DecodeHeader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.YUV != YUVNone || h.Channels != 4 {
+			t.Fatalf("%v %v: header = %+v", v.layout, v.r, h)
+		}
+
+		buf.Reset()
+		if err := Encode(&buf, std, &Options{YUV: true}); err != nil {
+			t.Fatalf("%v %v: %v", v.layout, v.r, err)
+		}
+		if h, err = DecodeHeader(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if h.YUV != v.layout {
+			t.Fatalf("%v %v: YUV = %v", v.layout, v.r, h.YUV)
+		}
+		m, err := DecodeYUV(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tCheckYUV(t, m, tNewYUVImage(v.r, v.layout))
+	}
+
+	for _, std := range []*image.YCbCr{
+		image.NewYCbCr(image.Rect(0, 0, 4, 4), image.YCbCrSubsampleRatio444),
+		tNewYUVImage(image.Rect(1, 0, 9, 6), YUVI420).StdImage(),
+	} {
+		if err := Encode(new(bytes.Buffer), std, &Options{YUV: true}); !errors.Is(err, ErrUnsupported) {
+			t.Fatalf("%v %v: expect = %v, got = %v", std.SubsampleRatio, std.Rect, ErrUnsupported, err)
+		}
+	}
+}